@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+var (
+	// generateAltText describes each image with a Gemini text model
+	// (GENERATE_ALT_TEXT).
+	generateAltText bool
+	// altTextModel writes the descriptions (ALT_TEXT_MODEL).
+	altTextModel = "gemini-2.5-flash"
+)
+
+// maxAltTextChars keeps alt text short enough for screen readers and for
+// S3's 2 KB user metadata limit.
+const maxAltTextChars = 300
+
+const altTextInstruction = "Write alt text for this image: one or two plain sentences describing what it shows, " +
+	"for a screen reader user. Don't start with \"Image of\" and don't mention that it was generated."
+
+// describeImage returns alt text for an encoded image.
+func describeImage(ctx context.Context, data []byte, contentType string) (string, error) {
+	contents := []*genai.Content{genai.NewContentFromParts([]*genai.Part{
+		genai.NewPartFromText(altTextInstruction),
+		genai.NewPartFromBytes(data, contentType),
+	}, genai.RoleUser)}
+	if err := genaiLimit.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer genaiLimit.release()
+	resp, err := genaiClient.Models.GenerateContent(ctx, altTextModel, contents, &genai.GenerateContentConfig{
+		MaxOutputTokens: 200,
+	})
+	if err != nil {
+		return "", err
+	}
+	alt := strings.Join(strings.Fields(resp.Text()), " ")
+	if alt == "" {
+		return "", errors.New("model returned no alt text")
+	}
+	if r := []rune(alt); len(r) > maxAltTextChars {
+		alt = string(r[:maxAltTextChars-1]) + "…"
+	}
+	return alt, nil
+}
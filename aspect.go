@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// supportedAspectRatios are the ratios Imagen accepts.
+var supportedAspectRatios = map[string]bool{
+	"1:1":  true,
+	"3:4":  true,
+	"4:3":  true,
+	"9:16": true,
+	"16:9": true,
+}
+
+// aspectRatioOrder lists supportedAspectRatios from tallest to widest.
+var aspectRatioOrder = []string{"9:16", "3:4", "1:1", "4:3", "16:9"}
+
+var (
+	// modelAspectRatios lists the aspect ratios each model accepts
+	// (MODEL_ASPECT_RATIOS). Models missing from the map accept them all.
+	modelAspectRatios = map[string][]string{}
+	// autoAdjustAspect moves a ratio the model doesn't accept to the nearest
+	// one it does, instead of rejecting the request (AUTO_ADJUST_ASPECT).
+	autoAdjustAspect bool
+)
+
+// aspectRatioAliases maps named ratios, lower-cased, to their canonical form.
+var aspectRatioAliases = map[string]string{
+	"square":    "1:1",
+	"portrait":  "3:4",
+	"landscape": "4:3",
+}
+
+// aspectPromptHints maps an aspect ratio to composition hint text appended
+// to prompts generated at it (ASPECT_PROMPT_HINTS), e.g. "wide cinematic
+// shot" for 16:9.
+var aspectPromptHints = map[string]string{}
+
+// parseAspectPromptHints reads ASPECT_PROMPT_HINTS, normalizing its ratios.
+// Hints must be supported ratios and pass the same screening as prompts.
+func parseAspectPromptHints(raw string) (map[string]string, error) {
+	var in map[string]string
+	if err := json.Unmarshal([]byte(raw), &in); err != nil {
+		return nil, err
+	}
+	hints := make(map[string]string, len(in))
+	for ratio, hint := range in {
+		r, err := normalizeAspectRatio(ratio)
+		if err != nil {
+			return nil, err
+		}
+		hint = strings.TrimSpace(hint)
+		if clean, err := sanitizePrompt(hint); err != nil || clean != hint || hint == "" {
+			return nil, fmt.Errorf("hint for %s must be non-empty printable text", ratio)
+		}
+		hints[r] = hint
+	}
+	return hints, nil
+}
+
+// modelPrompt is the prompt sent to the model: prompt with the hint for
+// ratio appended, if there is one. Keys and metadata keep the caller's prompt.
+func modelPrompt(prompt, ratio string) string {
+	hint, ok := aspectPromptHints[ratio]
+	if !ok {
+		return prompt
+	}
+	return strings.TrimRight(strings.TrimSpace(prompt), ".,; ") + ", " + hint
+}
+
+// normalizeAspectRatio maps an aspect ratio onto the form Imagen expects.
+// It accepts the aliases above and "W:H" or "WxH" in any casing, reducing
+// the ratio so that e.g. "1920x1080" becomes "16:9".
+func normalizeAspectRatio(ratio string) (string, error) {
+	ratio = strings.TrimSpace(ratio)
+	if alias, ok := aspectRatioAliases[strings.ToLower(ratio)]; ok {
+		ratio = alias
+	} else if w, h, ok := splitRatio(ratio); ok {
+		g := gcd(w, h)
+		ratio = fmt.Sprintf("%d:%d", w/g, h/g)
+	}
+	if !supportedAspectRatios[ratio] {
+		return "", fmt.Errorf("unsupported aspect ratio %q (supported: 1:1, 3:4, 4:3, 9:16, 16:9)", ratio)
+	}
+	return ratio, nil
+}
+
+// parseModelAspectRatios reads MODEL_ASPECT_RATIOS, a JSON object mapping
+// model names to the ratios they accept.
+func parseModelAspectRatios(raw string) (map[string][]string, error) {
+	var in map[string][]string
+	if err := json.Unmarshal([]byte(raw), &in); err != nil {
+		return nil, err
+	}
+	out := make(map[string][]string, len(in))
+	for model, ratios := range in {
+		if len(ratios) == 0 {
+			return nil, fmt.Errorf("model %s lists no aspect ratios", model)
+		}
+		for _, ratio := range ratios {
+			r, err := normalizeAspectRatio(ratio)
+			if err != nil {
+				return nil, fmt.Errorf("model %s: %w", model, err)
+			}
+			out[model] = append(out[model], r)
+		}
+	}
+	return out, nil
+}
+
+// modelSupportsAspect reports whether model accepts the normalized ratio.
+func modelSupportsAspect(model, ratio string) bool {
+	ratios, ok := modelAspectRatios[model]
+	if !ok {
+		return true
+	}
+	for _, r := range ratios {
+		if r == ratio {
+			return true
+		}
+	}
+	return false
+}
+
+// nearestAspectRatio returns the ratio model accepts that is closest in
+// shape to ratio. Shapes are compared on a log scale, so 16:9 is as far from
+// 1:1 as 9:16 is; ties go to the taller ratio.
+func nearestAspectRatio(model, ratio string) string {
+	w, h, _ := splitRatio(ratio)
+	want := math.Log(float64(w) / float64(h))
+	best, bestDist := "", math.Inf(1)
+	for _, r := range aspectRatioOrder {
+		if !modelSupportsAspect(model, r) {
+			continue
+		}
+		rw, rh, _ := splitRatio(r)
+		if d := math.Abs(math.Log(float64(rw)/float64(rh)) - want); d < bestDist {
+			best, bestDist = r, d
+		}
+	}
+	return best
+}
+
+// fitAspectRatio checks a normalized ratio against model. With
+// AUTO_ADJUST_ASPECT an unsupported ratio becomes the nearest supported one;
+// otherwise it is an error.
+func fitAspectRatio(model, ratio string) (string, error) {
+	if modelSupportsAspect(model, ratio) {
+		return ratio, nil
+	}
+	if !autoAdjustAspect {
+		return "", fmt.Errorf("aspect ratio %s is not supported by model %s (supported: %s)", ratio, model, strings.Join(modelAspectRatios[model], ", "))
+	}
+	return nearestAspectRatio(model, ratio), nil
+}
+
+// splitRatio parses "W:H" or "WxH" into two positive integers.
+func splitRatio(s string) (int, int, bool) {
+	i := strings.IndexAny(s, ":xX")
+	if i < 0 {
+		return 0, 0, false
+	}
+	w, err := strconv.Atoi(strings.TrimSpace(s[:i]))
+	if err != nil || w <= 0 {
+		return 0, 0, false
+	}
+	h, err := strconv.Atoi(strings.TrimSpace(s[i+1:]))
+	if err != nil || h <= 0 {
+		return 0, 0, false
+	}
+	return w, h, true
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
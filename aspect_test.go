@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestNormalizeAspectRatio(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "16:9", want: "16:9"},
+		{in: " 4:3 ", want: "4:3"},
+		{in: "Square", want: "1:1"},
+		{in: "portrait", want: "3:4"},
+		{in: "1920x1080", want: "16:9"},
+		{in: "1080X1920", want: "9:16"},
+		{in: "2:2", want: "1:1"},
+		{in: "21:9", wantErr: true},
+		{in: "wide", wantErr: true},
+		{in: "0:1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeAspectRatio(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeAspectRatio(%q) = %q, %v; want %q, error %t", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestFitAspectRatio(t *testing.T) {
+	defer func(m map[string][]string, auto bool) { modelAspectRatios, autoAdjustAspect = m, auto }(modelAspectRatios, autoAdjustAspect)
+	modelAspectRatios = map[string][]string{"square-only": {"1:1"}, "wide": {"1:1", "16:9"}}
+	tests := []struct {
+		name    string
+		model   string
+		ratio   string
+		auto    bool
+		want    string
+		wantErr bool
+	}{
+		{name: "unlisted model accepts all", model: "other", ratio: "9:16", want: "9:16"},
+		{name: "supported", model: "wide", ratio: "16:9", want: "16:9"},
+		{name: "unsupported", model: "square-only", ratio: "16:9", wantErr: true},
+		{name: "adjusted to only ratio", model: "square-only", ratio: "16:9", auto: true, want: "1:1"},
+		{name: "adjusted to nearest", model: "wide", ratio: "4:3", auto: true, want: "1:1"},
+		{name: "adjusted wide", model: "wide", ratio: "9:16", auto: true, want: "1:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			autoAdjustAspect = tt.auto
+			got, err := fitAspectRatio(tt.model, tt.ratio)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("fitAspectRatio(%q, %q) = %q, %v; want %q, error %t", tt.model, tt.ratio, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseModelAspectRatios(t *testing.T) {
+	got, err := parseModelAspectRatios(`{"m": ["landscape", "1920x1080"]}`)
+	if err != nil {
+		t.Fatalf("parseModelAspectRatios() error = %v", err)
+	}
+	if r := got["m"]; len(r) != 2 || r[0] != "4:3" || r[1] != "16:9" {
+		t.Errorf("parseModelAspectRatios() = %v, want m: [4:3 16:9]", got)
+	}
+	for _, raw := range []string{`{"m": []}`, `{"m": ["21:9"]}`, `not json`} {
+		if _, err := parseModelAspectRatios(raw); err == nil {
+			t.Errorf("parseModelAspectRatios(%s) succeeded, want an error", raw)
+		}
+	}
+}
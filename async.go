@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	// pending tracks background work started during the current invocation.
+	// Lambda runs one invocation per container at a time, so a single group
+	// is enough.
+	pending sync.WaitGroup
+	// flushTimeout bounds how long flushAsync waits (FLUSH_TIMEOUT_MS).
+	flushTimeout = 2 * time.Second
+)
+
+// runAsync runs fn in the background. Handlers wait for it in flushAsync
+// before returning, since Lambda may freeze the container as soon as the
+// response is sent and in-flight work would be lost.
+func runAsync(name string, fn func()) {
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("background %s panicked: %v", name, r)
+			}
+		}()
+		fn()
+	}()
+}
+
+// flushAsync waits for background work started by runAsync, giving up after
+// flushTimeout or at the invocation deadline, whichever comes first.
+func flushAsync(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+
+	wait := flushTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < wait {
+			wait = left
+		}
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Printf("gave up waiting for background work after %v", wait)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"path"
+	"sort"
+	"strings"
+)
+
+// atlasFrame is the rectangle one image occupies in a texture atlas.
+type atlasFrame struct {
+	Name   string `json:"name"`  // the image's object name without extension
+	Index  int    `json:"index"` // position in imageUrls
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// textureAtlas is the .atlas.json uploaded next to an atlas image.
+type textureAtlas struct {
+	Image  string       `json:"image"` // file name of the atlas image, relative to the JSON
+	Width  int          `json:"width"`
+	Height int          `json:"height"`
+	Frames []atlasFrame `json:"frames"`
+}
+
+// packAtlas places rectangles of the given sizes without overlap using
+// shelf packing: tallest first, left to right, in rows roughly as wide as
+// a square of the total area. It returns each rectangle's position and the
+// overall atlas size.
+func packAtlas(sizes []image.Point) (placed []image.Point, width, height int) {
+	if len(sizes) == 0 {
+		return nil, 0, 0
+	}
+	var area float64
+	var widest int
+	for _, s := range sizes {
+		area += float64(s.X) * float64(s.Y)
+		widest = max(widest, s.X)
+	}
+	rowWidth := max(widest, int(math.Ceil(math.Sqrt(area))))
+
+	order := make([]int, len(sizes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return sizes[order[a]].Y > sizes[order[b]].Y })
+
+	placed = make([]image.Point, len(sizes))
+	var x, y, shelf int
+	for _, i := range order {
+		s := sizes[i]
+		if x > 0 && x+s.X > rowWidth {
+			x, y, shelf = 0, y+shelf, 0
+		}
+		placed[i] = image.Pt(x, y)
+		x += s.X
+		shelf = max(shelf, s.Y)
+		width = max(width, x)
+	}
+	return placed, width, y + shelf
+}
+
+// composeAtlas packs imgs into one image. Each image is named after its
+// key in keys.
+func composeAtlas(imgs []image.Image, keys []string) (*image.RGBA, textureAtlas) {
+	sizes := make([]image.Point, len(imgs))
+	for i, img := range imgs {
+		sizes[i] = img.Bounds().Size()
+	}
+	placed, w, h := packAtlas(sizes)
+	sheet := image.NewRGBA(image.Rect(0, 0, w, h))
+	atlas := textureAtlas{Width: w, Height: h, Frames: make([]atlasFrame, len(imgs))}
+	for i, img := range imgs {
+		r := image.Rectangle{Min: placed[i], Max: placed[i].Add(sizes[i])}
+		draw.Draw(sheet, r, img, img.Bounds().Min, draw.Src)
+		name := path.Base(keys[i])
+		atlas.Frames[i] = atlasFrame{
+			Name:   strings.TrimSuffix(name, path.Ext(name)),
+			Index:  i,
+			X:      r.Min.X,
+			Y:      r.Min.Y,
+			Width:  sizes[i].X,
+			Height: sizes[i].Y,
+		}
+	}
+	return sheet, atlas
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestPackAtlas(t *testing.T) {
+	tests := []struct {
+		name       string
+		sizes      []image.Point
+		wantWidth  int
+		wantHeight int
+	}{
+		{"empty", nil, 0, 0},
+		{"one", []image.Point{{10, 20}}, 10, 20},
+		{"four squares make a square", []image.Point{{10, 10}, {10, 10}, {10, 10}, {10, 10}}, 20, 20},
+		{"tallest first", []image.Point{{10, 5}, {10, 20}, {10, 5}}, 10, 30},
+		{"row no narrower than the widest", []image.Point{{40, 1}, {1, 1}}, 40, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			placed, w, h := packAtlas(tt.sizes)
+			if w != tt.wantWidth || h != tt.wantHeight {
+				t.Errorf("packAtlas() size %dx%d, want %dx%d", w, h, tt.wantWidth, tt.wantHeight)
+			}
+			rects := make([]image.Rectangle, len(tt.sizes))
+			for i, s := range tt.sizes {
+				rects[i] = image.Rectangle{Min: placed[i], Max: placed[i].Add(s)}
+				if !rects[i].In(image.Rect(0, 0, w, h)) {
+					t.Errorf("rectangle %d at %v is outside the %dx%d atlas", i, rects[i], w, h)
+				}
+				for j := range i {
+					if rects[i].Overlaps(rects[j]) {
+						t.Errorf("rectangles %d %v and %d %v overlap", i, rects[i], j, rects[j])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestComposeAtlas(t *testing.T) {
+	red := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	red.Set(0, 0, color.RGBA{R: 255, A: 255})
+	blue := image.NewRGBA(image.Rect(0, 0, 2, 8))
+	blue.Set(0, 0, color.RGBA{B: 255, A: 255})
+	sheet, atlas := composeAtlas([]image.Image{red, blue}, []string{"out/imagen_0_x.png", "out/imagen_1_x.png"})
+
+	if atlas.Width != sheet.Bounds().Dx() || atlas.Height != sheet.Bounds().Dy() {
+		t.Fatalf("atlas says %dx%d, sheet is %v", atlas.Width, atlas.Height, sheet.Bounds())
+	}
+	tests := []struct {
+		frame atlasFrame
+		want  color.RGBA
+	}{
+		{atlasFrame{Name: "imagen_0_x", Index: 0, Width: 4, Height: 4}, color.RGBA{R: 255, A: 255}},
+		{atlasFrame{Name: "imagen_1_x", Index: 1, Width: 2, Height: 8}, color.RGBA{B: 255, A: 255}},
+	}
+	for i, tt := range tests {
+		f := atlas.Frames[i]
+		if f.Name != tt.frame.Name || f.Index != tt.frame.Index || f.Width != tt.frame.Width || f.Height != tt.frame.Height {
+			t.Errorf("frame %d = %+v, want %+v", i, f, tt.frame)
+		}
+		if got := sheet.RGBAAt(f.X, f.Y); got != tt.want {
+			t.Errorf("frame %d corner pixel = %v, want %v", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/gen2brain/avif"
+)
+
+// AVIF output for outputFormat "avif". The encoder is pure Go (WebAssembly),
+// so the function needs no native libraries.
+const (
+	minAVIFQuality = 1
+	maxAVIFQuality = 100
+)
+
+// avifAvailable is false when the startup check found the encoder unusable;
+// AVIF requests are then refused rather than failing after generation.
+var avifAvailable bool
+
+// checkAVIF encodes a 1x1 image to confirm the encoder works here.
+func checkAVIF() error {
+	var buf bytes.Buffer
+	return avif.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1)), avif.Options{Quality: avif.DefaultQuality, Speed: avif.DefaultSpeed})
+}
+
+// encodeAVIF transcodes generated PNG or JPEG bytes to AVIF at quality
+// (1-100, 0 for the encoder default).
+func encodeAVIF(data []byte, quality int) ([]byte, error) {
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	if quality == 0 {
+		quality = avif.DefaultQuality
+	}
+	var buf bytes.Buffer
+	if err := avif.Encode(&buf, img, avif.Options{Quality: quality, Speed: avif.DefaultSpeed}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
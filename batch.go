@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	// maxPromptsPerBatch caps len(prompts) (MAX_PROMPTS_PER_BATCH).
+	maxPromptsPerBatch = 4
+	// maxImagesPerPrompt caps numberOfImages for each prompt (MAX_IMAGES_PER_PROMPT).
+	maxImagesPerPrompt = 4
+)
+
+// checkImageLimits validates a request for prompts prompts of perPrompt
+// images each against all three limits, reporting every limit exceeded.
+func checkImageLimits(prompts, perPrompt int) *requestError {
+	var hit []string
+	if prompts > maxPromptsPerBatch {
+		hit = append(hit, fmt.Sprintf("%d prompts exceeds MAX_PROMPTS_PER_BATCH (%d)", prompts, maxPromptsPerBatch))
+	}
+	if perPrompt > maxImagesPerPrompt {
+		hit = append(hit, fmt.Sprintf("numberOfImages %d exceeds MAX_IMAGES_PER_PROMPT (%d)", perPrompt, maxImagesPerPrompt))
+	}
+	if total := prompts * perPrompt; total > maxImages {
+		hit = append(hit, fmt.Sprintf("%d images in total exceeds MAX_IMAGES (%d)", total, maxImages))
+	}
+	if len(hit) == 0 {
+		return nil
+	}
+	return &requestError{status: http.StatusBadRequest, msg: "request exceeds limits: " + strings.Join(hit, "; ")}
+}
+
+// run executes a parsed request, generating each prompt of a batch in turn
+// or each model of a comparison.
+// A batch's results come back in Results, in prompt order.
+func run(ctx context.Context, in requestPayload, onUpload func(uploadProgress)) (responsePayload, *requestError) {
+	if len(in.CompareModels) > 0 {
+		return compareModels(ctx, in, onUpload)
+	}
+	if len(in.Prompts) == 0 {
+		return generate(ctx, in, onUpload)
+	}
+	var out responsePayload
+	for i, prompt := range in.Prompts {
+		one := in
+		one.Prompt = prompt
+		one.Prompts = nil
+		if in.promptLanguages != nil {
+			one.originalPrompt, one.promptLanguage = in.originalPrompts[i], in.promptLanguages[i]
+		}
+		// Keep keys of different prompts apart under the flat key strategy
+		one.namePrefix = fmt.Sprintf("p%d_", i)
+		res, reqErr := generate(ctx, one, onUpload)
+		if reqErr != nil {
+			reqErr.msg = fmt.Sprintf("prompt %d: %s", i, reqErr.msg)
+			return responsePayload{}, reqErr
+		}
+		out.Results = append(out.Results, res)
+		if res.Partial {
+			// Out of time: later prompts are not attempted
+			out.Partial = true
+			break
+		}
+	}
+	// Batch-wide fields mirror the last prompt's result
+	last := out.Results[len(out.Results)-1]
+	out.ImageURLs = []string{}
+	out.Model = last.Model
+	out.ClientToken = last.ClientToken
+	return out, nil
+}
+
+// loadRequestLimits reads the per-request defaults and bounds, then the
+// tenant and quality preset settings checked against them.
+func loadRequestLimits() {
+	var err error
+	// Aspect ratio used when a request omits one
+	defaultAspectRatio = "1:1"
+	if v := os.Getenv("DEFAULT_ASPECT_RATIO"); v != "" {
+		defaultAspectRatio, err = normalizeAspectRatio(v)
+		if err != nil {
+			log.Fatalf("invalid DEFAULT_ASPECT_RATIO: %v", err)
+		}
+	}
+
+	// Per-request image count bounds
+	maxImages = envInt("MAX_IMAGES", 4)
+	maxPromptsPerBatch = envInt("MAX_PROMPTS_PER_BATCH", maxPromptsPerBatch)
+	maxImagesPerPrompt = envInt("MAX_IMAGES_PER_PROMPT", maxImagesPerPrompt)
+	minImages = envInt("MIN_IMAGES", 1)
+	if minImages > maxImages {
+		log.Fatalf("MIN_IMAGES (%d) must not exceed MAX_IMAGES (%d)", minImages, maxImages)
+	}
+	defaultNumberOfImages = envInt("DEFAULT_NUMBER_OF_IMAGES", 1)
+	if limit := min(maxImages, maxImagesPerPrompt); defaultNumberOfImages > limit {
+		log.Fatalf("DEFAULT_NUMBER_OF_IMAGES (%d) must not exceed MAX_IMAGES or MAX_IMAGES_PER_PROMPT (%d)", defaultNumberOfImages, limit)
+	}
+
+	// Per-API-key defaults, checked against the global limits above
+	if v := os.Getenv("TENANT_CONFIG"); v != "" {
+		if tenantConfigs, err = parseTenantConfig(v); err != nil {
+			log.Fatalf("invalid TENANT_CONFIG: %v", err)
+		}
+	}
+	if v := os.Getenv("QUALITY_PRESETS"); v != "" {
+		if qualityPresets, err = parseQualityPresets(v); err != nil {
+			log.Fatalf("invalid QUALITY_PRESETS: %v", err)
+		}
+	}
+}
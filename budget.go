@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// generationBudget is the longest a request is estimated to be allowed
+	// to take (GENERATION_BUDGET_SECONDS); zero disables the check.
+	generationBudget time.Duration
+	// secondsPerImage is the estimated generation time of one 1K image on a
+	// standard model (SECONDS_PER_IMAGE).
+	secondsPerImage = 6
+)
+
+// estimateImageTime estimates how long model takes to generate one image
+// of size. 2K images and Ultra models each take about twice as long.
+func estimateImageTime(model, size string) time.Duration {
+	d := time.Duration(secondsPerImage) * time.Second
+	if size == "2K" {
+		d *= 2
+	}
+	if strings.Contains(model, "ultra") {
+		d *= 2
+	}
+	return d
+}
+
+// estimateDuration estimates how long the request will take to generate.
+// Batch prompts run one after another; compared models run
+// compareConcurrency at a time.
+func estimateDuration(in requestPayload) time.Duration {
+	n := time.Duration(in.NumberOfImages)
+	if len(in.CompareModels) > 0 {
+		var total time.Duration
+		for _, m := range in.CompareModels {
+			total += n * estimateImageTime(m, in.ImageSize)
+		}
+		return total / time.Duration(min(compareConcurrency, len(in.CompareModels)))
+	}
+	model := imagenModel
+	if in.ReferenceImage != "" {
+		model = editModel
+	}
+	if in.model != "" {
+		// Picked by a quality preset or the tenant, as in generateWithFallback
+		model = in.model
+	}
+	prompts := time.Duration(max(len(in.Prompts), 1))
+	return prompts * n * estimateImageTime(model, in.ImageSize)
+}
+
+// checkBudget rejects requests estimated to run past generationBudget.
+func checkBudget(in requestPayload) *requestError {
+	if generationBudget == 0 {
+		return nil
+	}
+	if est := estimateDuration(in); est > generationBudget {
+		return &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf(
+			"request is estimated to take %v, over the %v budget; ask for fewer images or a smaller imageSize, or use fastFirst with response streaming",
+			est, generationBudget)}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEstimateDuration(t *testing.T) {
+	defer func(s int, c int) { secondsPerImage, compareConcurrency = s, c }(secondsPerImage, compareConcurrency)
+	secondsPerImage, compareConcurrency = 6, 2
+	const unit = 6 * time.Second
+	tests := []struct {
+		name string
+		in   requestPayload
+		want time.Duration
+	}{
+		{"one image", requestPayload{NumberOfImages: 1}, unit},
+		{"2K doubles", requestPayload{NumberOfImages: 2, ImageSize: "2K"}, 4 * unit},
+		{"batch prompts run in turn", requestPayload{NumberOfImages: 2, Prompts: []string{"a", "b", "c"}}, 6 * unit},
+		{"preset or tenant model", requestPayload{NumberOfImages: 1, model: "imagen-4.0-ultra-generate-001"}, 2 * unit},
+		{"model wins over edit model", requestPayload{NumberOfImages: 1, ReferenceImage: "s3://b/k", model: "imagen-4.0-ultra-generate-001"}, 2 * unit},
+		{"compared models in parallel", requestPayload{NumberOfImages: 1, CompareModels: []string{"a", "b-ultra", "c"}}, 2 * unit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateDuration(tt.in); got != tt.want {
+				t.Errorf("estimateDuration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckBudget(t *testing.T) {
+	defer func(b time.Duration, s int) { generationBudget, secondsPerImage = b, s }(generationBudget, secondsPerImage)
+	secondsPerImage = 6
+	tests := []struct {
+		name   string
+		budget time.Duration
+		in     requestPayload
+		reject bool
+	}{
+		{"disabled", 0, requestPayload{NumberOfImages: 100}, false},
+		{"within budget", 30 * time.Second, requestPayload{NumberOfImages: 4}, false},
+		{"at the budget", 24 * time.Second, requestPayload{NumberOfImages: 4}, false},
+		{"over budget", 30 * time.Second, requestPayload{NumberOfImages: 4, ImageSize: "2K"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generationBudget = tt.budget
+			reqErr := checkBudget(tt.in)
+			if (reqErr != nil) != tt.reject {
+				t.Fatalf("checkBudget() = %+v, want reject %v", reqErr, tt.reject)
+			}
+			if reqErr != nil && reqErr.status != http.StatusBadRequest {
+				t.Errorf("checkBudget() status = %d, want 400", reqErr.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cfDecode reverses CloudFront's base64 variant.
+func cfDecode(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := base64.StdEncoding.DecodeString(strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(s))
+	if err != nil {
+		t.Fatalf("decoding %q: %v", s, err)
+	}
+	return b
+}
+
+func TestCDNURLSigner(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &cdnURLSigner{keyPairID: "KTEST", key: key}
+	expires := time.Unix(1700000000, 0)
+	const resource = "https://d111.cloudfront.net/images/a.png"
+
+	tests := []struct {
+		name   string
+		url    string
+		ip     string
+		policy string
+	}{
+		{"canned", resource, "", `{"Statement":[{"Resource":"` + resource + `","Condition":{"DateLessThan":{"AWS:EpochTime":1700000000}}}]}`},
+		{"canned with query", resource + "?v=2", "", `{"Statement":[{"Resource":"` + resource + `?v=2","Condition":{"DateLessThan":{"AWS:EpochTime":1700000000}}}]}`},
+		{"ip", resource, "203.0.113.7/32", `{"Statement":[{"Resource":"` + resource + `","Condition":{"IpAddress":{"AWS:SourceIp":"203.0.113.7/32"},"DateLessThan":{"AWS:EpochTime":1700000000}}}]}`},
+	}
+	for _, tt := range tests {
+		var signed string
+		if tt.ip == "" {
+			signed, err = s.sign(tt.url, expires)
+		} else {
+			signed, err = s.signForIP(tt.url, expires, tt.ip)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !strings.HasPrefix(signed, tt.url) {
+			t.Errorf("%s: %s doesn't start with %s", tt.name, signed, tt.url)
+		}
+		u, err := url.Parse(signed)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		q := u.Query()
+		if got := q.Get("Key-Pair-Id"); got != "KTEST" {
+			t.Errorf("%s: Key-Pair-Id = %q", tt.name, got)
+		}
+		if tt.ip == "" {
+			if got := q.Get("Expires"); got != "1700000000" {
+				t.Errorf("%s: Expires = %q", tt.name, got)
+			}
+		} else if got := string(cfDecode(t, q.Get("Policy"))); got != tt.policy {
+			t.Errorf("%s: Policy = %s, want %s", tt.name, got, tt.policy)
+		}
+		sum := sha1.Sum([]byte(tt.policy))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, sum[:], cfDecode(t, q.Get("Signature"))); err != nil {
+			t.Errorf("%s: signature doesn't verify: %v", tt.name, err)
+		}
+	}
+}
+
+func TestParseCDNPrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, block := range map[string]*pem.Block{
+		"pkcs1": {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+		"pkcs8": {Type: "PRIVATE KEY", Bytes: pkcs8},
+	} {
+		got, err := parseCDNPrivateKey(pem.EncodeToMemory(block))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !got.Equal(key) {
+			t.Errorf("%s: parsed a different key", name)
+		}
+	}
+	if _, err := parseCDNPrivateKey([]byte("not a key")); err == nil {
+		t.Error("parsed a key from garbage")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/genai"
+)
+
+// vertexBackend is set when GenAI calls go to Vertex AI (GENAI_BACKEND=vertex).
+var vertexBackend bool
+
+// vertexScope is the OAuth scope Vertex AI calls are authorized with.
+const vertexScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// genaiClientConfig builds the GenAI client config. endpoint and apiVersion
+// override the SDK's default base URL and API version when non-empty
+// (GENAI_API_ENDPOINT, GENAI_API_VERSION).
+func genaiClientConfig(apiKey, endpoint, apiVersion string) (*genai.ClientConfig, error) {
+	cfg := &genai.ClientConfig{
+		APIKey:     apiKey,
+		Backend:    genai.BackendGeminiAPI,
+		HTTPClient: &http.Client{Transport: traceTransport{base: http.DefaultTransport}},
+	}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Scheme != "https" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("GENAI_API_ENDPOINT must be an https URL such as https://generativelanguage.googleapis.com/, got %q", endpoint)
+		}
+		cfg.HTTPOptions.BaseURL = endpoint
+	}
+	cfg.HTTPOptions.APIVersion = apiVersion
+	return cfg, nil
+}
+
+// useVertex switches cfg to the Vertex AI backend in project and location
+// (GENAI_BACKEND=vertex). Vertex authenticates with Google application
+// default credentials, e.g. GOOGLE_APPLICATION_CREDENTIALS, not an API key.
+// The SDK only adds credentials to clients it builds itself, so the traced
+// client gets an ADC-authorized transport here.
+func useVertex(ctx context.Context, cfg *genai.ClientConfig, project, location string) error {
+	if project == "" || location == "" {
+		return errors.New("GOOGLE_CLOUD_PROJECT and GOOGLE_CLOUD_LOCATION must be set")
+	}
+	creds, err := google.FindDefaultCredentials(ctx, vertexScope)
+	if err != nil {
+		return fmt.Errorf("loading application default credentials: %w", err)
+	}
+	cfg.HTTPClient = &http.Client{Transport: traceTransport{base: &oauth2.Transport{Source: creds.TokenSource, Base: http.DefaultTransport}}}
+	cfg.Backend = genai.BackendVertexAI
+	cfg.APIKey = ""
+	cfg.Project = project
+	cfg.Location = location
+	return nil
+}
+
+// loadGenAIClient reads the GenAI backend settings and creates the client.
+func loadGenAIClient() {
+	var err error
+	switch v := os.Getenv("GENAI_BACKEND"); v {
+	case "", "gemini":
+	case "vertex":
+		vertexBackend = true
+	default:
+		log.Fatalf("GENAI_BACKEND must be \"gemini\" or \"vertex\", got %q", v)
+	}
+	apiKey := os.Getenv("API_KEY")
+	if apiKey == "" && !vertexBackend {
+		log.Fatalf("API_KEY must be set")
+	}
+
+	// Leave the images in GCS instead of uploading them to S3
+	returnGCSURI = os.Getenv("RETURN_GCS_URI") == "true"
+	if returnGCSURI {
+		if !vertexBackend {
+			log.Fatalf("RETURN_GCS_URI requires GENAI_BACKEND=vertex")
+		}
+		if gcsOutputURI, err = parseGCSOutputURI(os.Getenv("GCS_OUTPUT_URI")); err != nil {
+			log.Fatalf("invalid GCS_OUTPUT_URI: %v", err)
+		}
+	}
+
+	ctx := context.Background()
+	genaiCfg, err := genaiClientConfig(apiKey, os.Getenv("GENAI_API_ENDPOINT"), os.Getenv("GENAI_API_VERSION"))
+	if err != nil {
+		log.Fatalf("invalid GenAI client settings: %v", err)
+	}
+	if vertexBackend {
+		if err := useVertex(ctx, genaiCfg, os.Getenv("GOOGLE_CLOUD_PROJECT"), os.Getenv("GOOGLE_CLOUD_LOCATION")); err != nil {
+			log.Fatalf("invalid Vertex AI settings: %v", err)
+		}
+	}
+	genaiClient, err = genai.NewClient(ctx, genaiCfg)
+	if err != nil {
+		log.Fatalf("failed to create GenAI client: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// compareConcurrency caps how many models of a comparison run at once
+	// (COMPARE_CONCURRENCY).
+	compareConcurrency = 2
+	// compareTimeout bounds a whole comparison (COMPARE_TIMEOUT_SECONDS);
+	// zero means only the invocation deadline applies.
+	compareTimeout time.Duration
+)
+
+// modelComparison is one model's outcome in a compareModels request.
+type modelComparison struct {
+	Model  string           `json:"model"`
+	Status string           `json:"status"`           // "ok" or "error"
+	Code   int              `json:"code,omitempty"`   // HTTP status of the failure
+	Error  string           `json:"error,omitempty"`  // set when Status is "error"
+	Result *responsePayload `json:"result,omitempty"` // set when Status is "ok"
+}
+
+// compareModels generates in.Prompt with each of in.CompareModels, running
+// at most compareConcurrency at a time under one shared deadline. A model's
+// failure is reported in its entry and doesn't affect the others; the
+// request only fails if every model did.
+func compareModels(ctx context.Context, in requestPayload, onUpload func(uploadProgress)) (responsePayload, *requestError) {
+	if compareTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, compareTimeout)
+		defer cancel()
+	}
+	// Progress callbacks aren't safe for concurrent use
+	var mu sync.Mutex
+	report := func(u uploadProgress) {
+		if onUpload != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			onUpload(u)
+		}
+	}
+
+	results := make([]modelComparison, len(in.CompareModels))
+	sem := make(chan struct{}, compareConcurrency)
+	var wg sync.WaitGroup
+	for i, model := range in.CompareModels {
+		wg.Add(1)
+		go func(i int, model string) {
+			defer wg.Done()
+			results[i] = modelComparison{Model: model, Status: "error"}
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i].Code = http.StatusGatewayTimeout
+				results[i].Error = "comparison deadline exceeded before the model started"
+				return
+			}
+			one := in
+			one.CompareModels = nil
+			one.model = model
+			// Keep keys of different models apart under the flat key strategy
+			one.namePrefix = fmt.Sprintf("m%d_", i)
+			res, reqErr := generate(ctx, one, report)
+			if reqErr != nil {
+				results[i].Code = reqErr.status
+				results[i].Error = reqErr.msg
+				return
+			}
+			results[i].Status = "ok"
+			results[i].Result = &res
+		}(i, model)
+	}
+	wg.Wait()
+
+	for _, r := range results {
+		if r.Status == "ok" {
+			return responsePayload{ImageURLs: []string{}, ClientToken: in.ClientToken, Comparisons: results}, nil
+		}
+	}
+	first := results[0]
+	return responsePayload{}, &requestError{status: first.Code, msg: fmt.Sprintf("all models failed; %s: %s", first.Model, first.Error)}
+}
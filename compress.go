@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+)
+
+// maxImageBytes is the largest object we upload (MAX_IMAGE_BYTES); 0 means
+// no limit.
+var maxImageBytes int
+
+const (
+	// JPEG qualities tried, in order, before shrinking the image.
+	recompressStartQuality = 90
+	recompressMinQuality   = 50
+	recompressQualityStep  = 10
+	// Each shrink pass scales the longest side by 3/4, stopping at this size.
+	recompressMinDim = 256
+)
+
+// fitToSize returns data re-encoded as JPEG, at decreasing quality and then
+// decreasing size, until it is at most limit bytes. Images already within
+// the limit are returned as is. It fails when the quality and size floors
+// are reached without fitting.
+func fitToSize(data []byte, contentType string, limit int) ([]byte, string, error) {
+	if len(data) <= limit {
+		return data, contentType, nil
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, "", err
+	}
+	original := len(data)
+	for {
+		for q := recompressStartQuality; q >= recompressMinQuality; q -= recompressQualityStep {
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: q}); err != nil {
+				return nil, "", err
+			}
+			if buf.Len() <= limit {
+				b := img.Bounds()
+				log.Printf("recompressed image from %d to %d bytes (JPEG quality %d, %dx%d)", original, buf.Len(), q, b.Dx(), b.Dy())
+				return buf.Bytes(), contentTypeFor("jpeg"), nil
+			}
+		}
+		longest := longestSide(img)
+		if longest <= recompressMinDim {
+			return nil, "", fmt.Errorf("image is %d bytes and cannot be recompressed under %d bytes", original, limit)
+		}
+		next := longest * 3 / 4
+		if next < recompressMinDim {
+			next = recompressMinDim
+		}
+		img = resizeToFit(img, next)
+	}
+}
+
+func longestSide(img image.Image) int {
+	b := img.Bounds()
+	if b.Dx() > b.Dy() {
+		return b.Dx()
+	}
+	return b.Dy()
+}
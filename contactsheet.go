@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// Contact sheet layout on A4 portrait, in millimetres.
+const (
+	sheetPageWidth  = 210.0
+	sheetPageHeight = 297.0
+	sheetMargin     = 10.0
+	sheetGap        = 5.0
+)
+
+// sheetImage is one encoded image placed on a contact sheet.
+type sheetImage struct {
+	data        []byte
+	contentType string
+}
+
+// renderContactSheet lays out images in a grid on A4 pages under the prompt
+// as a caption, starting new pages as rows fill up.
+func renderContactSheet(prompt string, images []sheetImage) ([]byte, error) {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle(prompt, true)
+	pdf.SetMargins(sheetMargin, sheetMargin, sheetMargin)
+	pdf.SetAutoPageBreak(false, sheetMargin)
+	pdf.AddPage()
+
+	// The core fonts only cover cp1252
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.MultiCell(sheetPageWidth-2*sheetMargin, 5, tr(prompt), "", "L", false)
+
+	cols := int(math.Ceil(math.Sqrt(float64(len(images)))))
+	cellW := (sheetPageWidth - 2*sheetMargin - sheetGap*float64(cols-1)) / float64(cols)
+	y := pdf.GetY() + sheetGap
+	rowH := 0.0
+	for i, img := range images {
+		imageType := "PNG"
+		if img.contentType == "image/jpeg" {
+			imageType = "JPG"
+		}
+		opts := fpdf.ImageOptions{ImageType: imageType}
+		name := "image" + strconv.Itoa(i)
+		info := pdf.RegisterImageOptionsReader(name, opts, bytes.NewReader(img.data))
+		if pdf.Err() {
+			return nil, pdf.Error()
+		}
+		h := cellW
+		if info.Width() > 0 {
+			h = cellW * info.Height() / info.Width()
+		}
+
+		col := i % cols
+		if col == 0 && i > 0 {
+			y += rowH + sheetGap
+			rowH = 0
+		}
+		if col == 0 && y+h > sheetPageHeight-sheetMargin {
+			pdf.AddPage()
+			y = sheetMargin
+		}
+		x := sheetMargin + float64(col)*(cellW+sheetGap)
+		pdf.ImageOptions(name, x, y, cellW, h, false, opts, 0, "")
+		rowH = math.Max(rowH, h)
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
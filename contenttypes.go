@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// formatContentTypes maps each format we write to its standard content
+// type. Processing (DPI, alt text, extensions) always uses these values.
+var formatContentTypes = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"avif": "image/avif",
+	"webp": "image/webp",
+	"pdf":  "application/pdf",
+	"html": "text/html",
+	"json": "application/json",
+}
+
+// contentTypeOverrides replaces the Content-Type objects of a format are
+// stored and presigned with, for CDNs that expect something non-standard
+// (CONTENT_TYPE_OVERRIDES, e.g. {"avif": "image/avif-sequence"}).
+var contentTypeOverrides map[string]string
+
+// contentTypeFor returns the standard content type of format.
+func contentTypeFor(format string) string {
+	return formatContentTypes[format]
+}
+
+// storedContentType returns the Content-Type objects of the standard
+// contentType are uploaded with: its override, if any, or itself.
+func storedContentType(contentType string) string {
+	for format, ct := range formatContentTypes {
+		if ct != contentType {
+			continue
+		}
+		if v, ok := contentTypeOverrides[format]; ok {
+			return v
+		}
+		break
+	}
+	return contentType
+}
+
+func parseContentTypeOverrides(raw string) (map[string]string, error) {
+	var overrides map[string]string
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		return nil, err
+	}
+	for format, ct := range overrides {
+		if _, ok := formatContentTypes[format]; !ok {
+			return nil, fmt.Errorf("unknown format %q", format)
+		}
+		if !strings.Contains(ct, "/") {
+			return nil, fmt.Errorf("format %q: %q is not a content type", format, ct)
+		}
+	}
+	return overrides, nil
+}
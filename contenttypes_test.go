@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestStoredContentType(t *testing.T) {
+	defer func(o map[string]string) { contentTypeOverrides = o }(contentTypeOverrides)
+	contentTypeOverrides = map[string]string{"avif": "image/avif-sequence"}
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{"image/avif", "image/avif-sequence"},
+		{"image/png", "image/png"},
+		{"application/octet-stream", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := storedContentType(tt.contentType); got != tt.want {
+			t.Errorf("storedContentType(%q) = %q, want %q", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestParseContentTypeOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr bool
+	}{
+		{"valid", `{"avif": "image/avif-sequence", "html": "text/html; charset=utf-8"}`, false},
+		{"unknown format", `{"gif": "image/gif"}`, true},
+		{"not a content type", `{"png": "png"}`, true},
+		{"not JSON", `avif=image/avif`, true},
+	}
+	for _, tt := range tests {
+		if _, err := parseContentTypeOverrides(tt.raw); (err != nil) != tt.wantErr {
+			t.Errorf("%s: parseContentTypeOverrides() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
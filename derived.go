@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// uploadDerived builds and uploads the objects made from all of a request's
+// images together: sprite sheet, contact sheet, animation, atlas and
+// gallery. Their URLs go into out.
+func uploadDerived(ctx context.Context, in requestPayload, uploads []uploadedImage, keys []string, now time.Time, opts uploadOptions, out *responsePayload) *requestError {
+	// Combine the thumbnails into one sprite sheet for grid UIs
+	if in.SpriteSheet && in.Thumbnails {
+		thumbs := make([]image.Image, len(uploads))
+		for i, u := range uploads {
+			thumbs[i] = u.thumb
+		}
+		sheet, frames := composeSprite(thumbs, in.SpriteColumns)
+		sheetBytes, err := encodePNG(sheet)
+		if err != nil {
+			return &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to encode sprite sheet: %v", err)}
+		}
+		sheetURL, err := putObject(ctx, objectKey(in.outputPrefix, in.Prompt, in.namePrefix+"sprite", "png", now), sheetBytes, contentTypeFor("png"), opts)
+		if err != nil {
+			return uploadFailed("sprite sheet", err)
+		}
+		out.SpriteSheet = &spriteSheet{
+			URL:    sheetURL,
+			Width:  sheet.Bounds().Dx(),
+			Height: sheet.Bounds().Dy(),
+			Frames: frames,
+		}
+	}
+
+	if in.ContactSheetPDF {
+		sheet := make([]sheetImage, len(uploads))
+		for i, u := range uploads {
+			sheet[i] = sheetImage{data: u.data, contentType: u.contentType}
+		}
+		pdf, err := renderContactSheet(in.Prompt, sheet)
+		if err != nil {
+			return &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to render contact sheet: %v", err)}
+		}
+		sheetURL, err := putObject(ctx, objectKey(in.outputPrefix, in.Prompt, in.namePrefix+"contact", "pdf", now), pdf, contentTypeFor("pdf"), opts)
+		if err != nil {
+			return uploadFailed("contact sheet", err)
+		}
+		out.ContactSheetURL = sheetURL
+	}
+
+	if in.OutputFormat == "webp-anim" {
+		frames := make([][]byte, len(uploads))
+		for i, u := range uploads {
+			frames[i] = u.data
+		}
+		// parseRequest asked for two images or more, but safety filters can
+		// leave a single one, which is uploaded as a still WebP instead
+		var anim []byte
+		var err error
+		if len(frames) == 1 {
+			anim, err = encodeStillWebP(frames[0], in.OutputQuality)
+		} else {
+			anim, err = encodeAnimatedWebP(frames, in.OutputQuality, animationFrameDelay)
+		}
+		if err != nil {
+			return &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to encode animation: %v", err)}
+		}
+		animURL, err := putObject(ctx, objectKey(in.outputPrefix, in.Prompt, in.namePrefix+"animation", "webp", now), anim, contentTypeFor("webp"), opts)
+		if err != nil {
+			return uploadFailed("animation", err)
+		}
+		out.AnimationURL = animURL
+	}
+
+	if in.Atlas {
+		imgs := make([]image.Image, len(uploads))
+		for i, u := range uploads {
+			img, err := decodeImage(u.data)
+			if err != nil {
+				return &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to decode image %d for the atlas: %v", i, err)}
+			}
+			imgs[i] = img
+		}
+		sheet, atlas := composeAtlas(imgs, keys)
+		sheetBytes, err := encodePNG(sheet)
+		if err != nil {
+			return &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to encode atlas: %v", err)}
+		}
+		atlasKey := objectKey(in.outputPrefix, in.Prompt, in.namePrefix+"atlas", "png", now)
+		atlas.Image = path.Base(atlasKey)
+		atlasJSON, _ := json.MarshalIndent(atlas, "", "  ")
+		if out.AtlasURL, err = putObject(ctx, atlasKey, sheetBytes, contentTypeFor("png"), opts); err != nil {
+			return uploadFailed("atlas", err)
+		}
+		if out.AtlasJSONURL, err = putObject(ctx, strings.TrimSuffix(atlasKey, ".png")+".atlas.json", atlasJSON, contentTypeFor("json"), opts); err != nil {
+			return uploadFailed("atlas JSON", err)
+		}
+	}
+
+	if in.Gallery {
+		page, err := renderGallery(in.Prompt, out.ImageURLs)
+		if err != nil {
+			return &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to render gallery: %v", err)}
+		}
+		galleryURL, err := putObject(ctx, objectKey(in.outputPrefix, in.Prompt, in.namePrefix+"index", "html", now), page, contentTypeFor("html"), opts)
+		if err != nil {
+			return uploadFailed("gallery", err)
+		}
+		out.GalleryURL = galleryURL
+	}
+	return nil
+}
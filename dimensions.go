@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+
+	"golang.org/x/image/draw"
+)
+
+// Dimension policies selectable with MAX_DIMENSION_POLICY.
+const (
+	// dimensionPolicyDownscale shrinks oversized images to fit.
+	dimensionPolicyDownscale = "downscale"
+	// dimensionPolicyReject fails the request instead.
+	dimensionPolicyReject = "reject"
+)
+
+var (
+	// maxWidth and maxHeight cap the pixel size of every uploaded image, to
+	// protect downstream storage and CDN limits (MAX_WIDTH, MAX_HEIGHT). 0
+	// means no limit.
+	maxWidth, maxHeight int
+	// dimensionPolicy is what happens to images over the limits.
+	dimensionPolicy = dimensionPolicyDownscale
+)
+
+// limitDimensions enforces maxW and maxH (0 for no limit) on encoded image
+// bytes. Images within the limits are returned unchanged; larger ones are
+// scaled down to fit, keeping their aspect ratio, and re-encoded as PNG, or
+// rejected when reject is set. The size is read from the header first, so
+// images that fit are never decoded.
+func limitDimensions(data []byte, maxW, maxH int, reject bool) ([]byte, error) {
+	if maxW <= 0 && maxH <= 0 {
+		return data, nil
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	w, h := cfg.Width, cfg.Height
+	scale := 1.0
+	if maxW > 0 && w > maxW {
+		scale = float64(maxW) / float64(w)
+	}
+	if maxH > 0 && h > maxH {
+		scale = min(scale, float64(maxH)/float64(h))
+	}
+	if scale == 1 {
+		return data, nil
+	}
+	if reject {
+		return nil, fmt.Errorf("image is %dx%d, over the %s limit", w, h, dimensionLimits(maxW, maxH))
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	dw, dh := max(1, int(float64(w)*scale)), max(1, int(float64(h)*scale))
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return encodePNG(dst)
+}
+
+// dimensionLimits describes the limits for errors, e.g. "2048x∞".
+func dimensionLimits(maxW, maxH int) string {
+	side := func(n int) string {
+		if n <= 0 {
+			return "∞"
+		}
+		return fmt.Sprint(n)
+	}
+	return side(maxW) + "x" + side(maxH)
+}
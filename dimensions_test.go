@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestLimitDimensions(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for i := range src.Pix {
+		src.Pix[i] = 0xff
+	}
+	src.Set(0, 0, color.Black)
+	data, err := encodePNG(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		maxW, maxH   int
+		reject       bool
+		wantW, wantH int
+		wantErr      string
+	}{
+		{name: "no limits", wantW: 400, wantH: 200},
+		{name: "within limits", maxW: 400, maxH: 200, wantW: 400, wantH: 200},
+		{name: "width", maxW: 100, wantW: 100, wantH: 50},
+		{name: "height", maxH: 50, wantW: 100, wantH: 50},
+		{name: "tighter side wins", maxW: 200, maxH: 50, wantW: 100, wantH: 50},
+		{name: "reject", maxW: 100, reject: true, wantErr: "image is 400x200, over the 100x∞ limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := limitDimensions(data, tt.maxW, tt.maxH, tt.reject)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("limitDimensions() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("limitDimensions() error = %v", err)
+			}
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != tt.wantW || cfg.Height != tt.wantH {
+				t.Errorf("limitDimensions() = %dx%d, want %dx%d", cfg.Width, cfg.Height, tt.wantW, tt.wantH)
+			}
+			if tt.wantW == 400 && !bytes.Equal(out, data) {
+				t.Error("limitDimensions() re-encoded an image within its limits")
+			}
+		})
+	}
+}
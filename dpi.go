@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// Accepted outputDpi range.
+const (
+	minOutputDPI = 50
+	maxOutputDPI = 2400
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// setDPI records dpi as the image's physical resolution: a pHYs chunk for
+// PNG, JFIF density for JPEG. Pixels are left untouched.
+func setDPI(data []byte, contentType string, dpi int) ([]byte, error) {
+	switch contentType {
+	case "image/png":
+		return setPNGDPI(data, dpi)
+	case "image/jpeg":
+		return setJPEGDPI(data, dpi)
+	}
+	return nil, fmt.Errorf("can't set DPI on %s images", contentType)
+}
+
+// setPNGDPI replaces any pHYs chunk with one placed straight after IHDR, as
+// the spec requires it to come before the image data.
+func setPNGDPI(data []byte, dpi int) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("not a PNG")
+	}
+	// pHYs stores pixels per metre
+	ppm := uint32(math.Round(float64(dpi) / 0.0254))
+	body := make([]byte, 13)
+	copy(body, "pHYs")
+	binary.BigEndian.PutUint32(body[4:], ppm)
+	binary.BigEndian.PutUint32(body[8:], ppm)
+	body[12] = 1 // unit: metre
+	phys := make([]byte, 0, 21)
+	phys = binary.BigEndian.AppendUint32(phys, 9)
+	phys = append(phys, body...)
+	phys = binary.BigEndian.AppendUint32(phys, crc32.ChecksumIEEE(body))
+
+	out := append([]byte{}, pngSignature...)
+	for pos := len(pngSignature); pos < len(data); {
+		if pos+12 > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		end := pos + 12 + int(binary.BigEndian.Uint32(data[pos:]))
+		if end > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		typ := string(data[pos+4 : pos+8])
+		if typ != "pHYs" {
+			out = append(out, data[pos:end]...)
+		}
+		if typ == "IHDR" {
+			out = append(out, phys...)
+		}
+		pos = end
+	}
+	return out, nil
+}
+
+// setJPEGDPI sets the density of an existing JFIF APP0 segment, or inserts
+// one after SOI (Go's encoder doesn't write it).
+func setJPEGDPI(data []byte, dpi int) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("not a JPEG")
+	}
+	if data[2] == 0xFF && data[3] == 0xE0 && len(data) >= 18 && string(data[6:11]) == "JFIF\x00" {
+		out := append([]byte{}, data...)
+		out[13] = 1 // units: dots per inch
+		binary.BigEndian.PutUint16(out[14:], uint16(dpi))
+		binary.BigEndian.PutUint16(out[16:], uint16(dpi))
+		return out, nil
+	}
+	app0 := []byte{0xFF, 0xE0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 1, 1, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(app0[12:], uint16(dpi))
+	binary.BigEndian.PutUint16(app0[14:], uint16(dpi))
+	out := append([]byte{}, data[:2]...)
+	out = append(out, app0...)
+	return append(out, data[2:]...), nil
+}
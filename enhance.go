@@ -0,0 +1,20 @@
+package main
+
+import "google.golang.org/genai"
+
+// enhancedPrompts lists the prompt the model actually used for each image
+// when prompt enhancement rewrote it, in the order of images. Enhancement
+// can diverge per image, so each image keeps its own. It is nil when no
+// image was enhanced, and "" for any image that wasn't.
+func enhancedPrompts(images []*genai.GeneratedImage) []string {
+	prompts := make([]string, len(images))
+	enhanced := false
+	for i, img := range images {
+		prompts[i] = img.EnhancedPrompt
+		enhanced = enhanced || img.EnhancedPrompt != ""
+	}
+	if !enhanced {
+		return nil
+	}
+	return prompts
+}
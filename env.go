@@ -0,0 +1,21 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// envInt reads a positive integer from the environment, returning def when
+// the variable is unset. Invalid values stop the container at cold start.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Fatalf("%s must be a positive integer, got %q", name, v)
+	}
+	return n
+}
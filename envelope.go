@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// envelopeResponses wraps every response in an envelope (ENVELOPE=true).
+var envelopeResponses bool
+
+// envelope is the gateway-standard response shape: exactly one of Data and
+// Error is set.
+type envelope struct {
+	Data  json.RawMessage `json:"data,omitempty"` // responsePayload, filtered by the fields parameter
+	Error *envelopeError  `json:"error,omitempty"`
+	Meta  responseMeta    `json:"meta"`
+}
+
+type envelopeError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type responseMeta struct {
+	RequestID string `json:"requestId"`
+	Timestamp string `json:"timestamp"`
+	Model     string `json:"model,omitempty"`
+}
+
+// requestID returns the API Gateway request ID, falling back to the Lambda
+// invocation ID when there is none.
+func requestID(ctx context.Context, req events.APIGatewayProxyRequest) string {
+	if req.RequestContext.RequestID != "" {
+		return req.RequestContext.RequestID
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		return lc.AwsRequestID
+	}
+	return ""
+}
+
+// envelopeResponse renders the outcome of a request as an envelope.
+func envelopeResponse(ctx context.Context, req events.APIGatewayProxyRequest, out responsePayload, reqErr *requestError) (events.APIGatewayProxyResponse, error) {
+	env := envelope{
+		Meta: responseMeta{
+			RequestID: requestID(ctx, req),
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+	if reqErr != nil && errorFormat == errorFormatRFC7807 {
+		// Problem documents stand on their own, without the envelope
+		return problemResponse(reqErr.status, reqErr.msg, reqErr.reason, env.Meta.RequestID), nil
+	}
+	status := http.StatusOK
+	if reqErr != nil {
+		status = reqErr.status
+		env.Error = &envelopeError{Status: reqErr.status, Message: reqErr.msg, Reason: reqErr.reason}
+	} else {
+		if out.Partial {
+			status = http.StatusPartialContent
+		}
+		data, _ := json.Marshal(out)
+		env.Data = filterFields(data, parseFields(req.QueryStringParameters["fields"]))
+		env.Meta.Model = out.Model
+	}
+
+	body, _ := json.Marshal(env)
+	headers := map[string]string{"Content-Type": "application/json"}
+	if reqErr == nil {
+		headers = withManifestSignature(headers, body)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    headers,
+		Body:       string(body),
+	}, nil
+}
+
+// loadResponseConfig reads the response and error formats and the
+// invocation timing reserves.
+func loadResponseConfig() {
+	// Wrap responses in {"data": ..., "meta": ...}
+	envelopeResponses = os.Getenv("ENVELOPE") == "true"
+	switch errorFormat = os.Getenv("ERROR_FORMAT"); errorFormat {
+	case "", errorFormatRFC7807:
+	default:
+		log.Fatalf("ERROR_FORMAT must be %q or unset, got %q", errorFormatRFC7807, errorFormat)
+	}
+
+	// Sign response bodies for tamper-evident delivery
+	if v := os.Getenv("MANIFEST_HMAC_SECRET"); v != "" {
+		manifestSecret = []byte(v)
+	}
+
+	flushTimeout = time.Duration(envInt("FLUSH_TIMEOUT_MS", int(flushTimeout/time.Millisecond))) * time.Millisecond
+	watchdogReserve = time.Duration(envInt("WATCHDOG_RESERVE_MS", int(watchdogReserve/time.Millisecond))) * time.Millisecond
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestEnvelopeResponse(t *testing.T) {
+	defer func(f string) { errorFormat = f }(errorFormat)
+	req := events.APIGatewayProxyRequest{RequestContext: events.APIGatewayProxyRequestContext{RequestID: "req-1"}}
+	tests := []struct {
+		name        string
+		format      string
+		out         responsePayload
+		reqErr      *requestError
+		wantStatus  int
+		wantType    string
+		wantMessage string
+	}{
+		{name: "data", out: responsePayload{Model: "m"}, wantStatus: http.StatusOK, wantType: "application/json"},
+		{name: "partial", out: responsePayload{Partial: true}, wantStatus: http.StatusPartialContent, wantType: "application/json"},
+		{name: "error", reqErr: &requestError{status: http.StatusBadRequest, msg: "bad prompt"}, wantStatus: http.StatusBadRequest, wantType: "application/json", wantMessage: "bad prompt"},
+		{name: "problem", format: errorFormatRFC7807, reqErr: &requestError{status: http.StatusTooManyRequests, msg: "slow down"}, wantStatus: http.StatusTooManyRequests, wantType: "application/problem+json", wantMessage: "slow down"},
+		{name: "problem format keeps data envelope", format: errorFormatRFC7807, wantStatus: http.StatusOK, wantType: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errorFormat = tt.format
+			resp, err := envelopeResponse(context.Background(), req, tt.out, tt.reqErr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus || resp.Headers["Content-Type"] != tt.wantType {
+				t.Fatalf("envelopeResponse() = %d %s, want %d %s", resp.StatusCode, resp.Headers["Content-Type"], tt.wantStatus, tt.wantType)
+			}
+			if tt.wantType == "application/problem+json" {
+				var got problemDetails
+				if err := json.Unmarshal([]byte(resp.Body), &got); err != nil {
+					t.Fatal(err)
+				}
+				if got.Status != tt.wantStatus || got.Detail != tt.wantMessage || got.Instance != "req-1" {
+					t.Errorf("problem = %+v, want status %d, detail %q, instance req-1", got, tt.wantStatus, tt.wantMessage)
+				}
+				return
+			}
+			var got envelope
+			if err := json.Unmarshal([]byte(resp.Body), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Meta.RequestID != "req-1" {
+				t.Errorf("meta.requestId = %q, want req-1", got.Meta.RequestID)
+			}
+			if tt.reqErr != nil {
+				if got.Error == nil || got.Error.Message != tt.wantMessage || got.Data != nil {
+					t.Errorf("envelope = %s, want only error %q", resp.Body, tt.wantMessage)
+				}
+			} else if got.Error != nil || got.Data == nil {
+				t.Errorf("envelope = %s, want only data", resp.Body)
+			}
+		})
+	}
+}
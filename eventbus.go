@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+)
+
+// eventBus publishes an event per successful generation, or is nil when
+// EVENT_BUS_NAME is unset.
+var eventBus *eventPublisher
+
+// generatedDetailType is the detail-type of generation events.
+const generatedDetailType = "ImagesGenerated"
+
+// eventsAPI is the part of the EventBridge API the publisher uses.
+type eventsAPI interface {
+	PutEvents(ctx context.Context, params *eventbridge.PutEventsInput, optFns ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error)
+}
+
+type eventPublisher struct {
+	client eventsAPI
+	bus    string
+	source string // EVENT_SOURCE
+}
+
+// generatedEvent is the detail of an ImagesGenerated event.
+type generatedEvent struct {
+	RequestID   string   `json:"requestId"`
+	Keys        []string `json:"keys"`
+	Model       string   `json:"model"`
+	Count       int      `json:"count"`
+	ClientToken string   `json:"clientToken,omitempty"`
+	Partial     bool     `json:"partial,omitempty"`
+}
+
+func (p *eventPublisher) publish(ctx context.Context, ev generatedEvent) error {
+	detail, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	out, err := p.client.PutEvents(ctx, &eventbridge.PutEventsInput{
+		Entries: []types.PutEventsRequestEntry{{
+			EventBusName: aws.String(p.bus),
+			Source:       aws.String(p.source),
+			DetailType:   aws.String(generatedDetailType),
+			Detail:       aws.String(string(detail)),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	// PutEvents reports rejected entries in the output, not as an error
+	if out.FailedEntryCount > 0 && len(out.Entries) > 0 {
+		return fmt.Errorf("event rejected: %s: %s", aws.ToString(out.Entries[0].ErrorCode), aws.ToString(out.Entries[0].ErrorMessage))
+	}
+	return nil
+}
+
+// publishGenerated announces a finished generation in the background. A
+// failed publish is logged; the images are already uploaded and returned.
+func publishGenerated(ctx context.Context, out responsePayload, keys []string) {
+	if eventBus == nil {
+		return
+	}
+	ev := generatedEvent{
+		Keys:        keys,
+		Model:       out.Model,
+		Count:       len(keys),
+		ClientToken: out.ClientToken,
+		Partial:     out.Partial,
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		ev.RequestID = lc.AwsRequestID
+	}
+	runAsync("event", func() {
+		if err := eventBus.publish(ctx, ev); err != nil {
+			log.Printf("failed to publish %s event to %s: %v", generatedDetailType, eventBus.bus, err)
+		}
+	})
+}
+
+// loadEventBus sets up publishing generation events to EventBridge.
+func loadEventBus(awsCfg aws.Config) {
+	if bus := os.Getenv("EVENT_BUS_NAME"); bus != "" {
+		source := os.Getenv("EVENT_SOURCE")
+		if source == "" {
+			source = "imagen.lambda"
+		}
+		eventBus = &eventPublisher{client: eventbridge.NewFromConfig(awsCfg), bus: bus, source: source}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// parseFields reads the fields query parameter, a comma-separated list of
+// top-level response fields to return, e.g. "imageUrls,model". It returns
+// nil, meaning every field, when the parameter is absent or empty.
+func parseFields(v string) map[string]bool {
+	var fields map[string]bool
+	for _, f := range strings.Split(v, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			if fields == nil {
+				fields = map[string]bool{}
+			}
+			fields[f] = true
+		}
+	}
+	return fields
+}
+
+// filterFields keeps only the named top-level members of the JSON object
+// b; names the object doesn't have are ignored. A nil set keeps b as is.
+func filterFields(b []byte, fields map[string]bool) []byte {
+	if fields == nil {
+		return b
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return b
+	}
+	for name := range all {
+		if !fields[name] {
+			delete(all, name)
+		}
+	}
+	filtered, err := json.Marshal(all)
+	if err != nil {
+		return b
+	}
+	return filtered
+}
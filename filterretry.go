@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+var (
+	// retryFiltered regenerates images dropped by safety filters once, with
+	// a safety clause appended to the prompt (RETRY_FILTERED).
+	retryFiltered bool
+	// regenerate makes the retry call.
+	regenerate imageGenerator = generateWithModel
+)
+
+// filterRetryClause steers a borderline prompt away from whatever tripped
+// the filter, without changing its subject.
+const filterRetryClause = "Keep the image family-friendly and safe for work, with no violence, gore, nudity or explicit content."
+
+// imageGenerator makes one GenerateImages call against model.
+type imageGenerator func(ctx context.Context, model string, in requestPayload, cfg *genai.GenerateImagesConfig) (*genai.GenerateImagesResponse, error)
+
+// saferPrompt is prompt with filterRetryClause appended.
+func saferPrompt(prompt string) string {
+	prompt = strings.TrimSpace(prompt)
+	if !strings.HasSuffix(prompt, ".") {
+		prompt += "."
+	}
+	return prompt + " " + filterRetryClause
+}
+
+// usableImages splits a response into images with content and the reason
+// given for the last filtered one. Filtered images come back without bytes
+// (or a GCS URI), carrying only a reason.
+func usableImages(resp *genai.GenerateImagesResponse) ([]*genai.GeneratedImage, string) {
+	var images []*genai.GeneratedImage
+	var filteredReason string
+	for _, img := range resp.GeneratedImages {
+		if isFiltered(img) {
+			if img.RAIFilteredReason != "" {
+				filteredReason = img.RAIFilteredReason
+			}
+			continue
+		}
+		images = append(images, img)
+	}
+	return images, filteredReason
+}
+
+// isFiltered reports whether img came back without content.
+func isFiltered(img *genai.GeneratedImage) bool {
+	return img.Image == nil || (len(img.Image.ImageBytes) == 0 && img.Image.GCSURI == "")
+}
+
+// placeImages lists the usable images of resp in order, with recovered
+// images taking the places of filtered ones, first gap first. It also
+// returns each image's position in resp.GeneratedImages, so images keep
+// their index even when gaps remain.
+func placeImages(resp *genai.GenerateImagesResponse, recovered []*genai.GeneratedImage) ([]*genai.GeneratedImage, []int) {
+	var images []*genai.GeneratedImage
+	var positions []int
+	for i, img := range resp.GeneratedImages {
+		if isFiltered(img) {
+			if len(recovered) == 0 {
+				continue
+			}
+			img, recovered = recovered[0], recovered[1:]
+		}
+		images = append(images, img)
+		positions = append(positions, i)
+	}
+	return images, positions
+}
+
+// retryFilteredImages asks model once more for n images with a safer
+// prompt and returns whichever come back unfiltered. Errors are logged and
+// recover nothing; the first attempt's images still stand.
+func retryFilteredImages(ctx context.Context, model string, in requestPayload, cfg *genai.GenerateImagesConfig, n int, gen imageGenerator) []*genai.GeneratedImage {
+	retryCfg := *cfg
+	retryCfg.NumberOfImages = int32(n)
+	in.Prompt = saferPrompt(in.Prompt)
+	log.Printf("%d image(s) filtered; retrying once with a safety clause", n)
+	resp, err := gen(ctx, model, in, &retryCfg)
+	if err != nil {
+		log.Printf("filtered image retry failed: %v", err)
+		return nil
+	}
+	images, reason := usableImages(resp)
+	if len(images) > n {
+		images = images[:n]
+	}
+	log.Printf("filtered image retry recovered %d of %d image(s)", len(images), n)
+	if len(images) < n && reason != "" {
+		log.Printf("filtered again: %s", reason)
+	}
+	return images
+}
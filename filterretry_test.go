@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/genai"
+)
+
+func generated(n int, filtered ...string) *genai.GenerateImagesResponse {
+	resp := &genai.GenerateImagesResponse{}
+	for range n {
+		resp.GeneratedImages = append(resp.GeneratedImages, &genai.GeneratedImage{Image: &genai.Image{ImageBytes: []byte("png")}})
+	}
+	for _, reason := range filtered {
+		resp.GeneratedImages = append(resp.GeneratedImages, &genai.GeneratedImage{RAIFilteredReason: reason})
+	}
+	return resp
+}
+
+func TestSaferPrompt(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{in: "a cat", want: "a cat. " + filterRetryClause},
+		{in: " a cat. ", want: "a cat. " + filterRetryClause},
+	}
+	for _, tt := range tests {
+		if got := saferPrompt(tt.in); got != tt.want {
+			t.Errorf("saferPrompt(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUsableImages(t *testing.T) {
+	resp := generated(2, "violence", "")
+	resp.GeneratedImages = append(resp.GeneratedImages, &genai.GeneratedImage{Image: &genai.Image{GCSURI: "gs://b/k.png"}})
+	images, reason := usableImages(resp)
+	if len(images) != 3 || reason != "violence" {
+		t.Errorf("usableImages() = %d image(s), %q; want 3, %q", len(images), reason, "violence")
+	}
+}
+
+func TestRetryFilteredImages(t *testing.T) {
+	tests := []struct {
+		name string
+		resp *genai.GenerateImagesResponse
+		err  error
+		n    int
+		want int
+	}{
+		{name: "all recovered", resp: generated(2), n: 2, want: 2},
+		{name: "extra trimmed", resp: generated(3), n: 1, want: 1},
+		{name: "filtered again", resp: generated(1, "violence"), n: 2, want: 1},
+		{name: "error", err: errors.New("boom"), n: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPrompt string
+			var gotN int32
+			gen := func(_ context.Context, _ string, in requestPayload, cfg *genai.GenerateImagesConfig) (*genai.GenerateImagesResponse, error) {
+				gotPrompt, gotN = in.Prompt, cfg.NumberOfImages
+				return tt.resp, tt.err
+			}
+			cfg := &genai.GenerateImagesConfig{NumberOfImages: 4}
+			images := retryFilteredImages(context.Background(), "m", requestPayload{Prompt: "a cat"}, cfg, tt.n, gen)
+			if len(images) != tt.want {
+				t.Errorf("retryFilteredImages() = %d image(s), want %d", len(images), tt.want)
+			}
+			if gotPrompt != saferPrompt("a cat") || gotN != int32(tt.n) {
+				t.Errorf("retry asked for %d image(s) of %q", gotN, gotPrompt)
+			}
+			if cfg.NumberOfImages != 4 {
+				t.Errorf("retryFilteredImages() changed the caller's config to %d image(s)", cfg.NumberOfImages)
+			}
+		})
+	}
+}
+
+func TestPlaceImages(t *testing.T) {
+	img := func(name string) *genai.GeneratedImage {
+		return &genai.GeneratedImage{Image: &genai.Image{ImageBytes: []byte(name)}}
+	}
+	resp := &genai.GenerateImagesResponse{GeneratedImages: []*genai.GeneratedImage{
+		img("a"), {RAIFilteredReason: "violence"}, img("c"), {RAIFilteredReason: "violence"},
+	}}
+	tests := []struct {
+		name          string
+		recovered     []*genai.GeneratedImage
+		want          string
+		wantPositions string
+	}{
+		{name: "gaps kept", want: "ac", wantPositions: "[0 2]"},
+		{name: "first gap filled", recovered: []*genai.GeneratedImage{img("b")}, want: "abc", wantPositions: "[0 1 2]"},
+		{name: "all gaps filled", recovered: []*genai.GeneratedImage{img("b"), img("d")}, want: "abcd", wantPositions: "[0 1 2 3]"},
+	}
+	for _, tt := range tests {
+		images, positions := placeImages(resp, tt.recovered)
+		var got string
+		for _, img := range images {
+			got += string(img.Image.ImageBytes)
+		}
+		if got != tt.want || fmt.Sprint(positions) != tt.wantPositions {
+			t.Errorf("%s: placeImages() = %s %v, want %s %s", tt.name, got, positions, tt.want, tt.wantPositions)
+		}
+	}
+}
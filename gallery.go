@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+)
+
+// galleryPage lays out a request's images in a grid. Images are linked by
+// the URLs returned for them, since with SHARD_BUCKETS they may not even be
+// in the page's bucket. Presigned or signed URLs expire, and so do the
+// page's images with them.
+var galleryPage = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Prompt}}</title>
+<style>
+body { font-family: sans-serif; margin: 1rem; }
+.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(256px, 1fr)); gap: 0.5rem; }
+.grid img { width: 100%; height: auto; }
+</style>
+</head>
+<body>
+<p>{{.Prompt}}</p>
+<div class="grid">
+{{range .Images}}<a href="{{.}}"><img src="{{.}}" alt="" loading="lazy"></a>
+{{end}}</div>
+</body>
+</html>
+`))
+
+// renderGallery returns the gallery page for the image URLs.
+func renderGallery(prompt string, urls []string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := galleryPage.Execute(&buf, struct {
+		Prompt string
+		Images []string
+	}{prompt, urls})
+	return buf.Bytes(), err
+}
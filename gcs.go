@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// returnGCSURI skips S3: Vertex AI stores the images in GCS and the
+	// response lists their gs:// URIs (RETURN_GCS_URI).
+	returnGCSURI bool
+	// gcsOutputURI is the gs:// prefix Vertex writes images under in that
+	// mode (GCS_OUTPUT_URI).
+	gcsOutputURI string
+)
+
+// parseGCSOutputURI validates a gs://bucket[/prefix] URI and returns it
+// with a trailing slash, so generated names land under the prefix.
+func parseGCSOutputURI(v string) (string, error) {
+	bucket, _, _ := strings.Cut(strings.TrimPrefix(v, "gs://"), "/")
+	if !strings.HasPrefix(v, "gs://") || bucket == "" {
+		return "", fmt.Errorf("must be a gs://bucket/prefix URI, got %q", v)
+	}
+	return strings.TrimSuffix(v, "/") + "/", nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+// errorClass groups generation failures by how the caller should react.
+type errorClass int
+
+const (
+	classUnknown   errorClass = iota
+	classFiltered             // blocked by safety filters; rephrase the prompt
+	classTransient            // overloaded or timed out; retry later
+	classInvalid              // the request itself is wrong; fix it
+	classNoModel              // the model doesn't exist or can't generate images; pick another
+)
+
+// Machine-readable reasons for content-filtered responses.
+const (
+	reasonPromptBlocked  = "prompt_blocked"  // the prompt was rejected before generation
+	reasonImagesFiltered = "images_filtered" // every generated image was filtered out
+)
+
+// safetyMarkers are substrings of GenAI error messages that indicate the
+// prompt was blocked by Responsible AI filtering.
+var safetyMarkers = []string{
+	"safety",
+	"blocked",
+	"responsible ai",
+	"usage guidelines",
+	"prohibited",
+	"sensitive words",
+}
+
+// classifyGenAIError sorts a GenerateImages error into an errorClass.
+func classifyGenAIError(err error) errorClass {
+	if errors.Is(err, context.DeadlineExceeded) || isRetryableError(err) {
+		return classTransient
+	}
+	var apiErr genai.APIError
+	if !errors.As(err, &apiErr) {
+		return classUnknown
+	}
+	if isModelNotFound(apiErr) {
+		return classNoModel
+	}
+	msg := strings.ToLower(apiErr.Message)
+	for _, m := range safetyMarkers {
+		if strings.Contains(msg, m) {
+			return classFiltered
+		}
+	}
+	switch {
+	case apiErr.Code >= http.StatusInternalServerError, apiErr.Status == "DEADLINE_EXCEEDED":
+		return classTransient
+	case apiErr.Code >= http.StatusBadRequest:
+		return classInvalid
+	}
+	return classUnknown
+}
+
+// modelNotFoundMarkers are substrings of GenAI errors for unknown or
+// retired models, or ones that can't generate images, e.g. "models/x is not
+// found for API version v1beta, or is not supported for predict".
+var modelNotFoundMarkers = []string{
+	"is not found for api version",
+	"not supported for predict",
+	"model not found",
+	"unknown model",
+}
+
+func isModelNotFound(apiErr genai.APIError) bool {
+	if apiErr.Code == http.StatusNotFound || apiErr.Status == "NOT_FOUND" {
+		return true
+	}
+	msg := strings.ToLower(apiErr.Message)
+	for _, m := range modelNotFoundMarkers {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// configuredModels lists the models this deployment is set up to use, for
+// error messages.
+func configuredModels() string {
+	models := []string{imagenModel}
+	for _, m := range modelFallbackChain {
+		if m != imagenModel {
+			models = append(models, m)
+		}
+	}
+	return strings.Join(models, ", ")
+}
+
+// isAuthError reports whether err is GenAI rejecting our credentials. The
+// Gemini API answers an invalid key with a 400 INVALID_ARGUMENT carrying an
+// API_KEY_INVALID reason rather than a 401, so that case is matched too.
+func isAuthError(err error) bool {
+	var apiErr genai.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch {
+	case apiErr.Code == http.StatusUnauthorized, apiErr.Code == http.StatusForbidden:
+		return true
+	case apiErr.Status == "UNAUTHENTICATED", apiErr.Status == "PERMISSION_DENIED":
+		return true
+	}
+	for _, d := range apiErr.Details {
+		if reason, _ := d["reason"].(string); reason == "API_KEY_INVALID" {
+			return true
+		}
+	}
+	return strings.Contains(apiErr.Message, "API key not valid")
+}
+
+// isRetryableError reports whether a generation failure is worth retrying on
+// another model: the model is overloaded or out of quota, as opposed to the
+// request itself being invalid.
+func isRetryableError(err error) bool {
+	if errors.Is(err, errQuotaExhausted) {
+		return true
+	}
+	var apiErr genai.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch {
+	case apiErr.Code == http.StatusTooManyRequests, apiErr.Code == http.StatusServiceUnavailable:
+		return true
+	case apiErr.Status == "RESOURCE_EXHAUSTED", apiErr.Status == "UNAVAILABLE":
+		return true
+	}
+	return false
+}
+
+// isPersonGenerationRejected reports whether GenAI refused the request's
+// personGeneration setting, as happens for allow_all in some regions.
+func isPersonGenerationRejected(err error) bool {
+	var apiErr genai.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest {
+		return false
+	}
+	msg := strings.ToLower(apiErr.Message)
+	return strings.Contains(msg, "person_generation") || strings.Contains(msg, "persongeneration") ||
+		strings.Contains(msg, "person generation")
+}
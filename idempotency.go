@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// idempotency caches responses by Idempotency-Key header, or is nil when
+// IDEMPOTENCY_TABLE is unset.
+var idempotency *idempotencyCache
+
+// maxIdempotencyKeyLen bounds the header like clientToken.
+const maxIdempotencyKeyLen = 128
+
+// idempotencyAPI is the part of the DynamoDB API the cache uses.
+type idempotencyAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+}
+
+// idempotencyCache keeps the response of each successful request for ttl
+// (IDEMPOTENCY_TTL_SECONDS), so a retried request gets the same images
+// instead of generating new ones. Items expire through a DynamoDB TTL on
+// expiresAt; as TTL deletion lags, expiry is also checked on read. Each
+// response is stored with the hash of its request, so a key reused for a
+// different request is refused rather than answered with the old images.
+type idempotencyCache struct {
+	client idempotencyAPI
+	table  string
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// idempotencyKey returns the request's Idempotency-Key header.
+func idempotencyKey(headers map[string]string) (string, *requestError) {
+	for k, v := range headers {
+		if strings.EqualFold(k, "idempotency-key") {
+			if len(v) > maxIdempotencyKeyLen {
+				return "", &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("Idempotency-Key must be at most %d bytes", maxIdempotencyKeyLen)}
+			}
+			return strings.TrimSpace(v), nil
+		}
+	}
+	return "", nil
+}
+
+// scopedKey keeps keys of different tenants apart, and under
+// PRESIGN_IP_LOCK those of different addresses, whose URLs differ.
+func (c *idempotencyCache) scopedKey(in requestPayload, key string) map[string]types.AttributeValue {
+	pk := in.bucket + "/" + in.outputPrefix + "#" + key
+	if in.sourceIP != "" {
+		pk += "@" + in.sourceIP
+	}
+	return map[string]types.AttributeValue{"pk": &types.AttributeValueMemberS{Value: pk}}
+}
+
+// requestHash identifies what in asks for, so a key can't be replayed for
+// another request. It covers the request's fields after defaults, except
+// force, which only decides whether to replay.
+func requestHash(in requestPayload) string {
+	in.Force = false
+	b, _ := json.Marshal(in)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// lookup returns the cached response for key, if there is a live one, or a
+// 422 when key was last used for a different request. Lookup failures are
+// logged and treated as a miss.
+func (c *idempotencyCache) lookup(ctx context.Context, in requestPayload, key string) (responsePayload, bool, *requestError) {
+	res, err := c.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(c.table),
+		Key:            c.scopedKey(in, key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		log.Printf("idempotency lookup failed for %q: %v", key, err)
+		return responsePayload{}, false, nil
+	}
+	exp, ok := res.Item["expiresAt"].(*types.AttributeValueMemberN)
+	body, ok2 := res.Item["response"].(*types.AttributeValueMemberS)
+	if !ok || !ok2 {
+		return responsePayload{}, false, nil
+	}
+	if sec, err := strconv.ParseInt(exp.Value, 10, 64); err != nil || c.now().Unix() >= sec {
+		return responsePayload{}, false, nil
+	}
+	if hash, _ := res.Item["requestHash"].(*types.AttributeValueMemberS); hash == nil || hash.Value != requestHash(in) {
+		return responsePayload{}, false, &requestError{status: http.StatusUnprocessableEntity, msg: "Idempotency-Key was already used for a different request"}
+	}
+	var out responsePayload
+	if err := json.Unmarshal([]byte(body.Value), &out); err != nil {
+		log.Printf("bad cached response for %q: %v", key, err)
+		return responsePayload{}, false, nil
+	}
+	return out, true, nil
+}
+
+// store caches out, the response to in, under key for c.ttl, replacing any
+// earlier response.
+func (c *idempotencyCache) store(ctx context.Context, in requestPayload, key string, out responsePayload) error {
+	body, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	item := c.scopedKey(in, key)
+	item["response"] = &types.AttributeValueMemberS{Value: string(body)}
+	item["requestHash"] = &types.AttributeValueMemberS{Value: requestHash(in)}
+	item["expiresAt"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(c.now().Add(c.ttl).Unix(), 10)}
+	_, err = c.client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(c.table), Item: item})
+	return err
+}
+
+// runIdempotent runs a request, answering from the cache when it carries a
+// key seen within the TTL.
+func runIdempotent(ctx context.Context, in requestPayload, key string) (responsePayload, *requestError) {
+	generate := func() (responsePayload, *requestError) { return run(ctx, in, nil) }
+	if idempotency == nil || key == "" {
+		return generate()
+	}
+	return idempotency.do(ctx, in, key, generate)
+}
+
+// do answers in from the cache when key was seen within the TTL, and
+// otherwise calls generate and caches its response. force skips the lookup
+// and replaces the cached response with a fresh one. Partial responses
+// aren't cached, so a retry can complete them.
+func (c *idempotencyCache) do(ctx context.Context, in requestPayload, key string, generate func() (responsePayload, *requestError)) (responsePayload, *requestError) {
+	if !in.Force {
+		out, ok, reqErr := c.lookup(ctx, in, key)
+		if reqErr != nil {
+			return responsePayload{}, reqErr
+		}
+		if ok {
+			log.Printf("returning cached response for Idempotency-Key %q", key)
+			return out, nil
+		}
+	}
+	out, reqErr := generate()
+	if reqErr == nil && !out.Partial {
+		if err := c.store(ctx, in, key, out); err != nil {
+			log.Printf("failed to cache response for Idempotency-Key %q: %v", key, err)
+		}
+	}
+	return out, reqErr
+}
+
+// urlLifetime is how long the URLs in a response stay valid, or 0 when
+// they don't expire.
+func urlLifetime() time.Duration {
+	switch {
+	case presignGetURLs:
+		return presignExpiry
+	case cdnSigner != nil:
+		return cdnURLExpiry
+	}
+	return 0
+}
+
+// loadIdempotency sets up the Idempotency-Key response cache.
+func loadIdempotency(awsCfg aws.Config) {
+	if table := os.Getenv("IDEMPOTENCY_TABLE"); table != "" {
+		idempotency = &idempotencyCache{
+			client: dynamodb.NewFromConfig(awsCfg),
+			table:  table,
+			ttl:    time.Duration(envInt("IDEMPOTENCY_TTL_SECONDS", 86400)) * time.Second,
+			now:    time.Now,
+		}
+		// A replay must not hand out URLs that have already expired
+		if lifetime := urlLifetime(); lifetime > 0 && idempotency.ttl > lifetime {
+			log.Printf("IDEMPOTENCY_TTL_SECONDS capped at %v, the lifetime of signed URLs", lifetime)
+			idempotency.ttl = lifetime
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeIdempotency stores items by pk.
+type fakeIdempotency struct {
+	items map[string]map[string]types.AttributeValue
+}
+
+func (f *fakeIdempotency) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.items[params.Item["pk"].(*types.AttributeValueMemberS).Value] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeIdempotency) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.items[params.Key["pk"].(*types.AttributeValueMemberS).Value]}, nil
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	first := requestPayload{Prompt: "a cat", NumberOfImages: 1}
+	tests := []struct {
+		name       string
+		later      requestPayload
+		after      time.Duration
+		partial    bool
+		wantCalls  int
+		wantURL    string
+		wantStatus int
+	}{
+		{name: "replayed within the TTL", later: first, after: 59 * time.Minute, wantCalls: 1, wantURL: "u1"},
+		{name: "regenerated after the TTL", later: first, after: time.Hour, wantCalls: 2, wantURL: "u2"},
+		{name: "force regenerates", later: requestPayload{Prompt: "a cat", NumberOfImages: 1, Force: true}, wantCalls: 2, wantURL: "u2"},
+		{name: "different request refused", later: requestPayload{Prompt: "a dog", NumberOfImages: 1}, wantCalls: 1, wantStatus: http.StatusUnprocessableEntity},
+		{name: "partial responses not cached", later: first, partial: true, wantCalls: 2, wantURL: "u2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := start
+			c := &idempotencyCache{client: &fakeIdempotency{items: map[string]map[string]types.AttributeValue{}}, table: "idem", ttl: time.Hour, now: func() time.Time { return now }}
+			calls := 0
+			generate := func() (responsePayload, *requestError) {
+				calls++
+				return responsePayload{ImageURLs: []string{"u" + string(rune('0'+calls))}, Partial: tt.partial}, nil
+			}
+			if _, reqErr := c.do(context.Background(), first, "key", generate); reqErr != nil {
+				t.Fatal(reqErr)
+			}
+			now = start.Add(tt.after)
+			out, reqErr := c.do(context.Background(), tt.later, "key", generate)
+			if calls != tt.wantCalls {
+				t.Errorf("generated %d time(s), want %d", calls, tt.wantCalls)
+			}
+			if tt.wantStatus != 0 {
+				if reqErr == nil || reqErr.status != tt.wantStatus {
+					t.Fatalf("do() error = %+v, want %d", reqErr, tt.wantStatus)
+				}
+				return
+			}
+			if reqErr != nil || len(out.ImageURLs) != 1 || out.ImageURLs[0] != tt.wantURL {
+				t.Errorf("do() = %v, %+v; want %s", out.ImageURLs, reqErr, tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestURLLifetime(t *testing.T) {
+	defer func(p bool, pe, ce time.Duration, s *cdnURLSigner) {
+		presignGetURLs, presignExpiry, cdnURLExpiry, cdnSigner = p, pe, ce, s
+	}(presignGetURLs, presignExpiry, cdnURLExpiry, cdnSigner)
+	presignExpiry, cdnURLExpiry = time.Hour, 2*time.Hour
+	tests := []struct {
+		name    string
+		presign bool
+		signed  bool
+		want    time.Duration
+	}{
+		{name: "public URLs", want: 0},
+		{name: "presigned", presign: true, want: time.Hour},
+		{name: "signed CDN", signed: true, want: 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		presignGetURLs, cdnSigner = tt.presign, nil
+		if tt.signed {
+			cdnSigner = &cdnURLSigner{}
+		}
+		if got := urlLifetime(); got != tt.want {
+			t.Errorf("%s: urlLifetime() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	_ "image/jpeg" // register JPEG for decodeImage
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/buckket/go-blurhash"
+	"golang.org/x/image/draw"
+)
+
+// pngEncoder encodes every PNG we produce ourselves, such as thumbnails,
+// crops and sprite sheets; images uploaded as Imagen returned them aren't
+// re-encoded. Its level is PNG_COMPRESSION_LEVEL.
+var pngEncoder = png.Encoder{CompressionLevel: png.DefaultCompression}
+
+// pngCompressionLevels maps PNG_COMPRESSION_LEVEL values to encoder levels.
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"default":          png.DefaultCompression,
+	"best-speed":       png.BestSpeed,
+	"best-compression": png.BestCompression,
+}
+
+// decodeImage decodes generated image bytes (PNG or JPEG).
+func decodeImage(b []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(b))
+	return img, err
+}
+
+// extensionFor returns the file extension used for keys of contentType.
+func extensionFor(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return "jpg"
+	case "image/avif":
+		return "avif"
+	}
+	return "png"
+}
+
+// detectMIMEType returns the MIME type of encoded image bytes.
+func detectMIMEType(b []byte) string {
+	return http.DetectContentType(b)
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := pngEncoder.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resizeToFit scales img down, preserving its aspect ratio, so that neither
+// side exceeds maxDim. Images that already fit are returned unchanged.
+func resizeToFit(img image.Image, maxDim int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxDim && h <= maxDim {
+		return img
+	}
+	if w >= h {
+		h = h * maxDim / w
+		w = maxDim
+	} else {
+		w = w * maxDim / h
+		h = maxDim
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+// BlurHash placeholders are computed from a small copy of the image; the
+// hash only keeps blurhashX × blurhashY colour components anyway.
+const (
+	blurhashSourceSize = 64
+	blurhashX          = 4
+	blurhashY          = 3
+)
+
+// blurHash returns the BlurHash placeholder string of encoded image bytes.
+func blurHash(data []byte) (string, error) {
+	img, err := decodeImage(data)
+	if err != nil {
+		return "", err
+	}
+	return blurhash.Encode(blurhashX, blurhashY, resizeToFit(img, blurhashSourceSize))
+}
+
+// cropRect returns the largest rectangle of ratio w:h centred in b.
+func cropRect(b image.Rectangle, w, h int) image.Rectangle {
+	cw, ch := b.Dx(), b.Dx()*h/w
+	if ch > b.Dy() {
+		cw, ch = b.Dy()*w/h, b.Dy()
+	}
+	x := b.Min.X + (b.Dx()-cw)/2
+	y := b.Min.Y + (b.Dy()-ch)/2
+	return image.Rect(x, y, x+cw, y+ch)
+}
+
+// cropToAspect centre-crops encoded image bytes to ratio w:h and returns
+// them as PNG. Images already at that ratio are returned unchanged.
+func cropToAspect(data []byte, w, h int) ([]byte, error) {
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	r := cropRect(img.Bounds(), w, h)
+	if r == img.Bounds() {
+		return data, nil
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return encodePNG(dst)
+}
+
+// loadOutputConfig reads the output encoders, image limits and object key
+// layout.
+func loadOutputConfig() {
+	var err error
+	if err := checkAVIF(); err != nil {
+		log.Printf("AVIF encoder unavailable, outputFormat \"avif\" disabled: %v", err)
+	} else {
+		avifAvailable = true
+	}
+	if err := checkWebP(); err != nil {
+		log.Printf("WebP encoder unavailable, outputFormat \"webp-anim\" disabled: %v", err)
+	} else {
+		webpAvailable = true
+	}
+	animationFrameDelay = time.Duration(envInt("ANIMATION_FRAME_DELAY_MS", int(animationFrameDelay/time.Millisecond))) * time.Millisecond
+
+	thumbnailSize = envInt("THUMBNAIL_SIZE", thumbnailSize)
+	if v := os.Getenv("CONTENT_TYPE_OVERRIDES"); v != "" {
+		if contentTypeOverrides, err = parseContentTypeOverrides(v); err != nil {
+			log.Fatalf("invalid CONTENT_TYPE_OVERRIDES: %v", err)
+		}
+	}
+	maxWidth = envInt("MAX_WIDTH", 0)
+	maxHeight = envInt("MAX_HEIGHT", 0)
+	switch v := os.Getenv("MAX_DIMENSION_POLICY"); v {
+	case "", dimensionPolicyDownscale:
+	case dimensionPolicyReject:
+		dimensionPolicy = v
+	default:
+		log.Fatalf("MAX_DIMENSION_POLICY must be %q or %q, got %q", dimensionPolicyDownscale, dimensionPolicyReject, v)
+	}
+	generateLQIP = os.Getenv("GENERATE_LQIP") == "true"
+	lqipWidth = envInt("LQIP_WIDTH", lqipWidth)
+	if lqipWidth < 1 {
+		log.Fatalf("LQIP_WIDTH must be positive, got %d", lqipWidth)
+	}
+	maxImageBytes = envInt("MAX_IMAGE_BYTES", 0)
+	if v := os.Getenv("PNG_COMPRESSION_LEVEL"); v != "" {
+		level, ok := pngCompressionLevels[v]
+		if !ok {
+			log.Fatalf("PNG_COMPRESSION_LEVEL must be default, best-speed or best-compression, got %q", v)
+		}
+		pngEncoder.CompressionLevel = level
+	}
+
+	// Object key layout
+	switch v := os.Getenv("KEY_STRATEGY"); v {
+	case "", keyStrategyFlat:
+	case keyStrategyDatePromptHash:
+		keyStrategy = v
+	default:
+		log.Fatalf("KEY_STRATEGY must be %q or %q, got %q", keyStrategyFlat, keyStrategyDatePromptHash, v)
+	}
+	if v := os.Getenv("ALLOWED_KEY_PREFIX_REGEX"); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			log.Fatalf("invalid ALLOWED_KEY_PREFIX_REGEX: %v", err)
+		}
+		allowedKeyPattern = re
+	}
+}
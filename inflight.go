@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// Generations running in this container, reported as X-Inflight-Count so
+// an orchestrator can back off a busy container. Lambda hands a container
+// one invocation at a time, but model comparisons still run generations
+// side by side.
+var (
+	inflight     atomic.Int64
+	inflightPeak atomic.Int64 // highest count since resetInflightPeak
+)
+
+// startGeneration counts a generation as in flight until done is called.
+func startGeneration() (done func()) {
+	n := inflight.Add(1)
+	for {
+		peak := inflightPeak.Load()
+		if n <= peak || inflightPeak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	return func() { inflight.Add(-1) }
+}
+
+// resetInflightPeak starts tracking the peak for a new invocation.
+func resetInflightPeak() {
+	inflightPeak.Store(inflight.Load())
+}
+
+// inflightCount is the X-Inflight-Count value: the most generations that
+// ran at once since the invocation started.
+func inflightCount() string {
+	return strconv.FormatInt(max(inflightPeak.Load(), inflight.Load()), 10)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// jobs records fastFirst jobs, or is nil when JOBS_TABLE is unset.
+var jobs *jobTracker
+
+var errJobNotFound = errors.New("job not found")
+
+// Job states.
+const (
+	jobPending  = "pending"
+	jobComplete = "complete"
+	jobFailed   = "failed"
+)
+
+// jobAPI is the part of the DynamoDB API the job tracker uses.
+type jobAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+}
+
+// jobTracker stores the progress of fastFirst requests so clients can pick
+// up the remaining images after the first one. Items are keyed by jobId and
+// expire through a DynamoDB TTL on expiresAt.
+type jobTracker struct {
+	client jobAPI
+	table  string
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// jobStatus is a job as returned to clients.
+type jobStatus struct {
+	JobID     string   `json:"jobId"`
+	Status    string   `json:"status"`
+	Total     int      `json:"total"`
+	ImageURLs []string `json:"imageUrls"` // by image index; "" while still uploading
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (j *jobTracker) key(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"jobId": &types.AttributeValueMemberS{Value: id}}
+}
+
+// create records a new pending job.
+func (j *jobTracker) create(ctx context.Context, id string) error {
+	_, err := j.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(j.table),
+		Item: map[string]types.AttributeValue{
+			"jobId":     &types.AttributeValueMemberS{Value: id},
+			"status":    &types.AttributeValueMemberS{Value: jobPending},
+			"images":    &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{}},
+			"expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(j.now().Add(j.ttl).Unix(), 10)},
+		},
+	})
+	return err
+}
+
+// addImage records the URL of image idx out of total.
+func (j *jobTracker) addImage(ctx context.Context, id string, idx, total int, url string) error {
+	_, err := j.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(j.table),
+		Key:                      j.key(id),
+		UpdateExpression:         aws.String("SET images.#idx = :url, #total = :total"),
+		ExpressionAttributeNames: map[string]string{"#idx": strconv.Itoa(idx), "#total": "total"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":url":   &types.AttributeValueMemberS{Value: url},
+			":total": &types.AttributeValueMemberN{Value: strconv.Itoa(total)},
+		},
+	})
+	return err
+}
+
+// finish sets the job's final status.
+func (j *jobTracker) finish(ctx context.Context, id, status string) error {
+	_, err := j.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(j.table),
+		Key:                       j.key(id),
+		UpdateExpression:          aws.String("SET #status = :status"),
+		ExpressionAttributeNames:  map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":status": &types.AttributeValueMemberS{Value: status}},
+	})
+	return err
+}
+
+// get loads a job.
+func (j *jobTracker) get(ctx context.Context, id string) (jobStatus, error) {
+	out, err := j.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(j.table),
+		Key:            j.key(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return jobStatus{}, err
+	}
+	if out.Item == nil {
+		return jobStatus{}, errJobNotFound
+	}
+	st := jobStatus{JobID: id}
+	if v, ok := out.Item["status"].(*types.AttributeValueMemberS); ok {
+		st.Status = v.Value
+	}
+	if v, ok := out.Item["total"].(*types.AttributeValueMemberN); ok {
+		st.Total, _ = strconv.Atoi(v.Value)
+	}
+	st.ImageURLs = make([]string, st.Total)
+	if m, ok := out.Item["images"].(*types.AttributeValueMemberM); ok {
+		for k, v := range m.Value {
+			idx, err := strconv.Atoi(k)
+			s, ok := v.(*types.AttributeValueMemberS)
+			if err == nil && ok && idx >= 0 && idx < len(st.ImageURLs) {
+				st.ImageURLs[idx] = s.Value
+			}
+		}
+	}
+	return st, nil
+}
+
+// loadJobs sets up job records for fastFirst requests.
+func loadJobs(awsCfg aws.Config) {
+	if table := os.Getenv("JOBS_TABLE"); table != "" {
+		jobs = &jobTracker{
+			client: dynamodb.NewFromConfig(awsCfg),
+			table:  table,
+			ttl:    24 * time.Hour,
+			now:    time.Now,
+		}
+	}
+}
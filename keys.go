@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Key strategies selectable with KEY_STRATEGY.
+const (
+	// keyStrategyFlat names objects imagen_<name>_<timestamp>.<ext> directly
+	// under the prefix.
+	keyStrategyFlat = "flat"
+	// keyStrategyDatePromptHash groups objects as
+	// <prefix>/<YYYYMMDD>/<promptHash8>/<name>.<ext>, so repeating a prompt on
+	// the same day reuses (and overwrites) the same keys.
+	keyStrategyDatePromptHash = "date-prompt-hash"
+)
+
+// keyStrategy is the active key strategy.
+var keyStrategy = keyStrategyFlat
+
+// allowedKeyPattern, when set, must match every key we write
+// (ALLOWED_KEY_PREFIX_REGEX).
+var allowedKeyPattern *regexp.Regexp
+
+// errKeyNotAllowed is returned by checkKey for keys outside
+// ALLOWED_KEY_PREFIX_REGEX.
+var errKeyNotAllowed = errors.New("key does not match ALLOWED_KEY_PREFIX_REGEX")
+
+// checkKey enforces allowedKeyPattern, so a bad template or folder override
+// fails the request instead of writing outside the expected paths.
+func checkKey(key string) error {
+	if allowedKeyPattern != nil && !allowedKeyPattern.MatchString(key) {
+		return fmt.Errorf("%w: %q", errKeyNotAllowed, key)
+	}
+	return nil
+}
+
+// promptHash returns the first 8 hex characters of the prompt's SHA-256.
+func promptHash(prompt string) string {
+	sum := sha256.Sum256([]byte(prompt))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+// normalizePrefix cleans a folder prefix so keys never start with "/" or
+// contain empty segments: "/a//b/" becomes "a/b" and "/" becomes "".
+func normalizePrefix(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return strings.Trim(path.Clean(p), "/")
+}
+
+// objectKey builds the key for one generated object. name is the image index
+// or the role of a derived object, such as "sprite".
+func objectKey(prefix, prompt, name, ext string, t time.Time) string {
+	if keyStrategy == keyStrategyDatePromptHash {
+		return path.Join(prefix, t.Format("20060102"), promptHash(prompt), name+"."+ext)
+	}
+	return path.Join(prefix, fmt.Sprintf("imagen_%s_%s.%s", name, t.Format("20060102T150405"), ext))
+}
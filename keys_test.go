@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestObjectKey(t *testing.T) {
+	defer func(s string) { keyStrategy = s }(keyStrategy)
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		strategy string
+		prefix   string
+		name     string
+		want     string
+	}{
+		{keyStrategyFlat, "generated", "0", "generated/imagen_0_20250102T030405.png"},
+		{keyStrategyFlat, "", "sprite", "imagen_sprite_20250102T030405.png"},
+		{keyStrategyDatePromptHash, "generated", "1", "generated/20250102/" + promptHash("a fox") + "/1.png"},
+	}
+	for _, tt := range tests {
+		keyStrategy = tt.strategy
+		if got := objectKey(tt.prefix, "a fox", tt.name, "png", now); got != tt.want {
+			t.Errorf("objectKey(%q, %q) with %s = %q, want %q", tt.prefix, tt.name, tt.strategy, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizePrefix(t *testing.T) {
+	tests := map[string]string{
+		"":             "",
+		"/":            "",
+		"images":       "images",
+		"/a//b/":       "a/b",
+		"a/./b/../c/":  "a/c",
+		"tenant/x/../": "tenant",
+	}
+	for in, want := range tests {
+		if got := normalizePrefix(in); got != want {
+			t.Errorf("normalizePrefix(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	defer func(re *regexp.Regexp) { allowedKeyPattern = re }(allowedKeyPattern)
+	tests := []struct {
+		pattern string
+		key     string
+		allowed bool
+	}{
+		{"", "anything/at/all.png", true},
+		{`^generated/`, "generated/imagen_0.png", true},
+		{`^generated/`, "other/imagen_0.png", false},
+	}
+	for _, tt := range tests {
+		allowedKeyPattern = nil
+		if tt.pattern != "" {
+			allowedKeyPattern = regexp.MustCompile(tt.pattern)
+		}
+		err := checkKey(tt.key)
+		if tt.allowed != (err == nil) {
+			t.Errorf("checkKey(%q) with %q = %v, want allowed %v", tt.key, tt.pattern, err, tt.allowed)
+		}
+		if err != nil && !errors.Is(err, errKeyNotAllowed) {
+			t.Errorf("checkKey(%q) = %v, want errKeyNotAllowed", tt.key, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+var (
+	// autoLabel tags each image with the objects a Gemini vision model
+	// detects in it, for searchable libraries (AUTO_LABEL).
+	autoLabel bool
+	// labelModel does the detection (LABEL_MODEL).
+	labelModel = "gemini-2.5-flash"
+	// maxLabels caps labels per image (MAX_LABELS).
+	maxLabels = 5
+	// labelImage is the labeler used for uploads.
+	labelImage labeler = geminiLabels
+)
+
+// maxLabelTagChars is S3's limit on a tag value.
+const maxLabelTagChars = 256
+
+const labelInstruction = "List the main objects, subjects and scene types visible in this image, most prominent first, " +
+	"as short lower-case English nouns separated by commas, e.g. \"dog, beach, ball\". Reply with the list only."
+
+// labeler returns labels for an encoded image.
+type labeler func(ctx context.Context, data []byte, contentType string) ([]string, error)
+
+// geminiLabels is the labeler backed by labelModel.
+func geminiLabels(ctx context.Context, data []byte, contentType string) ([]string, error) {
+	contents := []*genai.Content{genai.NewContentFromParts([]*genai.Part{
+		genai.NewPartFromText(labelInstruction),
+		genai.NewPartFromBytes(data, contentType),
+	}, genai.RoleUser)}
+	if err := genaiLimit.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer genaiLimit.release()
+	resp, err := genaiClient.Models.GenerateContent(ctx, labelModel, contents, &genai.GenerateContentConfig{
+		MaxOutputTokens: 100,
+	})
+	if err != nil {
+		return nil, err
+	}
+	labels := normalizeLabels(strings.Split(resp.Text(), ","))
+	if len(labels) == 0 {
+		return nil, errors.New("model returned no labels")
+	}
+	return labels, nil
+}
+
+// normalizeLabels turns raw labels into at most maxLabels distinct
+// lower-case words joined by dashes, e.g. "Golden Retriever" becomes
+// "golden-retriever", so they are safe in S3 tags.
+func normalizeLabels(raw []string) []string {
+	var labels []string
+	seen := map[string]bool{}
+	for _, l := range raw {
+		var b strings.Builder
+		for _, f := range strings.Fields(strings.ToLower(l)) {
+			f = strings.Map(func(r rune) rune {
+				if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+					return r
+				}
+				return -1
+			}, f)
+			if f == "" {
+				continue
+			}
+			if b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteString(f)
+		}
+		l = b.String()
+		if l == "" || seen[l] {
+			continue
+		}
+		seen[l] = true
+		labels = append(labels, l)
+		if len(labels) == maxLabels {
+			break
+		}
+	}
+	return labels
+}
+
+// withLabelTag adds labels to URL-encoded object tags as one "labels" tag,
+// space separated and kept within S3's tag value limit.
+func withLabelTag(tagging string, labels []string) (string, error) {
+	tags, err := url.ParseQuery(tagging)
+	if err != nil {
+		return "", fmt.Errorf("invalid tagging %q: %w", tagging, err)
+	}
+	value := ""
+	for _, l := range labels {
+		next := strings.TrimSpace(value + " " + l)
+		if len(next) > maxLabelTagChars {
+			break
+		}
+		value = next
+	}
+	tags.Set("labels", value)
+	return tags.Encode(), nil
+}
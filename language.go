@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+var (
+	// englishOnly rejects prompts that are confidently not English
+	// (ENGLISH_ONLY).
+	englishOnly bool
+	// englishOnlyConfidence is how sure detection must be before a prompt
+	// is rejected, from 0 to 1 (ENGLISH_ONLY_CONFIDENCE).
+	englishOnlyConfidence = 0.75
+)
+
+// minLanguageWords is the shortest prompt, in words, whose language is
+// judged from its words. Shorter prompts are mostly names and nouns.
+const minLanguageWords = 4
+
+// englishWords and languageWords are common function words, chosen to be
+// distinctive: words shared between English and one of the other
+// languages, such as "a" or "in", are left out of both.
+var (
+	englishWords  = wordSet("the and of with on at an by from for to its is are under over near wearing holding this that")
+	languageWords = map[string]map[string]bool{
+		"Spanish":    wordSet("el la los las un una unos del con por para que y es muy sobre al"),
+		"French":     wordSet("le la les un une des du et avec sur dans est sous très au aux"),
+		"German":     wordSet("der das ein eine einem einen und mit auf im ist unter sehr dem"),
+		"Italian":    wordSet("il lo la gli le un una del della con su per che e è sotto molto"),
+		"Portuguese": wordSet("o os um uma da dos das com em na que e é sobre muito"),
+		"Dutch":      wordSet("de het een en met op voor onder zeer"),
+	}
+)
+
+func wordSet(words string) map[string]bool {
+	set := map[string]bool{}
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
+
+// detectNonEnglish guesses whether prompt is in a language other than
+// English, returning the language and a confidence from 0 to 1. A prompt
+// mostly written in a non-Latin script is judged by its script; a Latin
+// one by how many of its words are function words of another language
+// rather than of English. Short prompts and stray foreign names score low.
+func detectNonEnglish(prompt string) (string, float64) {
+	letters, latin := 0, 0
+	for _, r := range prompt {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.Is(unicode.Latin, r) {
+				latin++
+			}
+		}
+	}
+	if letters == 0 {
+		return "", 0
+	}
+	if share := 1 - float64(latin)/float64(letters); share >= 0.5 {
+		return "a non-Latin script", share
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(prompt), func(r rune) bool { return !unicode.IsLetter(r) })
+	if len(words) < minLanguageWords {
+		return "", 0
+	}
+	english := 0
+	counts := map[string]int{}
+	for _, w := range words {
+		if englishWords[w] {
+			english++
+		}
+		for lang, set := range languageWords {
+			if set[w] {
+				counts[lang]++
+			}
+		}
+	}
+	best, foreign := "", 0
+	for lang, n := range counts {
+		if n > foreign || (n == foreign && lang < best) {
+			best, foreign = lang, n
+		}
+	}
+	// One function word can come with a name, e.g. "Le Mans"
+	if foreign < 2 {
+		return "", 0
+	}
+	return best, float64(foreign) / float64(foreign+english)
+}
+
+// checkPromptLanguage rejects prompt under ENGLISH_ONLY when it is
+// confidently not English.
+func checkPromptLanguage(prompt string) error {
+	if !englishOnly {
+		return nil
+	}
+	if lang, conf := detectNonEnglish(prompt); conf >= englishOnlyConfidence {
+		return fmt.Errorf("prompt appears to be in %s; this deployment only accepts English prompts", lang)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"path"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+var (
+	// generateLQIP uploads a tiny JPEG placeholder per image, before the
+	// image itself, for progressive loading (GENERATE_LQIP).
+	generateLQIP bool
+	// lqipWidth is the placeholder width in pixels (LQIP_WIDTH).
+	lqipWidth = 20
+)
+
+// lqipQuality is the JPEG quality of placeholders. They are shown blurred
+// and scaled up, so artefacts don't matter but bytes do.
+const lqipQuality = 30
+
+// makeLQIP scales a generated image to width pixels wide, keeping its aspect
+// ratio, and encodes it as a low-quality JPEG.
+func makeLQIP(imgBytes []byte, width int) ([]byte, error) {
+	img, err := decodeImage(imgBytes)
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	w := min(width, b.Dx())
+	h := max(1, b.Dy()*w/b.Dx())
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: lqipQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// lqipKey is the key of the placeholder for the image stored at key.
+func lqipKey(key string) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + "_lqip.jpg"
+}
@@ -1,168 +1,975 @@
 package main
 
 import (
-    "bytes"
-    "context"
-    "encoding/json"
-    "fmt"
-    "log"
-    "net/http"
-    "os"
-    "path"
-    "time"
-
-    "github.com/aws/aws-lambda-go/events"
-    "github.com/aws/aws-lambda-go/lambda"
-    "github.com/aws/aws-sdk-go-v2/aws"
-    "github.com/aws/aws-sdk-go-v2/config"
-    "github.com/aws/aws-sdk-go-v2/service/s3"
-    "google.golang.org/genai"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genai"
 )
 
 var (
-    s3Client     *s3.Client
-    genaiClient  *genai.Client
-    bucketName   string
-    folderPrefix string
-	region string
+	s3Client              *s3.Client
+	genaiClient           *genai.Client
+	bucketName            string
+	folderPrefix          string
+	region                string
+	streaming             bool
+	defaultAspectRatio    string
+	minImages             int
+	defaultNumberOfImages int
+	maxImages             int
 )
 
-func init() {
-	// load AWS Output Bucket Configuration
-	region = os.Getenv("OUTPUT_BUCKET_REGION")
-	if region == "" {
-		region = "us-east-1" 
-	}
-
-    // Load AWS config & create S3 client
-    awsCfg, err := config.LoadDefaultConfig(
-		context.Background(), 
-		config.WithRegion(region),
-	)
-    if err != nil {
-        log.Fatalf("unable to load AWS SDK config: %v", err)
-    }
-    s3Client = s3.NewFromConfig(awsCfg)
-
-    // Read bucket + optional folder prefix from env
-    bucketName = os.Getenv("OUTPUT_BUCKET")
-    if bucketName == "" {
-        log.Fatalf("OUTPUT_BUCKET must be set")
-    }
-    folderPrefix = os.Getenv("OUTPUT_FOLDER") // e.g. "generated-images" or ""
-
-    // Initialize GenAI client with API key from env
-    apiKey := os.Getenv("API_KEY")
-    if apiKey == "" {
-        log.Fatalf("API_KEY must be set")
-    }
-
-	ctx := context.Background()
-	genaiClient, err = genai.NewClient(ctx, &genai.ClientConfig{
-		APIKey:   apiKey,
-		Backend:  genai.BackendGeminiAPI,
-	})
-
-    if err != nil {
-        log.Fatalf("failed to create GenAI client: %v", err)
-    }
+// loadConfig reads the configuration from the environment and creates the
+// clients, once per container. main calls it rather than init, so tests can
+// load the package without a deployment's environment.
+func loadConfig() {
+	awsCfg := loadStorageConfig()
+	loadURLConfig(awsCfg)
+	loadRequestLimits()
+	loadGenerationConfig()
+	loadAccessConfig()
+	loadConcurrencyConfig()
+	loadOutputConfig()
+	loadPromptConfig()
+	loadResponseConfig()
+
+	// Optional OpenTelemetry tracing
+	if os.Getenv("OTEL_ENABLED") == "true" {
+		initTracing(context.Background())
+	}
+
+	// DynamoDB tables and the event bus, each optional
+	loadQuota(awsCfg)
+	loadJobs(awsCfg)
+	loadIdempotency(awsCfg)
+	loadLinks(awsCfg)
+	loadEventBus(awsCfg)
+	loadSequence(awsCfg)
+
+	// Serve through Lambda response streaming instead of a buffered response
+	streaming = os.Getenv("RESPONSE_STREAMING") == "true"
+
+	// Or consume requests from an SQS queue
+	sqsMode = os.Getenv("SQS_MODE") == "true"
+	if sqsMode && tenantClaim != "" {
+		// Queue messages carry no authorizer claims to scope them by
+		log.Fatalf("SQS_MODE can't be combined with TENANT_CLAIM: queue messages have no tenant")
+	}
+	failureBucket = os.Getenv("FAILURE_BUCKET")
+	if sqsMode && failureBucket == "" {
+		log.Fatalf("SQS_MODE requires FAILURE_BUCKET, a private bucket for failure records")
+	}
+	sqsMaxReceiveCount = envInt("SQS_MAX_RECEIVE_COUNT", 0)
+	if v := normalizePrefix(os.Getenv("FAILURE_PREFIX")); v != "" {
+		failurePrefix = v
+	}
+
+	loadGenAIClient()
+
+	// Open the S3 and GenAI connections before the first request needs them
+	if os.Getenv("PREWARM") == "true" {
+		prewarm(context.Background(), s3Client, bucketName, pingGenAI)
+	}
 }
 
 type requestPayload struct {
-    NumberOfImages   int32  `json:"numberOfImages"`             // optional, default 1
-    AspectRatio      string `json:"aspectRatio,omitempty"`      // optional, default "SQUARE"
-    PersonGeneration string `json:"personGeneration,omitempty"` // optional
-    Prompt           string `json:"prompt"`                     // required
+	NumberOfImages      int32             `json:"numberOfImages"`                // optional, default DEFAULT_NUMBER_OF_IMAGES, raised to MIN_IMAGES, at most MAX_IMAGES
+	AspectRatio         string            `json:"aspectRatio,omitempty"`         // optional, default DEFAULT_ASPECT_RATIO or "1:1"
+	PersonGeneration    string            `json:"personGeneration,omitempty"`    // optional; trusted callers only when TRUSTED_SCOPE or TRUSTED_API_KEY_IDS is set
+	SafetyFilterLevel   string            `json:"safetyFilterLevel,omitempty"`   // optional, e.g. "BLOCK_ONLY_HIGH"; same restriction as personGeneration
+	ImageSize           string            `json:"imageSize,omitempty"`           // optional, e.g. "1K" or "2K"; model default when empty
+	Thumbnails          bool              `json:"thumbnails,omitempty"`          // optional, also upload a thumbnail per image
+	SpriteSheet         bool              `json:"spriteSheet,omitempty"`         // optional, combine thumbnails into one sheet; requires thumbnails
+	SpriteColumns       int               `json:"spriteColumns,omitempty"`       // optional, sprite sheet columns, default 4
+	IncludeReuploadURLs bool              `json:"includeReuploadUrls,omitempty"` // optional, return a presigned PUT URL per image
+	ReferenceImage      string            `json:"referenceImage,omitempty"`      // optional, base64 image or s3:// URI in the output bucket to condition on
+	ReferenceStrength   *float64          `json:"referenceStrength,omitempty"`   // optional, 0–1 influence of the reference image, default 0.5
+	ClientToken         string            `json:"clientToken,omitempty"`         // optional, echoed back in the response
+	Force               bool              `json:"force,omitempty"`               // optional, regenerate even when the Idempotency-Key has a cached response
+	FastFirst           bool              `json:"fastFirst,omitempty"`           // optional, stream the first image as soon as it is uploaded; streaming only
+	Prompt              string            `json:"prompt"`                        // required unless prompts is set
+	Prompts             []string          `json:"prompts,omitempty"`             // optional, batch of prompts generated with the same settings
+	CompareModels       []string          `json:"compareModels,omitempty"`       // optional, generate the prompt with each of these models side by side
+	OutputDPI           int               `json:"outputDpi,omitempty"`           // optional, resolution recorded in the image metadata
+	OutputFormat        string            `json:"outputFormat,omitempty"`        // optional, "png" (default), "avif" or "webp-anim"
+	CropToAspect        string            `json:"cropToAspect,omitempty"`        // optional, e.g. "21:9"; centre-crops each image before upload
+	Blurhash            bool              `json:"blurhash,omitempty"`            // optional, also return a BlurHash placeholder per image
+	Sizes               []int             `json:"sizes,omitempty"`               // optional, max dimensions of resized variants to upload per image
+	SafetyRatings       bool              `json:"safetyRatings,omitempty"`       // optional, also return Imagen's safety category scores per image
+	EnhancePrompt       bool              `json:"enhancePrompt,omitempty"`       // optional, let the model rewrite the prompt; see enhancedPrompts
+	OutputQuality       int               `json:"outputQuality,omitempty"`       // optional, AVIF quality 1-100
+	Quality             string            `json:"quality,omitempty"`             // optional, a QUALITY_PRESETS name such as "draft" or "high"
+	FriendlyFilenames   bool              `json:"friendlyFilenames,omitempty"`   // optional, presigned URLs download as <prompt-slug>.png
+	ContactSheetPDF     bool              `json:"contactSheetPdf,omitempty"`     // optional, also upload a PDF contact sheet of all images
+	Atlas               bool              `json:"atlas,omitempty"`               // optional, also upload a packed texture atlas with a JSON frame list
+	ShortLinks          bool              `json:"shortLinks,omitempty"`          // optional, also return a short link per image (needs SHORTLINK_TABLE)
+	CostCenter          string            `json:"costCenter,omitempty"`          // optional, one of COST_CENTERS; tags uploads for billing
+	Gallery             bool              `json:"gallery,omitempty"`             // optional, also upload an HTML page showing all images
+	EncryptionContext   map[string]string `json:"encryptionContext,omitempty"`   // optional, SSE-KMS encryption context for uploads
+
+	outputPrefix   string // S3 prefix for this request's objects
+	referenceBytes []byte // decoded ReferenceImage
+	namePrefix     string // prepended to object names, to keep batch prompts apart
+	encryptionCtx  string // encoded EncryptionContext
+	model          string // when set, the only model tried
+	firstSeq       int    // SEQUENTIAL_NAMING: number of the first image
+	cropW, cropH   int    // parsed CropToAspect
+	bucket         string // TENANT_CONFIG bucket, "" for OUTPUT_BUCKET
+	originalPrompt string // AUTO_TRANSLATE: Prompt as written, when it was translated
+	promptLanguage string // AUTO_TRANSLATE: language of originalPrompt
+	// AUTO_TRANSLATE: the same for each of Prompts, or nil when none was translated
+	originalPrompts []string
+	promptLanguages []string
+	requestedRatio  string // AUTO_ADJUST_ASPECT: AspectRatio as requested, when it was adjusted
+	sourceIP        string // PRESIGN_IP_LOCK: requester's address
 }
 
 type responsePayload struct {
-    ImageURLs []string `json:"imageUrls"`
+	ImageURLs         []string            `json:"imageUrls"`                 // in generation order, filtered images left out
+	AltTexts          []string            `json:"altTexts,omitempty"`        // GENERATE_ALT_TEXT only, same order as imageUrls; "" where description failed
+	Labels            [][]string          `json:"labels,omitempty"`          // AUTO_LABEL only, same order as imageUrls; null where labeling failed
+	ETags             []string            `json:"etags,omitempty"`           // S3 ETag of each image, same order as imageUrls
+	Checksums         []string            `json:"checksums,omitempty"`       // base64 SHA-256 of each image as confirmed by S3, same order as imageUrls
+	Blurhashes        []string            `json:"blurhashes,omitempty"`      // blurhash requests only, same order as imageUrls
+	LQIPURLs          []string            `json:"lqipUrls,omitempty"`        // GENERATE_LQIP only: tiny JPEG placeholders, same order as imageUrls
+	Variants          []map[string]string `json:"variants,omitempty"`        // sizes requests only: size → URL, same order as imageUrls
+	SafetyRatings     [][]safetyRating    `json:"safetyRatings,omitempty"`   // safetyRatings requests only, same order as imageUrls; omitted when Imagen returns none
+	EnhancedPrompts   []string            `json:"enhancedPrompts,omitempty"` // prompt the model used per image, same order as imageUrls; omitted unless enhanced
+	ShortLinks        []string            `json:"shortLinks,omitempty"`      // same order as imageUrls
+	QualityScores     []float64           `json:"qualityScores,omitempty"`   // SORT_BY_QUALITY: score of each image, same order as imageUrls
+	GenerationOrder   []int               `json:"generationOrder,omitempty"` // position of each image among those Imagen generated; set with SORT_BY_QUALITY or when images were filtered
+	PromptTokens      int                 `json:"promptTokens,omitempty"`    // local estimate for the prompt sent to the model
+	PromptTruncated   bool                `json:"promptTruncated,omitempty"` // the estimate exceeds PROMPT_TOKEN_LIMIT
+	PromptWarning     string              `json:"promptWarning,omitempty"`   // set when the prompt is near or over the limit
+	TranslatedFrom    string              `json:"translatedFrom,omitempty"`  // AUTO_TRANSLATE: language the prompt was translated from
+	RequestedAspect   string              `json:"requestedAspect,omitempty"` // AUTO_ADJUST_ASPECT: requested ratio, when the model doesn't support it
+	ThumbnailURLs     []string            `json:"thumbnailUrls,omitempty"`   // same order as imageUrls
+	FilteredCount     int                 `json:"filteredCount,omitempty"`   // images dropped by safety filters
+	FilterRetry       string              `json:"filterRetry,omitempty"`     // RETRY_FILTERED: "recovered" or "failed", when images were filtered
+	Partial           bool                `json:"partial,omitempty"`         // uploads stopped near the Lambda deadline; only finished images are listed
+	ReuploadURLs      []string            `json:"reuploadUrls,omitempty"`    // presigned PUT per image, same order as imageUrls
+	SpriteSheet       *spriteSheet        `json:"spriteSheet,omitempty"`
+	Model             string              `json:"model"`                       // model that produced the images
+	UpstreamRequestID string              `json:"upstreamRequestId,omitempty"` // GenAI request ID, when the API returns one
+	ClientToken       string              `json:"clientToken,omitempty"`       // echoed from the request
+	JobID             string              `json:"jobId,omitempty"`             // fastFirst job holding all image URLs
+	PersonGeneration  string              `json:"personGeneration,omitempty"`  // effective setting, after any AUTO_DOWNGRADE_PERSON step
+	Config            *effectiveConfig    `json:"config,omitempty"`            // resolved generation config
+	ContactSheetURL   string              `json:"contactSheetUrl,omitempty"`   // only when contactSheetPdf was requested
+	AnimationURL      string              `json:"animationUrl,omitempty"`      // only for outputFormat "webp-anim"
+	AtlasURL          string              `json:"atlasUrl,omitempty"`          // only when atlas was requested
+	AtlasJSONURL      string              `json:"atlasJsonUrl,omitempty"`      // frame rectangles of atlasUrl
+	GalleryURL        string              `json:"galleryUrl,omitempty"`        // only when gallery was requested
+	Comparisons       []modelComparison   `json:"comparisons,omitempty"`       // one per model for compareModels requests
+	Results           []responsePayload   `json:"results,omitempty"`           // one per prompt for batch requests
+}
+
+// uploadProgress describes one completed image upload.
+type uploadProgress struct {
+	Index int    // position of the image in the response
+	URL   string // URL of the uploaded image
+	Done  int    // images uploaded so far, including this one
+	Total int    // images to upload
+}
+
+// maxClientTokenLen bounds clientToken so it can't bloat logs and responses.
+const maxClientTokenLen = 128
+
+// requestError is a failed request together with the HTTP status it maps to.
+type requestError struct {
+	status int
+	msg    string
+	reason string // machine-readable cause, e.g. reasonPromptBlocked; optional
 }
 
 func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-    // 1) Parse and validate input
-    var in requestPayload
-    if err := json.Unmarshal([]byte(req.Body), &in); err != nil {
-        return clientError(http.StatusBadRequest, fmt.Sprintf("invalid JSON: %v", err))
-    }
-    if in.Prompt == "" {
-        return clientError(http.StatusBadRequest, "prompt is required")
-    }
-    if in.NumberOfImages <= 0 {
-        in.NumberOfImages = 1
-    }
-    if in.AspectRatio == "" {
-        in.AspectRatio = "SQUARE"
-    }
-
-    // 2) Call Imagen 4
-    genCfg := &genai.GenerateImagesConfig{
-        NumberOfImages: in.NumberOfImages,
-        AspectRatio:    in.AspectRatio,
-    }
-    if in.PersonGeneration != "" {
-        genCfg.PersonGeneration = genai.PersonGeneration(in.PersonGeneration)
-    }
-
-    genResp, err := genaiClient.Models.GenerateImages(
-        ctx,
-        "imagen-4.0-generate-preview-06-06",
-        in.Prompt,
-        genCfg,
-    )
-    if err != nil {
-        log.Printf("GenAI error: %v", err)
-        return serverError(fmt.Sprintf("image generation failed: %v", err))
-    }
-
-    // 3) Upload each image directly from memory into S3
-    var urls []string
-    for idx, img := range genResp.GeneratedImages {
-        key := path.Join(
-            folderPrefix,
-            fmt.Sprintf("imagen_%d_%s.png", idx, time.Now().Format("20060102T150405")),
-        )
-        _, err := s3Client.PutObject(ctx, &s3.PutObjectInput{
-            Bucket:      aws.String(bucketName),
-            Key:         aws.String(key),
-            Body:        bytes.NewReader(img.Image.ImageBytes),
-            ContentType: aws.String("image/png"),
-        })
-        if err != nil {
-            log.Printf("S3 upload failed for %s: %v", key, err)
-            return serverError(fmt.Sprintf("failed to upload image: %v", err))
-        }
-
-        // Construct a public URL (adjust region/domain if needed)
-        url := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucketName, region, key)
-        urls = append(urls, url)
-    }
-
-    // 4) Return JSON with all image URLs
-    respBody, _ := json.Marshal(responsePayload{ImageURLs: urls})
-    return events.APIGatewayProxyResponse{
-        StatusCode: http.StatusOK,
-        Headers:    map[string]string{"Content-Type": "application/json"},
-        Body:       string(respBody),
-    }, nil
-}
-
-func clientError(status int, msg string) (events.APIGatewayProxyResponse, error) {
-    return events.APIGatewayProxyResponse{
-        StatusCode: status,
-        Headers:    map[string]string{"Content-Type": "text/plain"},
-        Body:       msg,
-    }, nil
-}
-
-func serverError(msg string) (events.APIGatewayProxyResponse, error) {
-    return events.APIGatewayProxyResponse{
-        StatusCode: http.StatusInternalServerError,
-        Headers:    map[string]string{"Content-Type": "text/plain"},
-        Body:       msg,
-    }, nil
+	// Deferred so that background work is awaited on every return path
+	defer flushTraces(ctx)
+	defer flushAsync(ctx)
+
+	// Monitoring probes get the effective configuration without generating
+	if req.HTTPMethod == http.MethodHead {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Headers: configHeaders()}, nil
+	}
+	if req.HTTPMethod == http.MethodGet && req.Path == "/metadata" {
+		return metadataHandler(ctx, req)
+	}
+	if req.HTTPMethod == http.MethodGet && req.Path == "/stats" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusOK,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       string(statsBody()),
+		}, nil
+	}
+	if req.HTTPMethod == http.MethodGet && strings.HasPrefix(req.Path, "/s/") {
+		location, reqErr := shortLinkLocation(ctx, strings.TrimPrefix(req.Path, "/s/"), req.RequestContext.Identity.SourceIP)
+		if reqErr != nil && reqErr.status >= http.StatusInternalServerError {
+			return serverError(requestID(ctx, req), reqErr.status, reqErr.msg)
+		}
+		if reqErr != nil {
+			return clientError(requestID(ctx, req), reqErr.status, reqErr.msg)
+		}
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusFound, Headers: map[string]string{"Location": location}}, nil
+	}
+
+	resetInflightPeak()
+	resp, err := generationResponse(ctx, req)
+	if resp.Headers == nil {
+		resp.Headers = map[string]string{}
+	}
+	resp.Headers["X-Inflight-Count"] = inflightCount()
+	return resp, err
+}
+
+// generationResponse runs a generation request and renders its outcome.
+func generationResponse(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	out, reqErr := process(ctx, req)
+	if envelopeResponses {
+		return envelopeResponse(ctx, req, out, reqErr)
+	}
+	if reqErr != nil {
+		return errorResponse(requestID(ctx, req), reqErr)
+	}
+
+	// 4) Return JSON with all image URLs
+	status := http.StatusOK
+	if out.Partial {
+		status = http.StatusPartialContent
+	}
+	respBody, _ := json.Marshal(out)
+	respBody = filterFields(respBody, parseFields(req.QueryStringParameters["fields"]))
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    withManifestSignature(map[string]string{"Content-Type": "application/json"}, respBody),
+		Body:       string(respBody),
+	}, nil
+}
+
+// process parses an API Gateway request and runs the generation.
+func process(ctx context.Context, req events.APIGatewayProxyRequest) (responsePayload, *requestError) {
+	apiKey := apiKeyFromRequest(req.RequestContext.Identity.APIKey, req.Headers)
+	in, reqErr := parseRequest(ctx, req.Body, req.QueryStringParameters, apiKey)
+	if reqErr != nil {
+		return responsePayload{}, reqErr
+	}
+	if in.FastFirst {
+		return responsePayload{}, &requestError{status: http.StatusBadRequest, msg: "fastFirst requires response streaming (RESPONSE_STREAMING=true)"}
+	}
+	if reqErr := checkOverrides(in, isTrustedCaller(req.RequestContext)); reqErr != nil {
+		return responsePayload{}, reqErr
+	}
+	if reqErr := applyTenantConfig(&in, apiKey); reqErr != nil {
+		return responsePayload{}, reqErr
+	}
+	if tenantClaim != "" {
+		tenant, err := tenantFromAuthorizer(req.RequestContext.Authorizer)
+		if err != nil {
+			return responsePayload{}, &requestError{status: http.StatusForbidden, msg: err.Error()}
+		}
+		in.outputPrefix = normalizePrefix(path.Join(in.outputPrefix, tenant))
+	}
+	if presignIPLock {
+		in.sourceIP = req.RequestContext.Identity.SourceIP
+	}
+	key, reqErr := idempotencyKey(req.Headers)
+	if reqErr != nil {
+		return responsePayload{}, reqErr
+	}
+	return runIdempotent(ctx, in, key)
+}
+
+// parseRequest decodes a request and applies defaults, including the model
+// of apiKey's tenant. The JSON body is used when present; otherwise the
+// fields are read from the query string, for clients that can only send GET
+// requests. With AUTO_TRANSLATE, prompts are translated here, once, and
+// validated as translated.
+func parseRequest(ctx context.Context, body string, query map[string]string, apiKey string) (requestPayload, *requestError) {
+	// 1) Parse and validate input
+	var in requestPayload
+	if strings.TrimSpace(body) == "" && len(query) > 0 {
+		var err error
+		if in, err = payloadFromQuery(query); err != nil {
+			return in, &requestError{status: http.StatusBadRequest, msg: err.Error()}
+		}
+	} else if err := decodeBody(body, &in); err != nil {
+		return in, &requestError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if validation != nil {
+		if err := validation.check(in); err != nil {
+			return in, &requestError{status: http.StatusBadRequest, msg: err.Error()}
+		}
+	}
+	if reqErr := applyQualityPreset(&in); reqErr != nil {
+		return in, reqErr
+	}
+	applyTenantModel(&in, apiKey)
+	if len(in.Prompts) > 0 {
+		if in.Prompt != "" {
+			return in, &requestError{status: http.StatusBadRequest, msg: "use either prompt or prompts, not both"}
+		}
+		for i, p := range in.Prompts {
+			clean, err := sanitizePrompt(p)
+			if err != nil {
+				return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("prompts[%d]: %v", i, err)}
+			}
+			if strings.TrimSpace(clean) == "" {
+				return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("prompts[%d] is empty", i)}
+			}
+			english, lang, err := translateForModel(ctx, clean)
+			if err != nil {
+				return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("prompts[%d]: %v", i, err)}
+			}
+			if lang != "" {
+				if in.promptLanguages == nil {
+					in.originalPrompts = make([]string, len(in.Prompts))
+					in.promptLanguages = make([]string, len(in.Prompts))
+				}
+				in.originalPrompts[i], in.promptLanguages[i] = clean, lang
+				clean = english
+			}
+			if err := checkPromptLanguage(clean); err != nil {
+				return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("prompts[%d]: %v", i, err)}
+			}
+			in.Prompts[i] = clean
+		}
+	} else {
+		prompt, err := sanitizePrompt(in.Prompt)
+		if err != nil {
+			return in, &requestError{status: http.StatusBadRequest, msg: err.Error()}
+		}
+		in.Prompt = prompt
+		if strings.TrimSpace(in.Prompt) == "" {
+			return in, &requestError{status: http.StatusBadRequest, msg: "prompt is required"}
+		}
+		english, lang, err := translateForModel(ctx, in.Prompt)
+		if err != nil {
+			return in, &requestError{status: http.StatusBadRequest, msg: err.Error()}
+		}
+		if lang != "" {
+			in.originalPrompt, in.promptLanguage = in.Prompt, lang
+			in.Prompt = english
+		}
+		if err := checkPromptLanguage(in.Prompt); err != nil {
+			return in, &requestError{status: http.StatusBadRequest, msg: err.Error()}
+		}
+	}
+	if in.NumberOfImages <= 0 {
+		in.NumberOfImages = int32(defaultNumberOfImages)
+	}
+	if int(in.NumberOfImages) < minImages {
+		log.Printf("numberOfImages %d is below MIN_IMAGES; generating %d", in.NumberOfImages, minImages)
+		in.NumberOfImages = int32(minImages)
+	}
+	prompts := len(in.Prompts)
+	if prompts == 0 {
+		prompts = 1
+	}
+	if reqErr := checkImageLimits(prompts, int(in.NumberOfImages)); reqErr != nil {
+		return in, reqErr
+	}
+	if len(in.CompareModels) > 0 {
+		if len(in.Prompts) > 0 || in.ReferenceImage != "" || in.FastFirst {
+			return in, &requestError{status: http.StatusBadRequest, msg: "compareModels can't be combined with prompts, referenceImage or fastFirst"}
+		}
+		if total := len(in.CompareModels) * int(in.NumberOfImages); total > maxImages {
+			return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("%d images across compared models exceeds MAX_IMAGES (%d)", total, maxImages)}
+		}
+	}
+	if in.AspectRatio == "" {
+		in.AspectRatio = defaultAspectRatio
+	}
+	ratio, err := normalizeAspectRatio(in.AspectRatio)
+	if err != nil {
+		return in, &requestError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	// A quality preset or the tenant may have picked the model already
+	model := imagenModel
+	if in.model != "" {
+		model = in.model
+	}
+	if in.AspectRatio, err = fitAspectRatio(model, ratio); err != nil {
+		return in, &requestError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if in.AspectRatio != ratio {
+		log.Printf("aspect ratio %s is not supported by %s; using %s", ratio, model, in.AspectRatio)
+		in.requestedRatio = ratio
+	}
+	if in.CropToAspect != "" {
+		crop := in.CropToAspect
+		if alias, ok := aspectRatioAliases[strings.ToLower(strings.TrimSpace(crop))]; ok {
+			crop = alias
+		}
+		w, h, ok := splitRatio(crop)
+		if !ok {
+			return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("invalid cropToAspect %q (use W:H, e.g. \"21:9\")", in.CropToAspect)}
+		}
+		g := gcd(w, h)
+		in.cropW, in.cropH = w/g, h/g
+	}
+	in.ImageSize = strings.ToUpper(strings.TrimSpace(in.ImageSize))
+	if err := validateImageSize(model, in.ImageSize); err != nil {
+		return in, &requestError{status: http.StatusBadRequest, msg: err.Error()}
+	}
+	if len(in.Sizes) > maxVariantSizes {
+		return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("at most %d sizes are allowed", maxVariantSizes)}
+	}
+	seen := map[int]bool{}
+	for _, s := range in.Sizes {
+		if s < minVariantSize || s > maxVariantSize {
+			return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("sizes must be between %d and %d", minVariantSize, maxVariantSize)}
+		}
+		if seen[s] {
+			return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("size %d is listed twice", s)}
+		}
+		seen[s] = true
+	}
+	if in.SpriteSheet && !in.Thumbnails {
+		return in, &requestError{status: http.StatusBadRequest, msg: "spriteSheet requires thumbnails"}
+	}
+	if in.SpriteColumns < 0 {
+		return in, &requestError{status: http.StatusBadRequest, msg: "spriteColumns must be positive"}
+	}
+	if in.SpriteColumns == 0 {
+		in.SpriteColumns = defaultSpriteColumns
+	}
+	if len(in.ClientToken) > maxClientTokenLen {
+		return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("clientToken must be at most %d bytes", maxClientTokenLen)}
+	}
+	if in.ReferenceStrength != nil && in.ReferenceImage == "" {
+		return in, &requestError{status: http.StatusBadRequest, msg: "referenceStrength requires referenceImage"}
+	}
+	if in.ReferenceImage != "" {
+		// The SDK only offers image editing on Vertex AI
+		if !vertexBackend {
+			return in, &requestError{status: http.StatusBadRequest, msg: "referenceImage requires GENAI_BACKEND=vertex"}
+		}
+		if in.ImageSize != "" {
+			return in, &requestError{status: http.StatusBadRequest, msg: "imageSize can't be combined with referenceImage"}
+		}
+		if in.ReferenceStrength == nil {
+			strength := defaultReferenceStrength
+			in.ReferenceStrength = &strength
+		}
+		if s := *in.ReferenceStrength; s < 0 || s > 1 {
+			return in, &requestError{status: http.StatusBadRequest, msg: "referenceStrength must be between 0 and 1"}
+		}
+	}
+	if reqErr := checkBudget(in); reqErr != nil {
+		return in, reqErr
+	}
+	if in.ShortLinks && links == nil {
+		return in, &requestError{status: http.StatusBadRequest, msg: "shortLinks requires SHORTLINK_TABLE"}
+	}
+	if in.CostCenter != "" && !costCenters[in.CostCenter] {
+		return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("unknown costCenter %q", in.CostCenter)}
+	}
+	if in.FriendlyFilenames && !presignGetURLs {
+		return in, &requestError{status: http.StatusBadRequest, msg: "friendlyFilenames requires presigned URLs (PRESIGN_URLS=true)"}
+	}
+	if in.OutputDPI != 0 && (in.OutputDPI < minOutputDPI || in.OutputDPI > maxOutputDPI) {
+		return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("outputDpi must be between %d and %d", minOutputDPI, maxOutputDPI)}
+	}
+	if in.SafetyFilterLevel != "" {
+		in.SafetyFilterLevel = strings.ToUpper(in.SafetyFilterLevel)
+		if _, ok := safetyFilterLevels[in.SafetyFilterLevel]; !ok {
+			return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("unsupported safetyFilterLevel %q", in.SafetyFilterLevel)}
+		}
+	}
+	switch in.OutputFormat {
+	case "", "png":
+		if in.OutputQuality != 0 {
+			return in, &requestError{status: http.StatusBadRequest, msg: "outputQuality requires outputFormat \"avif\" or \"webp-anim\""}
+		}
+	case "avif":
+		if !avifAvailable {
+			return in, &requestError{status: http.StatusNotImplemented, msg: "AVIF output is not available"}
+		}
+		if in.OutputQuality != 0 && (in.OutputQuality < minAVIFQuality || in.OutputQuality > maxAVIFQuality) {
+			return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("outputQuality must be between %d and %d", minAVIFQuality, maxAVIFQuality)}
+		}
+		if in.OutputDPI != 0 {
+			return in, &requestError{status: http.StatusBadRequest, msg: "outputDpi is not supported with outputFormat \"avif\""}
+		}
+	case "webp-anim":
+		if !webpAvailable {
+			return in, &requestError{status: http.StatusNotImplemented, msg: "animated WebP output is not available"}
+		}
+		if in.NumberOfImages < 2 {
+			return in, &requestError{status: http.StatusBadRequest, msg: "outputFormat \"webp-anim\" needs numberOfImages of at least 2"}
+		}
+		if in.OutputQuality != 0 && (in.OutputQuality < minAVIFQuality || in.OutputQuality > maxAVIFQuality) {
+			return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("outputQuality must be between %d and %d", minAVIFQuality, maxAVIFQuality)}
+		}
+	default:
+		return in, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("unsupported outputFormat %q (use \"png\", \"avif\" or \"webp-anim\")", in.OutputFormat)}
+	}
+	if len(in.EncryptionContext) > 0 {
+		enc, err := encodeEncryptionContext(in.EncryptionContext)
+		if err != nil {
+			return in, &requestError{status: http.StatusBadRequest, msg: err.Error()}
+		}
+		in.encryptionCtx = enc
+	}
+	in.outputPrefix = folderPrefix
+	return in, nil
+}
+
+// payloadFromQuery builds a request from query string parameters. Only the
+// basic fields are supported.
+func payloadFromQuery(q map[string]string) (requestPayload, error) {
+	in := requestPayload{
+		Prompt:           q["prompt"],
+		AspectRatio:      q["aspectRatio"],
+		PersonGeneration: q["personGeneration"],
+	}
+	if v := q["numberOfImages"]; v != "" {
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			return in, fmt.Errorf("numberOfImages must be an integer, got %q", v)
+		}
+		in.NumberOfImages = int32(n)
+	}
+	return in, nil
+}
+
+// decodeBody decodes a JSON request body into in, rejecting unknown and
+// repeated fields so that typos don't silently fall back to defaults.
+func decodeBody(body string, in *requestPayload) error {
+	dec := json.NewDecoder(strings.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(in); err != nil {
+		if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return fmt.Errorf("unknown field %s", name)
+		}
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	if name := duplicateField(body); name != "" {
+		return fmt.Errorf("duplicate field %q", name)
+	}
+	return nil
+}
+
+// duplicateField returns the first top-level field name that appears more
+// than once in a JSON object, or "" if there is none.
+func duplicateField(body string) string {
+	dec := json.NewDecoder(strings.NewReader(body))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return ""
+	}
+	seen := map[string]bool{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+		name, _ := tok.(string)
+		// encoding/json matches field names case-insensitively
+		key := strings.ToLower(name)
+		if seen[key] {
+			return name
+		}
+		seen[key] = true
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return ""
+		}
+	}
+	return ""
+}
+
+// generate calls Imagen for a parsed request and uploads the results to S3.
+// If onUpload is non-nil it is called after each successful image upload.
+func generate(ctx context.Context, in requestPayload, onUpload func(uploadProgress)) (_ responsePayload, reqErr *requestError) {
+	defer startGeneration()()
+	statGenerations.Add(1)
+	ctx, span := tracer.Start(ctx, "imagen.generate", trace.WithAttributes(
+		attribute.Int("imagen.image_count", int(in.NumberOfImages)),
+		attribute.String("imagen.aspect_ratio", in.AspectRatio),
+	))
+	defer func() {
+		if reqErr != nil {
+			statErrors.Add(1)
+			span.SetStatus(codes.Error, reqErr.msg)
+		}
+		span.End()
+	}()
+
+	// 2) Call Imagen 4
+	genCfg := imagesConfig(in)
+	if in.ReferenceImage != "" {
+		ref, err := resolveReferenceImage(ctx, in.ReferenceImage, in.outputPrefix)
+		if err != nil {
+			return responsePayload{}, &requestError{status: http.StatusBadRequest, msg: err.Error()}
+		}
+		in.referenceBytes = ref
+	}
+
+	log.Printf("generating %d image(s) at %s for prompt %q (clientToken %q)", in.NumberOfImages, in.AspectRatio, redactPrompt(in.Prompt), in.ClientToken)
+	promptTokens := approxTokens(modelPrompt(in.Prompt, genCfg.AspectRatio))
+	promptWarning := promptLengthWarning(promptTokens)
+	if promptWarning != "" {
+		log.Printf("warning: %s", promptWarning)
+	}
+	gen, reqErr := generateImages(ctx, &in, genCfg)
+	if reqErr != nil {
+		return responsePayload{}, reqErr
+	}
+	images, model := gen.images, gen.model
+
+	// 3) Upload each image directly from memory into S3
+	now := time.Now()
+	opts := uploadOptions{encryptionContext: in.encryptionCtx, metadata: generationMetadata(in, model, now), bucket: in.bucket, sourceIP: in.sourceIP}
+	if in.CostCenter != "" {
+		opts.tagging = url.Values{"cost-center": {in.CostCenter}}.Encode()
+	}
+	out := responsePayload{
+		Model:             model,
+		UpstreamRequestID: gen.upstreamID,
+		ClientToken:       in.ClientToken,
+		PersonGeneration:  in.PersonGeneration,
+		Config:            newEffectiveConfig(model, in, genCfg),
+		FilteredCount:     gen.filtered,
+		FilterRetry:       gen.filterRetry,
+		PromptTokens:      promptTokens,
+		PromptTruncated:   promptTokens > promptTokenLimit,
+		PromptWarning:     promptWarning,
+		TranslatedFrom:    in.promptLanguage,
+		RequestedAspect:   in.requestedRatio,
+	}
+	// Vertex has already stored the images, so there is nothing to upload
+	if returnGCSURI {
+		for _, img := range images {
+			out.ImageURLs = append(out.ImageURLs, img.Image.GCSURI)
+		}
+		if gen.filtered > 0 {
+			out.GenerationOrder = gen.positions
+		}
+		out.EnhancedPrompts = enhancedPrompts(images)
+		publishGenerated(ctx, out, out.ImageURLs)
+		logPrompt(ctx, in, out)
+		if in.CostCenter != "" {
+			emitMetric("ImagesGenerated", float64(len(out.ImageURLs)), "Count", map[string]string{"CostCenter": in.CostCenter, "Model": model})
+		}
+		return out, nil
+	}
+	uploads, keys, reqErr := uploadGenerated(ctx, in, gen, now, opts, &out, onUpload)
+	if reqErr != nil {
+		return responsePayload{}, reqErr
+	}
+
+	// A partial response has no time left for derived objects
+	if !out.Partial {
+		if reqErr := uploadDerived(ctx, in, uploads, keys, now, opts, &out); reqErr != nil {
+			return responsePayload{}, reqErr
+		}
+	}
+
+	publishGenerated(ctx, out, keys)
+	logPrompt(ctx, in, out)
+	if in.CostCenter != "" {
+		emitMetric("ImagesGenerated", float64(len(out.ImageURLs)), "Count", map[string]string{"CostCenter": in.CostCenter, "Model": model})
+	}
+	return out, nil
+}
+
+// imagesConfig is the Imagen generation config for a request.
+func imagesConfig(in requestPayload) *genai.GenerateImagesConfig {
+	genCfg := &genai.GenerateImagesConfig{
+		NumberOfImages: in.NumberOfImages,
+		AspectRatio:    in.AspectRatio,
+		ImageSize:      in.ImageSize,
+		// Report why images were filtered instead of silently dropping them
+		IncludeRAIReason:        true,
+		IncludeSafetyAttributes: in.SafetyRatings,
+		EnhancePrompt:           in.EnhancePrompt,
+	}
+	if in.PersonGeneration != "" {
+		genCfg.PersonGeneration = genai.PersonGeneration(in.PersonGeneration)
+	}
+	if in.SafetyFilterLevel != "" {
+		genCfg.SafetyFilterLevel = safetyFilterLevels[in.SafetyFilterLevel]
+	}
+	if returnGCSURI {
+		genCfg.OutputGCSURI = gcsOutputURI
+	}
+	return genCfg
+}
+
+// generation is what Imagen returned for a request, once filtered images
+// are dropped (or regenerated) and the rest ranked.
+type generation struct {
+	images      []*genai.GeneratedImage
+	positions   []int         // position of each image in Imagen's response
+	ranked      []rankedImage // SORT_BY_QUALITY: ranking of images, nil otherwise
+	model       string        // model that produced the images
+	upstreamID  string
+	filtered    int    // images still blocked by safety filters
+	filterRetry string // RETRY_FILTERED outcome, "" when nothing was retried
+}
+
+// generateImages calls Imagen with genCfg and maps its failures to request
+// errors. in.PersonGeneration is updated when it had to be downgraded.
+func generateImages(ctx context.Context, in *requestPayload, genCfg *genai.GenerateImagesConfig) (generation, *requestError) {
+	traceCtx, upstream := withUpstreamTrace(ctx)
+	genResp, model, err := generateWithPersonDowngrade(traceCtx, *in, genCfg)
+	in.PersonGeneration = string(genCfg.PersonGeneration)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("imagen.model", model))
+	upstreamID := upstream.ID()
+	if upstreamID != "" {
+		log.Printf("GenAI request ID: %s", upstreamID)
+	}
+	if errors.Is(err, errQuotaExhausted) {
+		return generation{}, &requestError{status: http.StatusTooManyRequests, msg: fmt.Sprintf("daily quota exhausted for model %s", model)}
+	}
+	if errors.Is(err, errQuotaCheckFailed) {
+		return generation{}, &requestError{status: http.StatusInternalServerError, msg: "quota check failed"}
+	}
+	if err != nil && isAuthError(err) {
+		// Logged with a fixed prefix so a metric filter can alert on it
+		log.Printf("UPSTREAM_AUTH_FAILURE: GenAI rejected the configured API key: %v", err)
+		return generation{}, &requestError{status: http.StatusBadGateway, msg: "upstream authentication failed"}
+	}
+	if err != nil {
+		log.Printf("GenAI error: %v", err)
+		switch classifyGenAIError(err) {
+		case classFiltered:
+			return generation{}, &requestError{status: http.StatusUnprocessableEntity, msg: "content filtered: the prompt was blocked by safety filters", reason: reasonPromptBlocked}
+		case classTransient:
+			return generation{}, &requestError{status: http.StatusServiceUnavailable, msg: fmt.Sprintf("image generation temporarily unavailable: %v", err)}
+		case classInvalid:
+			return generation{}, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("invalid generation request: %v", err)}
+		case classNoModel:
+			return generation{}, &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("model %s was not found or can't generate images; this deployment is configured for: %s", model, configuredModels())}
+		}
+		return generation{}, &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("image generation failed: %v", err)}
+	}
+
+	usable, filteredReason := usableImages(genResp)
+	filtered := len(genResp.GeneratedImages) - len(usable)
+	var filterRetry string
+	var recovered []*genai.GeneratedImage
+	if retryFiltered && filtered > 0 {
+		recovered = retryFilteredImages(traceCtx, model, *in, genCfg, filtered, regenerate)
+		filtered -= len(recovered)
+		filterRetry = "failed"
+		if len(recovered) > 0 {
+			filterRetry = "recovered"
+		}
+	}
+	// Recovered images take the places of filtered ones, so no image moves
+	// past those Imagen generated after it
+	images, positions := placeImages(genResp, recovered)
+	if len(images) == 0 {
+		log.Printf("all images filtered: %s", filteredReason)
+		return generation{}, &requestError{status: http.StatusUnprocessableEntity, msg: "content filtered: all generated images were blocked by safety filters", reason: reasonImagesFiltered}
+	}
+	// Ranked before upload so object names, progress events and every
+	// per-image list follow the quality order
+	gen := generation{images: images, positions: positions, model: model, upstreamID: upstreamID, filtered: filtered, filterRetry: filterRetry}
+	if sortByQuality && !returnGCSURI {
+		gen.ranked = rankByQuality(images)
+		gen.positions = make([]int, len(positions))
+		for i, r := range gen.ranked {
+			images[i] = r.image
+			gen.positions[i] = positions[r.index]
+		}
+	}
+	return gen, nil
+}
+
+// uploadGenerated uploads the generated images to S3 and fills in the
+// per-image lists of out, in image order. It also returns the object keys.
+func uploadGenerated(ctx context.Context, in requestPayload, gen generation, now time.Time, opts uploadOptions, out *responsePayload, onUpload func(uploadProgress)) ([]uploadedImage, []string, *requestError) {
+	images := gen.images
+	var uploads []uploadedImage
+	var reqErr *requestError
+	if sequence != nil {
+		uploads, reqErr = sequence.number(ctx, in.outputPrefix, len(images), func(first int, written *writtenObjects) ([]uploadedImage, *requestError) {
+			in.firstSeq = first
+			opts := opts
+			opts.written = written
+			return uploadImages(ctx, in, images, now, opts, onUpload)
+		})
+	} else {
+		uploads, reqErr = uploadImages(ctx, in, images, now, opts, onUpload)
+	}
+	if reqErr != nil {
+		return nil, nil, reqErr
+	}
+	out.Partial = len(uploads) < len(images)
+	var keys []string
+	var rated bool
+	for i, u := range uploads {
+		out.ImageURLs = append(out.ImageURLs, u.url)
+		out.ETags = append(out.ETags, u.etag)
+		out.Checksums = append(out.Checksums, u.checksum)
+		if in.Blurhash {
+			out.Blurhashes = append(out.Blurhashes, u.blurhash)
+		}
+		if generateLQIP {
+			out.LQIPURLs = append(out.LQIPURLs, u.lqipURL)
+		}
+		if len(in.Sizes) > 0 {
+			out.Variants = append(out.Variants, u.variants)
+		}
+		if gen.ranked != nil || gen.filtered > 0 {
+			out.GenerationOrder = append(out.GenerationOrder, gen.positions[i])
+		}
+		if gen.ranked != nil {
+			out.QualityScores = append(out.QualityScores, gen.ranked[i].score)
+		}
+		if in.SafetyRatings {
+			ratings := safetyRatings(images[i].SafetyAttributes)
+			rated = rated || ratings != nil
+			out.SafetyRatings = append(out.SafetyRatings, ratings)
+		}
+		if generateAltText {
+			out.AltTexts = append(out.AltTexts, u.altText)
+		}
+		if autoLabel {
+			out.Labels = append(out.Labels, u.labels)
+		}
+		if in.ShortLinks {
+			out.ShortLinks = append(out.ShortLinks, u.shortLink)
+		}
+		keys = append(keys, u.key)
+		if in.IncludeReuploadURLs {
+			out.ReuploadURLs = append(out.ReuploadURLs, u.reuploadURL)
+		}
+		if in.Thumbnails {
+			out.ThumbnailURLs = append(out.ThumbnailURLs, u.thumbURL)
+		}
+	}
+
+	if !rated {
+		out.SafetyRatings = nil
+	}
+	out.EnhancedPrompts = enhancedPrompts(images[:len(uploads)])
+	return uploads, keys, nil
+}
+
+// uploadFailed maps a failed upload of what to the request's error.
+func uploadFailed(what string, err error) *requestError {
+	if errors.Is(err, errObjectExists) {
+		return &requestError{status: http.StatusConflict, msg: fmt.Sprintf("refusing to overwrite existing %s: %v", what, err)}
+	}
+	if errors.Is(err, errKeyNotAllowed) {
+		return &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("refusing to upload %s: %v", what, err)}
+	}
+	return &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to upload %s: %v", what, err)}
+}
+
+// metadataHandler serves GET /metadata?key=..., limited to the caller's
+// tenant folder when tenant isolation is on.
+func metadataHandler(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	prefix := folderPrefix
+	if tenantClaim != "" {
+		tenant, err := tenantFromAuthorizer(req.RequestContext.Authorizer)
+		if err != nil {
+			return clientError(requestID(ctx, req), http.StatusForbidden, err.Error())
+		}
+		prefix = normalizePrefix(path.Join(prefix, tenant))
+	}
+	body, reqErr := lookupMetadata(ctx, req.QueryStringParameters["key"], prefix)
+	if reqErr != nil {
+		if reqErr.status >= http.StatusInternalServerError {
+			return serverError(requestID(ctx, req), reqErr.status, reqErr.msg)
+		}
+		return clientError(requestID(ctx, req), reqErr.status, reqErr.msg)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}, nil
+}
+
+func clientError(requestID string, status int, msg string) (events.APIGatewayProxyResponse, error) {
+	if errorFormat == errorFormatRFC7807 {
+		return problemResponse(status, msg, "", requestID), nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Body:       msg,
+	}, nil
+}
+
+func serverError(requestID string, status int, msg string) (events.APIGatewayProxyResponse, error) {
+	if errorFormat == errorFormatRFC7807 {
+		return problemResponse(status, msg, "", requestID), nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Body:       msg,
+	}, nil
+}
+
+// configHeaders describes the effective configuration for HEAD requests.
+func configHeaders() map[string]string {
+	return map[string]string{
+		"X-Imagen-Model":         imagenModel,
+		"X-Fallback-Models":      strings.Join(modelFallbackChain, ","),
+		"X-Default-Aspect-Ratio": defaultAspectRatio,
+		"X-Min-Images":           strconv.Itoa(minImages),
+		"X-Max-Images":           strconv.Itoa(maxImages),
+		"X-Max-Image-Bytes":      strconv.Itoa(maxImageBytes),
+		"X-Key-Strategy":         keyStrategy,
+	}
+}
+
+// errorResponse renders a failed request in ERROR_FORMAT, as JSON when it
+// has a reason and as plain text otherwise.
+func errorResponse(requestID string, reqErr *requestError) (events.APIGatewayProxyResponse, error) {
+	if reqErr.reason != "" {
+		return reasonError(requestID, reqErr)
+	}
+	if reqErr.status >= http.StatusInternalServerError {
+		return serverError(requestID, reqErr.status, reqErr.msg)
+	}
+	return clientError(requestID, reqErr.status, reqErr.msg)
+}
+
+// reasonError renders an error that carries a machine-readable reason as JSON.
+func reasonError(requestID string, reqErr *requestError) (events.APIGatewayProxyResponse, error) {
+	if errorFormat == errorFormatRFC7807 {
+		return problemResponse(reqErr.status, reqErr.msg, reqErr.reason, requestID), nil
+	}
+	body, _ := json.Marshal(map[string]string{"error": reqErr.msg, "reason": reqErr.reason})
+	return events.APIGatewayProxyResponse{
+		StatusCode: reqErr.status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}, nil
 }
 
 func main() {
-    lambda.Start(handler)
+	loadConfig()
+	if sqsMode {
+		lambda.Start(sqsHandler)
+		return
+	}
+	if streaming {
+		lambda.StartHandlerFunc(streamHandler)
+		return
+	}
+	lambda.Start(handler)
 }
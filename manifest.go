@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// manifestSecret signs successful response bodies so clients holding the
+// same secret can detect tampering (MANIFEST_HMAC_SECRET). Nil disables
+// signing.
+var manifestSecret []byte
+
+// manifestSignatureHeader carries the signature of the response body.
+const manifestSignatureHeader = "X-Manifest-Signature"
+
+// signManifest returns the HMAC-SHA256 of body as "sha256=<hex>". The body
+// is the response JSON exactly as sent, which encoding/json renders
+// canonically: struct fields in declaration order, map keys sorted and no
+// insignificant whitespace.
+func signManifest(body []byte) string {
+	mac := hmac.New(sha256.New, manifestSecret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// withManifestSignature adds the body's signature to headers when signing
+// is enabled.
+func withManifestSignature(headers map[string]string, body []byte) map[string]string {
+	if manifestSecret != nil {
+		headers[manifestSignatureHeader] = signManifest(body)
+	}
+	return headers
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// generationMetadata is the provenance stored as S3 user metadata on each
+// uploaded object. Values are URL-escaped, as S3 metadata must be ASCII.
+func generationMetadata(in requestPayload, model string, t time.Time) map[string]string {
+	md := map[string]string{
+		"model":            model,
+		"prompt-hash":      promptHash(in.Prompt),
+		"prompt":           redactPrompt(in.Prompt),
+		"aspect-ratio":     in.AspectRatio,
+		"number-of-images": strconv.Itoa(int(in.NumberOfImages)),
+		"generated-at":     t.UTC().Format(time.RFC3339),
+	}
+	if in.ImageSize != "" {
+		md["image-size"] = in.ImageSize
+	}
+	if in.PersonGeneration != "" {
+		md["person-generation"] = in.PersonGeneration
+	}
+	for k, v := range md {
+		md[k] = url.QueryEscape(v)
+	}
+	return md
+}
+
+// maxMetadataBytes is S3's limit on user metadata: the UTF-8 bytes of all
+// keys and values together.
+const maxMetadataBytes = 2048
+
+// metadataSize is the size of md as S3 counts it against maxMetadataBytes.
+func metadataSize(md map[string]string) int {
+	n := 0
+	for k, v := range md {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+// withEscapedMetadata returns a copy of md with key set to the escaped
+// value, shortened by whole characters to fit maxMetadataBytes. It returns
+// md unchanged when none of value fits.
+func withEscapedMetadata(md map[string]string, key, value string) map[string]string {
+	room := maxMetadataBytes - metadataSize(md) - len(key)
+	escaped := url.QueryEscape(value)
+	for len(escaped) > room && value != "" {
+		_, size := utf8.DecodeLastRuneInString(value)
+		value = value[:len(value)-size]
+		escaped = url.QueryEscape(value)
+	}
+	if strings.TrimSpace(value) == "" {
+		return md
+	}
+	out := make(map[string]string, len(md)+1)
+	for k, v := range md {
+		out[k] = v
+	}
+	out[key] = escaped
+	return out
+}
+
+// metadataResponse is returned by GET /metadata.
+type metadataResponse struct {
+	Key      string            `json:"key"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// lookupMetadata returns the JSON provenance of key, which must lie under
+// prefix, without downloading the object.
+func lookupMetadata(ctx context.Context, key, prefix string) ([]byte, *requestError) {
+	key = strings.TrimPrefix(key, "/")
+	if key == "" {
+		return nil, &requestError{status: http.StatusBadRequest, msg: "key is required"}
+	}
+	if !keyWithinPrefix(key, prefix) {
+		return nil, &requestError{status: http.StatusForbidden, msg: "key is outside the output folder"}
+	}
+	out, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucketFor(key)),
+		Key:    aws.String(key),
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey") {
+		return nil, &requestError{status: http.StatusNotFound, msg: "object not found"}
+	}
+	if err != nil {
+		log.Printf("HeadObject failed for %s: %v", key, err)
+		return nil, &requestError{status: http.StatusInternalServerError, msg: "failed to read object metadata"}
+	}
+	md := make(map[string]string, len(out.Metadata))
+	for k, v := range out.Metadata {
+		if u, err := url.QueryUnescape(v); err == nil {
+			v = u
+		}
+		md[strings.ToLower(k)] = v
+	}
+	body, _ := json.Marshal(metadataResponse{Key: key, Metadata: md})
+	return body, nil
+}
+
+// keyWithinPrefix reports whether key lies under the folder prefix (any key
+// when prefix is empty) without escaping it through ".." segments.
+func keyWithinPrefix(key, prefix string) bool {
+	for _, seg := range strings.Split(key, "/") {
+		if seg == ".." {
+			return false
+		}
+	}
+	prefix = strings.Trim(prefix, "/")
+	return prefix == "" || strings.HasPrefix(key, prefix+"/")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWithEscapedMetadata(t *testing.T) {
+	base := map[string]string{"model": "imagen-4.0-generate-001", "prompt": "a%20fox"}
+	full := map[string]string{"prompt": strings.Repeat("x", maxMetadataBytes-len("prompt")-len("alt-text"))}
+	tests := []struct {
+		name     string
+		md       map[string]string
+		value    string
+		want     string // unescaped value stored; "" when left out
+		maxBytes bool   // the result fills the limit exactly or nearly
+	}{
+		{name: "short value", md: base, value: "A fox in snow.", want: "A fox in snow."},
+		{name: "cut to fit", md: base, value: strings.Repeat("é", 1000), maxBytes: true},
+		{name: "no room", md: full, value: "A fox", want: ""},
+		{name: "nil metadata", md: nil, value: "A fox", want: "A fox"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withEscapedMetadata(tt.md, "alt-text", tt.value)
+			if size := metadataSize(got); size > maxMetadataBytes {
+				t.Fatalf("metadata is %d bytes, over %d", size, maxMetadataBytes)
+			}
+			stored, ok := got["alt-text"]
+			if tt.maxBytes {
+				if !ok || metadataSize(got) < maxMetadataBytes-len(url.QueryEscape("é")) {
+					t.Errorf("metadata is %d bytes; want the value cut close to the limit", metadataSize(got))
+				}
+				return
+			}
+			if tt.want == "" {
+				if ok {
+					t.Errorf("alt-text = %q, want it left out", stored)
+				}
+				return
+			}
+			if stored != url.QueryEscape(tt.want) {
+				t.Errorf("alt-text = %q, want %q", stored, url.QueryEscape(tt.want))
+			}
+		})
+	}
+	if _, ok := base["alt-text"]; ok {
+		t.Error("withEscapedMetadata modified its input")
+	}
+}
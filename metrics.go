@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// metricsNamespace is the CloudWatch namespace of emitted metrics
+// (METRICS_NAMESPACE).
+var metricsNamespace = "ImagenLambda"
+
+// costCenters is the allowlist for the costCenter request field
+// (COST_CENTERS, comma separated).
+var costCenters = map[string]bool{}
+
+// emitMetric writes one CloudWatch Embedded Metric Format record to stdout,
+// where Lambda's log agent turns it into a metric with the given
+// dimensions. No API call is made, so it is cheap enough for every request.
+func emitMetric(name string, value float64, unit string, dims map[string]string) {
+	names := make([]string, 0, len(dims))
+	for k := range dims {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	rec := map[string]any{
+		"_aws": map[string]any{
+			"Timestamp": time.Now().UnixMilli(),
+			"CloudWatchMetrics": []map[string]any{{
+				"Namespace":  metricsNamespace,
+				"Dimensions": [][]string{names},
+				"Metrics":    []map[string]string{{"Name": name, "Unit": unit}},
+			}},
+		},
+		name: value,
+	}
+	for k, v := range dims {
+		rec[k] = v
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("failed to encode metric %s: %v", name, err)
+		return
+	}
+	os.Stdout.Write(append(b, '\n'))
+}
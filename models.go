@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// imagenModel is the model used for generation.
+var imagenModel = "imagen-4.0-generate-preview-06-06"
+
+// modelFallbackChain lists models to try, in order, when imagenModel fails
+// with a retryable error (MODEL_FALLBACK_CHAIN).
+var modelFallbackChain []string
+
+// generator makes the GenAI calls of generateWithFallback.
+var generator imageGenerator = generateWithModel
+
+// autoDowngradePerson retries requests whose personGeneration setting is
+// rejected with the next stricter one (AUTO_DOWNGRADE_PERSON).
+var autoDowngradePerson bool
+
+// personDowngrades maps each personGeneration setting to the next stricter
+// one. An unset value means the API default, ALLOW_ADULT.
+var personDowngrades = map[string]genai.PersonGeneration{
+	string(genai.PersonGenerationAllowAll):   genai.PersonGenerationAllowAdult,
+	string(genai.PersonGenerationAllowAdult): genai.PersonGenerationDontAllow,
+	"":                                       genai.PersonGenerationDontAllow,
+}
+
+// generateWithPersonDowngrade runs generateWithFallback, stepping
+// cfg.PersonGeneration down personDowngrades while GenAI rejects it. cfg is
+// left holding the setting that was used last.
+func generateWithPersonDowngrade(ctx context.Context, in requestPayload, cfg *genai.GenerateImagesConfig) (*genai.GenerateImagesResponse, string, error) {
+	for {
+		resp, model, err := generateWithFallback(ctx, in, cfg)
+		if err == nil || !autoDowngradePerson || !isPersonGenerationRejected(err) {
+			return resp, model, err
+		}
+		next, ok := personDowngrades[strings.ToUpper(string(cfg.PersonGeneration))]
+		if !ok {
+			return resp, model, err
+		}
+		log.Printf("personGeneration %q rejected (%v); retrying with %s", cfg.PersonGeneration, err, next)
+		cfg.PersonGeneration = next
+	}
+}
+
+// errQuotaCheckFailed hides quota store failures from callers; the
+// underlying error is logged.
+var errQuotaCheckFailed = errors.New("quota check failed")
+
+// modelImageSizes lists the sample image sizes each model accepts. Models
+// missing from the map only support their default size.
+var modelImageSizes = map[string][]string{
+	"imagen-4.0-generate-preview-06-06":       {"1K", "2K"},
+	"imagen-4.0-ultra-generate-preview-06-06": {"1K", "2K"},
+	"imagen-4.0-generate-001":                 {"1K", "2K"},
+	"imagen-4.0-ultra-generate-001":           {"1K", "2K"},
+}
+
+// validateImageSize checks that model can generate images of size. An empty
+// size means the model default and is always valid.
+func validateImageSize(model, size string) error {
+	if size == "" {
+		return nil
+	}
+	sizes := modelImageSizes[model]
+	for _, s := range sizes {
+		if s == size {
+			return nil
+		}
+	}
+	if len(sizes) == 0 {
+		return fmt.Errorf("model %s does not support imageSize", model)
+	}
+	return fmt.Errorf("imageSize %q is not supported by model %s (supported: %s)", size, model, strings.Join(sizes, ", "))
+}
+
+// effectiveConfig is the resolved generation config, after defaults,
+// normalization and any fallback or downgrade, returned so that a
+// generation can be reproduced.
+type effectiveConfig struct {
+	Model             string   `json:"model"`
+	NumberOfImages    int32    `json:"numberOfImages"`
+	AspectRatio       string   `json:"aspectRatio"`
+	ImageSize         string   `json:"imageSize,omitempty"`
+	PersonGeneration  string   `json:"personGeneration,omitempty"`
+	SafetyFilterLevel string   `json:"safetyFilterLevel,omitempty"`
+	Seed              *int32   `json:"seed,omitempty"`
+	GuidanceScale     *float32 `json:"guidanceScale,omitempty"`
+	NegativePrompt    string   `json:"negativePrompt,omitempty"`
+	EnhancePrompt     bool     `json:"enhancePrompt"`
+	AddWatermark      bool     `json:"addWatermark"`
+	IncludeRAIReason  bool     `json:"includeRaiReason"`
+	ReferenceStrength *float64 `json:"referenceStrength,omitempty"`
+	Prompt            string   `json:"prompt,omitempty"` // prompt sent to the model, when translation or an ASPECT_PROMPT_HINTS hint changed it
+}
+
+func newEffectiveConfig(model string, in requestPayload, cfg *genai.GenerateImagesConfig) *effectiveConfig {
+	ec := &effectiveConfig{
+		Model:             model,
+		NumberOfImages:    cfg.NumberOfImages,
+		AspectRatio:       cfg.AspectRatio,
+		ImageSize:         cfg.ImageSize,
+		PersonGeneration:  string(cfg.PersonGeneration),
+		SafetyFilterLevel: string(cfg.SafetyFilterLevel),
+		Seed:              cfg.Seed,
+		GuidanceScale:     cfg.GuidanceScale,
+		NegativePrompt:    cfg.NegativePrompt,
+		EnhancePrompt:     cfg.EnhancePrompt,
+		AddWatermark:      cfg.AddWatermark,
+		IncludeRAIReason:  cfg.IncludeRAIReason,
+		ReferenceStrength: in.ReferenceStrength,
+	}
+	if p := modelPrompt(in.Prompt, cfg.AspectRatio); p != in.Prompt || in.originalPrompt != "" {
+		ec.Prompt = p
+	}
+	return ec
+}
+
+// generateWithFallback generates images with imagenModel, then with each
+// fallback model in turn while failures are retryable and ctx is live. It
+// returns the model of the last attempt, which produced the images on success.
+func generateWithFallback(ctx context.Context, in requestPayload, cfg *genai.GenerateImagesConfig) (*genai.GenerateImagesResponse, string, error) {
+	models := append([]string{imagenModel}, modelFallbackChain...)
+	if in.referenceBytes != nil {
+		models = []string{editModel}
+	}
+	if in.model != "" {
+		models = []string{in.model}
+	}
+	var lastModel string
+	var lastErr error
+	for _, model := range models {
+		if lastErr != nil {
+			if err := validateImageSize(model, cfg.ImageSize); err != nil {
+				log.Printf("skipping fallback model %s: %v", model, err)
+				continue
+			}
+			if !modelSupportsAspect(model, cfg.AspectRatio) {
+				log.Printf("skipping fallback model %s: aspect ratio %s is not supported", model, cfg.AspectRatio)
+				continue
+			}
+			log.Printf("model %s failed (%v); falling back to %s", lastModel, lastErr, model)
+		}
+		resp, err := generator(ctx, model, in, cfg)
+		if err == nil || !isRetryableError(err) || ctx.Err() != nil {
+			return resp, model, err
+		}
+		lastModel, lastErr = model, err
+	}
+	return nil, lastModel, lastErr
+}
+
+// generateWithModel makes one GenerateImages call against model, charging
+// the images to its daily quota when quotas are enabled.
+func generateWithModel(ctx context.Context, model string, in requestPayload, cfg *genai.GenerateImagesConfig) (*genai.GenerateImagesResponse, error) {
+	// Claim quota for the whole request up front so concurrent invocations
+	// can't overshoot; anything not generated is given back below.
+	reserved := 0
+	if quota != nil {
+		if err := quota.reserve(ctx, model, int(cfg.NumberOfImages)); err != nil {
+			if !errors.Is(err, errQuotaExhausted) {
+				log.Printf("quota check failed: %v", err)
+				err = errQuotaCheckFailed
+			}
+			return nil, err
+		}
+		reserved = int(cfg.NumberOfImages)
+	}
+
+	call := func(ctx context.Context, cfg *genai.GenerateImagesConfig) (*genai.GenerateImagesResponse, error) {
+		if err := genaiLimit.acquire(ctx); err != nil {
+			return nil, err
+		}
+		defer genaiLimit.release()
+		if in.referenceBytes != nil {
+			return editWithReference(ctx, model, in, cfg)
+		}
+		return genaiClient.Models.GenerateImages(ctx, model, modelPrompt(in.Prompt, cfg.AspectRatio), cfg)
+	}
+	var resp *genai.GenerateImagesResponse
+	var err error
+	if singleImageModels[model] && cfg.NumberOfImages > 1 {
+		resp, err = generateEach(ctx, cfg, call)
+	} else {
+		resp, err = call(ctx, cfg)
+	}
+
+	if reserved > 0 {
+		generated := 0
+		if err == nil {
+			generated = len(resp.GeneratedImages)
+		}
+		if err := quota.release(ctx, model, reserved-generated); err != nil {
+			log.Printf("failed to release unused quota: %v", err)
+		}
+	}
+	return resp, err
+}
+
+// loadGenerationConfig reads the model settings and the optional model
+// calls made around generation.
+func loadGenerationConfig() {
+	var err error
+	// Generation behaviour
+	autoDowngradePerson = os.Getenv("AUTO_DOWNGRADE_PERSON") == "true"
+	generationBudget = time.Duration(envInt("GENERATION_BUDGET_SECONDS", 0)) * time.Second
+	secondsPerImage = envInt("SECONDS_PER_IMAGE", secondsPerImage)
+	generateAltText = os.Getenv("GENERATE_ALT_TEXT") == "true"
+	if v := os.Getenv("ALT_TEXT_MODEL"); v != "" {
+		altTextModel = v
+	}
+	autoLabel = os.Getenv("AUTO_LABEL") == "true"
+	if v := os.Getenv("LABEL_MODEL"); v != "" {
+		labelModel = v
+	}
+	maxLabels = envInt("MAX_LABELS", maxLabels)
+	retryFiltered = os.Getenv("RETRY_FILTERED") == "true"
+	sortByQuality = os.Getenv("SORT_BY_QUALITY") == "true"
+	autoTranslate = os.Getenv("AUTO_TRANSLATE") == "true"
+	if v := os.Getenv("TRANSLATE_MODEL"); v != "" {
+		translateModel = v
+	}
+	englishOnly = os.Getenv("ENGLISH_ONLY") == "true"
+	if englishOnly && autoTranslate {
+		log.Fatalf("ENGLISH_ONLY and AUTO_TRANSLATE can't both be set")
+	}
+	if v := os.Getenv("ENGLISH_ONLY_CONFIDENCE"); v != "" {
+		if englishOnlyConfidence, err = strconv.ParseFloat(v, 64); err != nil || englishOnlyConfidence <= 0 || englishOnlyConfidence > 1 {
+			log.Fatalf("ENGLISH_ONLY_CONFIDENCE must be a number in (0, 1], got %q", v)
+		}
+	}
+
+	// Models to try, in order, when the primary is overloaded
+	for _, m := range strings.Split(os.Getenv("MODEL_FALLBACK_CHAIN"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			modelFallbackChain = append(modelFallbackChain, m)
+		}
+	}
+	if v, ok := os.LookupEnv("SINGLE_IMAGE_MODELS"); ok {
+		singleImageModels = map[string]bool{}
+		for _, m := range strings.Split(v, ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				singleImageModels[m] = true
+			}
+		}
+	}
+	if v := os.Getenv("MODEL_ASPECT_RATIOS"); v != "" {
+		if modelAspectRatios, err = parseModelAspectRatios(v); err != nil {
+			log.Fatalf("invalid MODEL_ASPECT_RATIOS: %v", err)
+		}
+	}
+	autoAdjustAspect = os.Getenv("AUTO_ADJUST_ASPECT") == "true"
+
+	if v := os.Getenv("EDIT_MODEL"); v != "" {
+		editModel = v
+	}
+}
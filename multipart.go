@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// minPartSize is the smallest part S3 accepts, except for the last one.
+const minPartSize = 5 << 20
+
+var (
+	// multipartThreshold is the object size above which uploads are split
+	// into parts (MULTIPART_THRESHOLD_BYTES).
+	multipartThreshold = 64 << 20
+	// multipartPartSize is the size of each part (MULTIPART_PART_SIZE_BYTES).
+	multipartPartSize = 16 << 20
+)
+
+// multipartAPI is the part of the S3 API multipart uploads use.
+type multipartAPI interface {
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// putMultipart uploads body with the settings of input in parts of
+// partSize, each carrying its SHA-256 and retried on throttling like a
+// single PUT. The result is a PutObjectOutput so callers don't care which
+// way an object went up. Its checksum is what S3 reports for the completed
+// upload, a composite of the part checksums followed by "-<parts>";
+// uploadBody replaces it with the SHA-256 of body. A failed upload is
+// aborted, so no orphaned parts are left to bill for.
+func putMultipart(ctx context.Context, client multipartAPI, input *s3.PutObjectInput, body []byte, partSize int) (_ *s3.PutObjectOutput, err error) {
+	created, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:                  input.Bucket,
+		Key:                     input.Key,
+		ContentType:             input.ContentType,
+		Metadata:                input.Metadata,
+		Tagging:                 input.Tagging,
+		ChecksumAlgorithm:       types.ChecksumAlgorithmSha256,
+		ServerSideEncryption:    input.ServerSideEncryption,
+		SSEKMSKeyId:             input.SSEKMSKeyId,
+		SSEKMSEncryptionContext: input.SSEKMSEncryptionContext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	uploadID := created.UploadId
+	defer func() {
+		if err == nil {
+			return
+		}
+		// Abort even when ctx is what failed
+		if _, abortErr := client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   input.Bucket,
+			Key:      input.Key,
+			UploadId: uploadID,
+		}); abortErr != nil {
+			log.Printf("failed to abort multipart upload of %s: %v", aws.ToString(input.Key), abortErr)
+		}
+	}()
+
+	var parts []types.CompletedPart
+	for start := 0; start < len(body); start += partSize {
+		chunk := body[start:min(start+partSize, len(body))]
+		n := int32(len(parts) + 1)
+		sum := sha256Base64(chunk)
+		var out *s3.UploadPartOutput
+		err := retryS3(ctx, func() error {
+			var err error
+			out, err = client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:         input.Bucket,
+				Key:            input.Key,
+				UploadId:       uploadID,
+				PartNumber:     aws.Int32(n),
+				Body:           bytes.NewReader(chunk),
+				ChecksumSHA256: aws.String(sum),
+			})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("part %d: %w", n, err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(n), ChecksumSHA256: aws.String(sum)})
+	}
+	done, err := client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		IfNoneMatch:     input.IfNoneMatch,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3.PutObjectOutput{ETag: done.ETag, ChecksumSHA256: done.ChecksumSHA256}, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// fakeMultipart records the parts of one multipart upload.
+type fakeMultipart struct {
+	failPart     int32 // part number to fail, 0 for none
+	throttlePart int32 // part number to throttle once, 0 for none
+	throttled    bool
+	parts        [][]byte
+	completed    int // parts listed on completion
+	aborted      bool
+}
+
+func (f *fakeMultipart) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil
+}
+
+func (f *fakeMultipart) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if aws.ToInt32(params.PartNumber) == f.failPart {
+		return nil, errors.New("part failed")
+	}
+	if aws.ToInt32(params.PartNumber) == f.throttlePart && !f.throttled {
+		f.throttled = true
+		return nil, &smithy.GenericAPIError{Code: "SlowDown", Fault: smithy.FaultServer}
+	}
+	b, _ := io.ReadAll(params.Body)
+	if aws.ToString(params.ChecksumSHA256) != sha256Base64(b) {
+		return nil, errors.New("checksum mismatch")
+	}
+	f.parts = append(f.parts, b)
+	return &s3.UploadPartOutput{ETag: aws.String("part")}, nil
+}
+
+func (f *fakeMultipart) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.completed = len(params.MultipartUpload.Parts)
+	return &s3.CompleteMultipartUploadOutput{ETag: aws.String(`"etag-3"`), ChecksumSHA256: aws.String("composite-3")}, nil
+}
+
+func (f *fakeMultipart) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.aborted = true
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func TestPutMultipart(t *testing.T) {
+	defer func(d time.Duration) { s3RetryBase = d }(s3RetryBase)
+	s3RetryBase = time.Millisecond
+	body := bytes.Repeat([]byte("0123456789"), 5)
+	tests := []struct {
+		name         string
+		partSize     int
+		failPart     int32
+		throttlePart int32
+		wantParts    []int // sizes
+		wantErr      bool
+	}{
+		{name: "even split", partSize: 25, wantParts: []int{25, 25}},
+		{name: "short last part", partSize: 20, wantParts: []int{20, 20, 10}},
+		{name: "single part", partSize: 100, wantParts: []int{50}},
+		{name: "throttled part retried", partSize: 20, throttlePart: 2, wantParts: []int{20, 20, 10}},
+		{name: "failed part aborts", partSize: 20, failPart: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeMultipart{failPart: tt.failPart, throttlePart: tt.throttlePart}
+			input := &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")}
+			out, err := putMultipart(context.Background(), f, input, body, tt.partSize)
+			if tt.wantErr {
+				if err == nil || !f.aborted {
+					t.Fatalf("putMultipart() error = %v, aborted %v; want an error and an abort", err, f.aborted)
+				}
+				return
+			}
+			if err != nil || f.aborted {
+				t.Fatalf("putMultipart() error = %v, aborted %v", err, f.aborted)
+			}
+			if len(f.parts) != len(tt.wantParts) || f.completed != len(tt.wantParts) {
+				t.Fatalf("uploaded %d parts, completed %d; want %d", len(f.parts), f.completed, len(tt.wantParts))
+			}
+			for i, size := range tt.wantParts {
+				if len(f.parts[i]) != size {
+					t.Errorf("part %d is %d bytes, want %d", i+1, len(f.parts[i]), size)
+				}
+			}
+			if !bytes.Equal(bytes.Join(f.parts, nil), body) {
+				t.Error("parts don't add up to the body")
+			}
+			if aws.ToString(out.ETag) != `"etag-3"` {
+				t.Errorf("ETag = %q", aws.ToString(out.ETag))
+			}
+		})
+	}
+}
+
+// fakeUploader takes single PUTs and multipart uploads.
+type fakeUploader struct {
+	fakePutter
+	fakeMultipart
+}
+
+func TestUploadBody(t *testing.T) {
+	defer func(threshold, size int) { multipartThreshold, multipartPartSize = threshold, size }(multipartThreshold, multipartPartSize)
+	multipartThreshold, multipartPartSize = 40, 20
+	tests := []struct {
+		name      string
+		size      int
+		wantPuts  int
+		wantParts int
+	}{
+		{name: "small object in one PUT", size: 10, wantPuts: 1},
+		{name: "at the threshold in one PUT", size: 40, wantPuts: 1},
+		{name: "over the threshold in parts", size: 50, wantParts: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := bytes.Repeat([]byte("x"), tt.size)
+			sum := sha256Base64(body)
+			f := &fakeUploader{}
+			input := &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key"), ChecksumSHA256: aws.String(sum)}
+			out, err := uploadBody(context.Background(), f, input, body)
+			if err != nil {
+				t.Fatalf("uploadBody() error = %v", err)
+			}
+			if f.calls != tt.wantPuts || len(f.parts) != tt.wantParts {
+				t.Errorf("uploadBody() made %d PUT(s) and %d part(s), want %d and %d", f.calls, len(f.parts), tt.wantPuts, tt.wantParts)
+			}
+			if tt.wantParts > 0 && aws.ToString(out.ChecksumSHA256) != sum {
+				t.Errorf("checksum = %q, want the full-object SHA-256 %q", aws.ToString(out.ChecksumSHA256), sum)
+			}
+		})
+	}
+}
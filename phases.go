@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Container-wide caps on calls in flight per phase, shared by everything
+// running in the container (batch prompts, comparisons, split single-image
+// calls, concurrent streams). Each slot is held only for the call itself,
+// so images waiting on slow S3 uploads don't hold GenAI slots, and a burst
+// of generations doesn't starve uploads. UPLOAD_CONCURRENCY still caps the
+// workers of a single request.
+var (
+	// genaiLimit caps GenAI calls: Imagen generations and edits, alt text,
+	// labels and translation (GENAI_CONCURRENCY).
+	genaiLimit = newLimiter(8)
+	// s3Limit caps S3 uploads, each counted once however many retries or
+	// parts it takes (S3_CONCURRENCY).
+	s3Limit = newLimiter(32)
+)
+
+// limiter is a counting semaphore. A nil limiter doesn't limit.
+type limiter chan struct{}
+
+// newLimiter allows n calls at once, or any number when n is 0.
+func newLimiter(n int) limiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(limiter, n)
+}
+
+// acquire waits for a slot, giving up when ctx ends.
+func (l limiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot taken by acquire.
+func (l limiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// loadConcurrencyConfig reads the parallelism limits of uploads, compared
+// models and each phase.
+func loadConcurrencyConfig() {
+	maxUploadConcurrency = envInt("UPLOAD_CONCURRENCY", maxUploadConcurrency)
+	compareConcurrency = envInt("COMPARE_CONCURRENCY", compareConcurrency)
+	genaiLimit = newLimiter(envInt("GENAI_CONCURRENCY", cap(genaiLimit)))
+	s3Limit = newLimiter(envInt("S3_CONCURRENCY", cap(s3Limit)))
+	compareTimeout = time.Duration(envInt("COMPARE_TIMEOUT_SECONDS", 0)) * time.Second
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// qualityPresets bundles generation settings behind the request's quality
+// field, so clients can trade speed for quality without knowing models or
+// sizes (QUALITY_PRESETS replaces the whole map).
+var qualityPresets = map[string]qualityPreset{
+	"draft":    {Model: "imagen-4.0-fast-generate-001", NumberOfImages: 1},
+	"standard": {},
+	"high":     {Model: "imagen-4.0-ultra-generate-001", ImageSize: "2K", NumberOfImages: 1},
+}
+
+// qualityPreset holds the defaults one preset applies. Empty fields keep the
+// deployment defaults.
+type qualityPreset struct {
+	Model          string `json:"model,omitempty"`          // the only model tried, instead of IMAGEN_MODEL and its fallbacks
+	ImageSize      string `json:"imageSize,omitempty"`      // e.g. "2K"
+	NumberOfImages int32  `json:"numberOfImages,omitempty"` // images per prompt
+}
+
+func parseQualityPresets(raw string) (map[string]qualityPreset, error) {
+	var presets map[string]qualityPreset
+	dec := json.NewDecoder(bytes.NewReader([]byte(raw)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&presets); err != nil {
+		return nil, err
+	}
+	normalized := make(map[string]qualityPreset, len(presets))
+	for name, p := range presets {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			return nil, fmt.Errorf("empty preset name")
+		}
+		if p.NumberOfImages < 0 || int(p.NumberOfImages) > maxImages {
+			return nil, fmt.Errorf("preset %q: numberOfImages %d must be between 0 and MAX_IMAGES (%d)", name, p.NumberOfImages, maxImages)
+		}
+		p.ImageSize = strings.ToUpper(p.ImageSize)
+		model := p.Model
+		if model == "" {
+			model = imagenModel
+		}
+		if err := validateImageSize(model, p.ImageSize); err != nil {
+			return nil, fmt.Errorf("preset %q: %v", name, err)
+		}
+		normalized[name] = p
+	}
+	return normalized, nil
+}
+
+// presetNames lists the configured presets for error messages.
+func presetNames() string {
+	names := make([]string, 0, len(qualityPresets))
+	for name := range qualityPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// applyQualityPreset expands in.Quality into the settings it stands for.
+// Fields the request sets itself win over the preset. A preset model is the
+// only one tried, so it turns off MODEL_FALLBACK_CHAIN. Edits with a
+// referenceImage keep EDIT_MODEL and the default size, which editing can't
+// change.
+func applyQualityPreset(in *requestPayload) *requestError {
+	if in.Quality == "" {
+		return nil
+	}
+	in.Quality = strings.ToLower(strings.TrimSpace(in.Quality))
+	p, ok := qualityPresets[in.Quality]
+	if !ok {
+		return &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("unknown quality %q (use one of: %s)", in.Quality, presetNames())}
+	}
+	if p.Model != "" && len(in.CompareModels) == 0 && in.ReferenceImage == "" {
+		in.model = p.Model
+	}
+	if in.ImageSize == "" && in.ReferenceImage == "" {
+		in.ImageSize = p.ImageSize
+	}
+	if in.NumberOfImages <= 0 {
+		in.NumberOfImages = p.NumberOfImages
+	}
+	return nil
+}
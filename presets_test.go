@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestApplyQualityPreset(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        requestPayload
+		wantModel string
+		wantSize  string
+		wantN     int32
+		wantErr   string
+	}{
+		{name: "no preset", in: requestPayload{}},
+		{name: "draft", in: requestPayload{Quality: "draft"}, wantModel: "imagen-4.0-fast-generate-001", wantN: 1},
+		{name: "standard keeps defaults", in: requestPayload{Quality: "standard"}},
+		{name: "case and spaces", in: requestPayload{Quality: " HIGH "}, wantModel: "imagen-4.0-ultra-generate-001", wantSize: "2K", wantN: 1},
+		{name: "request fields win", in: requestPayload{Quality: "high", ImageSize: "1K", NumberOfImages: 3}, wantModel: "imagen-4.0-ultra-generate-001", wantSize: "1K", wantN: 3},
+		{name: "reference image keeps edit model", in: requestPayload{Quality: "high", ReferenceImage: "s3://b/k.png"}, wantN: 1},
+		{name: "compare models keep their models", in: requestPayload{Quality: "draft", CompareModels: []string{"a", "b"}}, wantN: 1},
+		{name: "unknown", in: requestPayload{Quality: "ultra"}, wantErr: `unknown quality "ultra" (use one of: draft, high, standard)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := tt.in
+			reqErr := applyQualityPreset(&in)
+			if tt.wantErr != "" {
+				if reqErr == nil || reqErr.status != http.StatusBadRequest || reqErr.msg != tt.wantErr {
+					t.Fatalf("applyQualityPreset() error = %+v, want 400 %q", reqErr, tt.wantErr)
+				}
+				return
+			}
+			if reqErr != nil {
+				t.Fatalf("applyQualityPreset() error = %+v", reqErr)
+			}
+			if in.model != tt.wantModel || in.ImageSize != tt.wantSize || in.NumberOfImages != tt.wantN {
+				t.Errorf("applyQualityPreset() = model %q, size %q, n %d; want %q, %q, %d",
+					in.model, in.ImageSize, in.NumberOfImages, tt.wantModel, tt.wantSize, tt.wantN)
+			}
+		})
+	}
+}
+
+func TestParseQualityPresets(t *testing.T) {
+	defer func(n int) { maxImages = n }(maxImages)
+	maxImages = 4
+	tests := []struct {
+		name    string
+		raw     string
+		want    map[string]qualityPreset
+		wantErr bool
+	}{
+		{
+			name: "names and sizes normalized",
+			raw:  `{" Print ": {"imageSize": "2k", "model": "imagen-4.0-generate-001"}, "quick": {"numberOfImages": 1}}`,
+			want: map[string]qualityPreset{
+				"print": {Model: "imagen-4.0-generate-001", ImageSize: "2K"},
+				"quick": {NumberOfImages: 1},
+			},
+		},
+		{name: "too many images", raw: `{"x": {"numberOfImages": 9}}`, wantErr: true},
+		{name: "negative images", raw: `{"x": {"numberOfImages": -1}}`, wantErr: true},
+		{name: "size the model lacks", raw: `{"x": {"imageSize": "2K", "model": "imagen-3.0-generate-002"}}`, wantErr: true},
+		{name: "empty name", raw: `{" ": {}}`, wantErr: true},
+		{name: "unknown field", raw: `{"x": {"steps": 50}}`, wantErr: true},
+		{name: "not an object", raw: `["draft"]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseQualityPresets(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseQualityPresets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseQualityPresets() = %+v, want %+v", got, tt.want)
+			}
+			for name, p := range tt.want {
+				if got[name] != p {
+					t.Errorf("preset %q = %+v, want %+v", name, got[name], p)
+				}
+			}
+		})
+	}
+}
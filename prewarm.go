@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// prewarmTimeout bounds each warm-up call, so a slow endpoint can't add
+// more than this to a cold start.
+const prewarmTimeout = 2 * time.Second
+
+// bucketHeader is the part of the S3 API the warm-up uses.
+type bucketHeader interface {
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+}
+
+// prewarm opens the S3 and GenAI connections during init (PREWARM=true), so
+// the first request doesn't pay for DNS and TLS handshakes. Both calls run
+// at once; failures are only warnings, as the request path will retry.
+func prewarm(ctx context.Context, s3c bucketHeader, bucket string, pingGenAI func(context.Context) error) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(ctx, prewarmTimeout)
+		defer cancel()
+		if _, err := s3c.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)}); err != nil {
+			log.Printf("warning: S3 pre-warm failed: %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(ctx, prewarmTimeout)
+		defer cancel()
+		if err := pingGenAI(ctx); err != nil {
+			log.Printf("warning: GenAI pre-warm failed: %v", err)
+		}
+	}()
+	wg.Wait()
+}
+
+// pingGenAI makes the cheapest authenticated GenAI call there is: looking
+// up the configured model.
+func pingGenAI(ctx context.Context) error {
+	_, err := genaiClient.Models.Get(ctx, imagenModel, nil)
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"google.golang.org/genai"
+)
+
+// personGeneration and safetyFilterLevel loosen what Imagen will produce.
+// Only callers holding the TRUSTED_SCOPE JWT scope or one of the
+// TRUSTED_API_KEY_IDS API Gateway API keys may send them. With neither
+// configured nobody may; everyone gets the deployment's defaults.
+var (
+	trustedScope     string
+	trustedAPIKeyIDs = map[string]bool{}
+)
+
+// safetyFilterLevels are the accepted safetyFilterLevel values.
+var safetyFilterLevels = map[string]genai.SafetyFilterLevel{
+	"BLOCK_LOW_AND_ABOVE":    genai.SafetyFilterLevelBlockLowAndAbove,
+	"BLOCK_MEDIUM_AND_ABOVE": genai.SafetyFilterLevelBlockMediumAndAbove,
+	"BLOCK_ONLY_HIGH":        genai.SafetyFilterLevelBlockOnlyHigh,
+	"BLOCK_NONE":             genai.SafetyFilterLevelBlockNone,
+}
+
+// isTrustedCaller reports whether an API Gateway request came with a trusted
+// API key or a JWT whose space-separated "scope" claim has TRUSTED_SCOPE.
+func isTrustedCaller(rc events.APIGatewayProxyRequestContext) bool {
+	if id := rc.Identity.APIKeyID; id != "" && trustedAPIKeyIDs[id] {
+		return true
+	}
+	if trustedScope == "" {
+		return false
+	}
+	scopes, _ := claimFromAuthorizer(rc.Authorizer, "scope")
+	for _, s := range strings.Fields(scopes) {
+		if s == trustedScope {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOverrides rejects privileged fields from untrusted callers.
+func checkOverrides(in requestPayload, trusted bool) *requestError {
+	if trusted {
+		return nil
+	}
+	if in.PersonGeneration != "" {
+		return &requestError{status: http.StatusForbidden, msg: "personGeneration may only be set by trusted callers"}
+	}
+	if in.SafetyFilterLevel != "" {
+		return &requestError{status: http.StatusForbidden, msg: "safetyFilterLevel may only be set by trusted callers"}
+	}
+	return nil
+}
+
+// loadAccessConfig reads tenant isolation, trusted callers and billing.
+func loadAccessConfig() {
+	// Isolate each tenant's images under its own prefix
+	tenantClaim = os.Getenv("TENANT_CLAIM")
+	trustedScope = os.Getenv("TRUSTED_SCOPE")
+	for _, id := range strings.Split(os.Getenv("TRUSTED_API_KEY_IDS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			trustedAPIKeyIDs[id] = true
+		}
+	}
+
+	// Billing: allowed cost centers and the metrics namespace they're reported under
+	for _, c := range strings.Split(os.Getenv("COST_CENTERS"), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			costCenters[c] = true
+		}
+	}
+	if v := os.Getenv("METRICS_NAMESPACE"); v != "" {
+		metricsNamespace = v
+	}
+}
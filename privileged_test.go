@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestCheckOverrides(t *testing.T) {
+	defer func(s string, ids map[string]bool) { trustedScope, trustedAPIKeyIDs = s, ids }(trustedScope, trustedAPIKeyIDs)
+	withKey := events.APIGatewayProxyRequestContext{Identity: events.APIGatewayRequestIdentity{APIKeyID: "key-1"}}
+	tests := []struct {
+		name       string
+		scope      string
+		ids        map[string]bool
+		rc         events.APIGatewayProxyRequestContext
+		in         requestPayload
+		wantStatus int
+	}{
+		{name: "nothing privileged", in: requestPayload{Prompt: "a cat"}},
+		{name: "no trust source configured", rc: withKey, in: requestPayload{PersonGeneration: "ALLOW_ALL"}, wantStatus: http.StatusForbidden},
+		{name: "untrusted key", ids: map[string]bool{"key-2": true}, rc: withKey, in: requestPayload{SafetyFilterLevel: "BLOCK_NONE"}, wantStatus: http.StatusForbidden},
+		{name: "trusted key", ids: map[string]bool{"key-1": true}, rc: withKey, in: requestPayload{SafetyFilterLevel: "BLOCK_NONE"}},
+		{name: "trusted scope", scope: "imagen:admin", rc: events.APIGatewayProxyRequestContext{Authorizer: map[string]interface{}{"claims": map[string]interface{}{"scope": "read imagen:admin"}}}, in: requestPayload{PersonGeneration: "ALLOW_ALL"}},
+	}
+	for _, tt := range tests {
+		trustedScope, trustedAPIKeyIDs = tt.scope, tt.ids
+		if trustedAPIKeyIDs == nil {
+			trustedAPIKeyIDs = map[string]bool{}
+		}
+		got := 0
+		if reqErr := checkOverrides(tt.in, isTrustedCaller(tt.rc)); reqErr != nil {
+			got = reqErr.status
+		}
+		if got != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.wantStatus)
+		}
+	}
+}
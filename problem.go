@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// errorFormatRFC7807 renders errors as RFC 7807 application/problem+json
+// (ERROR_FORMAT=rfc7807). The default is a plain-text body, or JSON for
+// errors with a reason.
+const errorFormatRFC7807 = "rfc7807"
+
+// errorFormat is ERROR_FORMAT: "" or errorFormatRFC7807.
+var errorFormat string
+
+// problemDetails is an RFC 7807 error body. We define no problem types of
+// our own, so type is always about:blank and title the status text; the
+// machine-readable cause goes in the reason extension member.
+type problemDetails struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"` // request ID
+	Reason   string `json:"reason,omitempty"`
+}
+
+// problemResponse renders an error as application/problem+json.
+func problemResponse(status int, msg, reason, requestID string) events.APIGatewayProxyResponse {
+	body, _ := json.Marshal(problemDetails{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   msg,
+		Instance: requestID,
+		Reason:   reason,
+	})
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/problem+json"},
+		Body:       string(body),
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Policies for prompts containing disallowed characters (INVALID_CHAR_POLICY).
+const (
+	invalidCharReject = "reject"
+	invalidCharStrip  = "strip"
+)
+
+var (
+	invalidCharPolicy = invalidCharReject
+	// disallowedCategories are the Unicode categories screened out of prompts
+	// (PROMPT_DISALLOWED_CATEGORIES): control characters, format characters
+	// such as zero-width spaces and bidi overrides, and private-use code points.
+	disallowedCategories = []string{"Cc", "Cf", "Co"}
+)
+
+// parseCategories validates a comma-separated list of Unicode category names.
+func parseCategories(v string) ([]string, error) {
+	var cats []string
+	for _, c := range strings.Split(v, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if _, ok := unicode.Categories[c]; !ok {
+			return nil, fmt.Errorf("unknown Unicode category %q", c)
+		}
+		cats = append(cats, c)
+	}
+	return cats, nil
+}
+
+// disallowedRune reports whether r is screened out. Ordinary whitespace
+// (newline, tab, carriage return) is always allowed even though it is Cc.
+func disallowedRune(r rune) bool {
+	if r == '\n' || r == '\t' || r == '\r' {
+		return false
+	}
+	for _, c := range disallowedCategories {
+		if unicode.Is(unicode.Categories[c], r) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizePrompt applies invalidCharPolicy to prompt, returning either the
+// prompt with disallowed characters removed or an error naming the first one.
+func sanitizePrompt(prompt string) (string, error) {
+	if strings.IndexFunc(prompt, disallowedRune) < 0 {
+		return prompt, nil
+	}
+	if invalidCharPolicy == invalidCharStrip {
+		return strings.Map(func(r rune) rune {
+			if disallowedRune(r) {
+				return -1
+			}
+			return r
+		}, prompt), nil
+	}
+	i := strings.IndexFunc(prompt, disallowedRune)
+	return "", fmt.Errorf("prompt contains disallowed character %U at byte %d", []rune(prompt[i:])[0], i)
+}
+
+// loadPromptConfig reads how prompts are screened, validated and logged.
+func loadPromptConfig() {
+	var err error
+	// Keep PII out of prompt log lines
+	if v, ok := os.LookupEnv("REDACT_PATTERNS"); ok {
+		if redactPatterns, err = parseRedactPatterns(v); err != nil {
+			log.Fatalf("invalid REDACT_PATTERNS: %v", err)
+		}
+	}
+	promptLogChars = envInt("PROMPT_LOG_CHARS", promptLogChars)
+
+	// Prompt analytics records, in a bucket of their own
+	promptLogPrefix = normalizePrefix(os.Getenv("PROMPT_LOG_PREFIX"))
+	promptLogBucket = os.Getenv("PROMPT_LOG_BUCKET")
+	if promptLogPrefix != "" && promptLogBucket == "" {
+		log.Fatalf("PROMPT_LOG_PREFIX requires PROMPT_LOG_BUCKET, a private bucket for prompt logs")
+	}
+
+	// Screen prompts for control and invisible characters
+	switch v := os.Getenv("INVALID_CHAR_POLICY"); v {
+	case "", invalidCharReject:
+	case invalidCharStrip:
+		invalidCharPolicy = v
+	default:
+		log.Fatalf("INVALID_CHAR_POLICY must be %q or %q, got %q", invalidCharReject, invalidCharStrip, v)
+	}
+	if v, ok := os.LookupEnv("PROMPT_DISALLOWED_CATEGORIES"); ok {
+		if disallowedCategories, err = parseCategories(v); err != nil {
+			log.Fatalf("invalid PROMPT_DISALLOWED_CATEGORIES: %v", err)
+		}
+	}
+	promptTokenLimit = envInt("PROMPT_TOKEN_LIMIT", promptTokenLimit)
+	// Composition hints are screened like prompts, so they follow the policy
+	if v := os.Getenv("ASPECT_PROMPT_HINTS"); v != "" {
+		if aspectPromptHints, err = parseAspectPromptHints(v); err != nil {
+			log.Fatalf("invalid ASPECT_PROMPT_HINTS: %v", err)
+		}
+	}
+
+	// Deployment-specific request policy
+	if v := os.Getenv("VALIDATION_CONFIG"); v != "" {
+		if validation, err = parseValidationConfig(v); err != nil {
+			log.Fatalf("invalid VALIDATION_CONFIG: %v", err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizePrompt(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		prompt  string
+		want    string
+		wantErr string
+	}{
+		{"clean", invalidCharReject, "a cat\non a mat\t", "a cat\non a mat\t", ""},
+		{"zero-width rejected", invalidCharReject, "a\u200bcat", "", "U+200B at byte 1"},
+		{"control rejected", invalidCharReject, "cat\x00", "", "U+0000 at byte 3"},
+		{"bidi override stripped", invalidCharStrip, "a\u202ecat", "acat", ""},
+		{"private use stripped", invalidCharStrip, "cat\ue000", "cat", ""},
+		{"zero-width joiner stripped", invalidCharStrip, "cat\u200d", "cat", ""},
+	}
+	defer func(p string) { invalidCharPolicy = p }(invalidCharPolicy)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invalidCharPolicy = tt.policy
+			got, err := sanitizePrompt(tt.prompt)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("sanitizePrompt(%q) error = %v, want one containing %q", tt.prompt, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("sanitizePrompt(%q) = %q, %v, want %q", tt.prompt, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCategories(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"Cc, Cf", "Cc,Cf", false},
+		{"", "", false},
+		{"Cc,Xx", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseCategories(tt.in)
+		if (err != nil) != tt.wantErr || strings.Join(got, ",") != tt.want {
+			t.Errorf("parseCategories(%q) = %q, %v, want %q (error %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+var (
+	// promptLogPrefix is where prompt analytics records go
+	// (PROMPT_LOG_PREFIX), or "" to not write them.
+	promptLogPrefix string
+	// promptLogBucket is the private bucket prompt logs are written to
+	// (PROMPT_LOG_BUCKET), kept apart from the output bucket.
+	promptLogBucket string
+)
+
+// promptLogRecord is one line of the prompt log: what was asked for and how
+// it was generated.
+type promptLogRecord struct {
+	Timestamp     string           `json:"timestamp"`
+	RequestID     string           `json:"requestId,omitempty"`
+	Prompt        string           `json:"prompt"` // PII masked as for logs, but not shortened
+	Images        int              `json:"images"`
+	FilteredCount int              `json:"filteredCount"`
+	Partial       bool             `json:"partial,omitempty"`
+	ClientToken   string           `json:"clientToken,omitempty"`
+	CostCenter    string           `json:"costCenter,omitempty"`
+	Config        *effectiveConfig `json:"config"`
+}
+
+// promptLogKey names a record <prefix>/<YYYY-MM-DD>/<time>-<id>.jsonl. Each
+// request writes its own object, so concurrent containers never contend
+// for a shared daily file, and the date folders partition it for queries.
+func promptLogKey(t time.Time, id string) string {
+	t = t.UTC()
+	return path.Join(promptLogPrefix, t.Format("2006-01-02"), fmt.Sprintf("%s-%s.jsonl", t.Format("150405.000"), id))
+}
+
+// newPromptLogRecord is the prompt log record of a generation at now.
+func newPromptLogRecord(ctx context.Context, in requestPayload, out responsePayload, now time.Time) promptLogRecord {
+	rec := promptLogRecord{
+		Timestamp:     now.UTC().Format(time.RFC3339Nano),
+		Prompt:        maskPII(in.Prompt),
+		Images:        len(out.ImageURLs),
+		FilteredCount: out.FilteredCount,
+		Partial:       out.Partial,
+		ClientToken:   in.ClientToken,
+		CostCenter:    in.CostCenter,
+		Config:        out.Config,
+	}
+	// Record what the caller wrote; config.prompt has any translation
+	if in.originalPrompt != "" {
+		rec.Prompt = maskPII(in.originalPrompt)
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		rec.RequestID = lc.AwsRequestID
+	}
+	return rec
+}
+
+// logPrompt writes the prompt log record of a generation to promptLogBucket
+// in the background. Failures are logged and never affect the response.
+func logPrompt(ctx context.Context, in requestPayload, out responsePayload) {
+	if promptLogPrefix == "" {
+		return
+	}
+	now := time.Now()
+	rec := newPromptLogRecord(ctx, in, out, now)
+	id := newJobID()
+	runAsync("prompt log", func() {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			log.Printf("failed to encode prompt log record: %v", err)
+			return
+		}
+		if err := putInternalObject(ctx, s3Client, promptLogBucket, promptLogKey(now, id), append(line, '\n'), "application/x-ndjson"); err != nil {
+			log.Printf("failed to write prompt log record: %v", err)
+		}
+	})
+}
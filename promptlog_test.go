@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+func TestPromptLogKey(t *testing.T) {
+	defer func(p string) { promptLogPrefix = p }(promptLogPrefix)
+	promptLogPrefix = "prompt-logs"
+	now := time.Date(2026, 3, 4, 5, 6, 7, 890e6, time.FixedZone("CET", 3600))
+	if got, want := promptLogKey(now, "abc"), "prompt-logs/2026-03-04/040607.890-abc.jsonl"; got != want {
+		t.Errorf("promptLogKey() = %q, want %q", got, want)
+	}
+}
+
+func TestNewPromptLogRecord(t *testing.T) {
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "req-1"})
+	now := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		name       string
+		in         requestPayload
+		wantPrompt string
+	}{
+		{name: "prompt", in: requestPayload{Prompt: "a cat", ClientToken: "t", CostCenter: "cc"}, wantPrompt: "a cat"},
+		{name: "original prompt before translation", in: requestPayload{Prompt: "a cat", originalPrompt: "un chat", ClientToken: "t", CostCenter: "cc"}, wantPrompt: "un chat"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := responsePayload{ImageURLs: []string{"a", "b"}, FilteredCount: 1, Partial: true, Config: &effectiveConfig{Model: "m"}}
+			line, err := json.Marshal(newPromptLogRecord(ctx, tt.in, out, now))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]any
+			if err := json.Unmarshal(line, &got); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]any{
+				"timestamp":     "2026-03-04T05:06:07Z",
+				"requestId":     "req-1",
+				"prompt":        tt.wantPrompt,
+				"images":        2.0,
+				"filteredCount": 1.0,
+				"partial":       true,
+				"clientToken":   "t",
+				"costCenter":    "cc",
+			}
+			for k, v := range want {
+				if got[k] != v {
+					t.Errorf("%s = %v, want %v", k, got[k], v)
+				}
+			}
+			if cfg, _ := got["config"].(map[string]any); cfg["model"] != "m" {
+				t.Errorf("config = %v, want the effective config", got["config"])
+			}
+			if len(got) != len(want)+1 {
+				t.Errorf("record has fields %v, want only %d", got, len(want)+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// promptTokenLimit is the model's prompt length in tokens; Imagen silently
+	// drops anything past it (PROMPT_TOKEN_LIMIT).
+	promptTokenLimit = 480
+	// promptWarnPercent is how full the prompt may get, as a percentage of
+	// promptTokenLimit, before the response carries a warning.
+	promptWarnPercent = 90
+)
+
+// approxTokens estimates the token count of prompt. The GenAI image API
+// reports no usage, so this goes by the usual rules of thumb for English
+// (about four characters, or three quarters of a word, per token) and takes
+// the larger of the two so that short-word and long-word prompts both land
+// on the safe side.
+func approxTokens(prompt string) int {
+	byChars := (utf8.RuneCountInString(prompt) + 3) / 4
+	byWords := (len(strings.Fields(prompt))*4 + 2) / 3
+	return max(byChars, byWords)
+}
+
+// promptLengthWarning describes how close a prompt of tokens is to
+// promptTokenLimit, or is "" when it is comfortably short.
+func promptLengthWarning(tokens int) string {
+	switch {
+	case tokens > promptTokenLimit:
+		return fmt.Sprintf("prompt is about %d tokens, over the model limit of %d; the model will likely ignore the end of it", tokens, promptTokenLimit)
+	case tokens*100 >= promptTokenLimit*promptWarnPercent:
+		return fmt.Sprintf("prompt is about %d tokens, close to the model limit of %d", tokens, promptTokenLimit)
+	}
+	return ""
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"sort"
+
+	"google.golang.org/genai"
+)
+
+// sortByQuality returns images best first by qualityScore instead of in
+// generation order (SORT_BY_QUALITY). Imagen returns no aesthetic score of
+// its own, so the ranking is a local sharpness and contrast estimate.
+var sortByQuality bool
+
+// qualitySamples bounds the pixels read per side when scoring, so large
+// images cost no more than small ones.
+const qualitySamples = 256
+
+// rankedImage is a generated image with its qualityScore and position in
+// the GenAI response.
+type rankedImage struct {
+	image *genai.GeneratedImage
+	index int
+	score float64
+}
+
+// rankByQuality orders images by descending qualityScore, keeping
+// generation order between equal scores. Images that can't be decoded
+// score zero and sort last.
+func rankByQuality(images []*genai.GeneratedImage) []rankedImage {
+	ranked := make([]rankedImage, len(images))
+	for i, img := range images {
+		ranked[i] = rankedImage{image: img, index: i}
+		decoded, err := decodeImage(img.Image.ImageBytes)
+		if err != nil {
+			log.Printf("can't score image %d: %v", i, err)
+			continue
+		}
+		ranked[i].score = qualityScore(decoded)
+	}
+	sort.SliceStable(ranked, func(a, b int) bool { return ranked[a].score > ranked[b].score })
+	return ranked
+}
+
+// qualityScore is a cheap proxy for how good img looks: the mean absolute
+// Laplacian of its luminance (sharpness) plus its standard deviation
+// (contrast), both on a 0-255 scale. Blurry or washed-out images score low.
+// Scores only mean something relative to images of the same request.
+func qualityScore(img image.Image) float64 {
+	b := img.Bounds()
+	step := max(1, max(b.Dx(), b.Dy())/qualitySamples)
+	w, h := b.Dx()/step, b.Dy()/step
+	if w < 3 || h < 3 {
+		return 0
+	}
+	luma := make([]float64, w*h)
+	var sum float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := float64(color.GrayModel.Convert(img.At(b.Min.X+x*step, b.Min.Y+y*step)).(color.Gray).Y)
+			luma[y*w+x] = v
+			sum += v
+		}
+	}
+	mean := sum / float64(len(luma))
+	var variance float64
+	for _, v := range luma {
+		variance += (v - mean) * (v - mean)
+	}
+	contrast := math.Sqrt(variance / float64(len(luma)))
+
+	var edges float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			edges += math.Abs(4*luma[i] - luma[i-1] - luma[i+1] - luma[i-w] - luma[i+w])
+		}
+	}
+	sharpness := edges / float64((w-2)*(h-2)) / 4
+	return math.Round((sharpness+contrast)*100) / 100
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// quota is the per-model daily quota tracker, or nil when QUOTA_TABLE is unset.
+var quota *quotaTracker
+
+var errQuotaExhausted = errors.New("daily quota exhausted")
+
+// quotaAPI is the part of the DynamoDB API the quota tracker uses.
+type quotaAPI interface {
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+// quotaTracker counts generated images per model per UTC day. Each day has
+// its own item (pk "<model>#<YYYY-MM-DD>"), so counters reset by key rather
+// than by a cleanup job; expiresAt lets a DynamoDB TTL drop old days.
+type quotaTracker struct {
+	client quotaAPI
+	table  string
+	limits map[string]int // model → images per day; models not listed are unlimited
+	now    func() time.Time
+}
+
+func (q *quotaTracker) key(model string) map[string]types.AttributeValue {
+	day := q.now().UTC().Format("2006-01-02")
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: model + "#" + day},
+	}
+}
+
+// reserve atomically claims n images of today's quota for model. It returns
+// errQuotaExhausted if that would take the counter past the limit.
+func (q *quotaTracker) reserve(ctx context.Context, model string, n int) error {
+	limit, ok := q.limits[model]
+	if !ok {
+		return nil
+	}
+	if n > limit {
+		return errQuotaExhausted
+	}
+	expires := q.now().UTC().Add(48 * time.Hour).Unix()
+	_, err := q.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(q.table),
+		Key:                      q.key(model),
+		UpdateExpression:         aws.String("ADD #used :n SET expiresAt = :exp"),
+		ConditionExpression:      aws.String("attribute_not_exists(#used) OR #used <= :max"),
+		ExpressionAttributeNames: map[string]string{"#used": "used"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":n":   &types.AttributeValueMemberN{Value: strconv.Itoa(n)},
+			":max": &types.AttributeValueMemberN{Value: strconv.Itoa(limit - n)},
+			":exp": &types.AttributeValueMemberN{Value: strconv.FormatInt(expires, 10)},
+		},
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return errQuotaExhausted
+	}
+	return err
+}
+
+// release gives back n reserved images that were never generated.
+func (q *quotaTracker) release(ctx context.Context, model string, n int) error {
+	if _, ok := q.limits[model]; !ok || n <= 0 {
+		return nil
+	}
+	_, err := q.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(q.table),
+		Key:                      q.key(model),
+		UpdateExpression:         aws.String("ADD #used :n"),
+		ExpressionAttributeNames: map[string]string{"#used": "used"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":n": &types.AttributeValueMemberN{Value: strconv.Itoa(-n)},
+		},
+	})
+	return err
+}
+
+// loadQuota sets up the optional per-model daily quotas.
+func loadQuota(awsCfg aws.Config) {
+	// Optional per-model daily quotas, e.g. {"imagen-4.0-generate-preview-06-06": 500}
+	if table := os.Getenv("QUOTA_TABLE"); table != "" {
+		limits := map[string]int{}
+		if err := json.Unmarshal([]byte(os.Getenv("MODEL_DAILY_QUOTAS")), &limits); err != nil {
+			log.Fatalf("MODEL_DAILY_QUOTAS must be a JSON object of model to daily image limit: %v", err)
+		}
+		quota = &quotaTracker{
+			client: dynamodb.NewFromConfig(awsCfg),
+			table:  table,
+			limits: limits,
+			now:    time.Now,
+		}
+	}
+}
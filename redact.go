@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// piiPatterns are the maskable kinds of personal data, by name.
+var piiPatterns = map[string]*regexp.Regexp{
+	"email": regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	"phone": regexp.MustCompile(`\+?\(?\d{1,4}\)?[\s.-]?\d{2,4}[\s.-]?\d{3,4}[\s.-]?\d{3,4}`),
+	"card":  regexp.MustCompile(`\b(?:\d[ -]?){13,19}\b`),
+}
+
+var (
+	// redactPatterns are the piiPatterns applied by redactPrompt (REDACT_PATTERNS).
+	redactPatterns = []string{"email", "phone"}
+	// promptLogChars caps how much of a prompt reaches the logs (PROMPT_LOG_CHARS).
+	promptLogChars = 80
+)
+
+// maskPII replaces PII matching redactPatterns with "[name]".
+func maskPII(prompt string) string {
+	for _, name := range redactPatterns {
+		prompt = piiPatterns[name].ReplaceAllString(prompt, "["+name+"]")
+	}
+	return prompt
+}
+
+// parseRedactPatterns validates a comma-separated list of piiPatterns names.
+func parseRedactPatterns(v string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := piiPatterns[name]; !ok {
+			return nil, fmt.Errorf("unknown pattern %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// redactPrompt makes a prompt safe to log: PII matching redactPatterns is
+// replaced with "[name]" and the result is cut to promptLogChars characters.
+// Only logs see the redacted form; Imagen always gets the full prompt.
+func redactPrompt(prompt string) string {
+	prompt = maskPII(prompt)
+	if r := []rune(prompt); len(r) > promptLogChars {
+		prompt = string(r[:promptLogChars]) + "…"
+	}
+	return prompt
+}
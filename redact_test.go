@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactPrompt(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		chars    int
+		prompt   string
+		want     string
+	}{
+		{"plain", []string{"email", "phone"}, 80, "a red fox in the snow", "a red fox in the snow"},
+		{"email", []string{"email", "phone"}, 80, "portrait for jane.doe@example.com", "portrait for [email]"},
+		{"phone", []string{"email", "phone"}, 80, "call +1 555 123 4567 today", "call [phone] today"},
+		{"card", []string{"card"}, 80, "card 4111111111111111.", "card [card]."},
+		{"pattern off", []string{"phone"}, 80, "mail jane@example.com", "mail jane@example.com"},
+		{"truncated", nil, 5, "abcdefgh", "abcde…"},
+		{"truncated by rune", nil, 3, "日本語のテキスト", "日本語…"},
+		{"exact length", nil, 4, "abcd", "abcd"},
+	}
+	defer func(p []string, n int) { redactPatterns, promptLogChars = p, n }(redactPatterns, promptLogChars)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redactPatterns, promptLogChars = tt.patterns, tt.chars
+			if got := redactPrompt(tt.prompt); got != tt.want {
+				t.Errorf("redactPrompt(%q) = %q, want %q", tt.prompt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRedactPatterns(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"email", []string{"email"}, false},
+		{" email , card ,", []string{"email", "card"}, false},
+		{"email,ssn", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRedactPatterns(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRedactPatterns(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("parseRedactPatterns(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestResolveReferenceImage(t *testing.T) {
+	defer func(b string) { bucketName = b }(bucketName)
+	bucketName = "out"
+	png, err := encodePNG(image.NewRGBA(image.Rect(0, 0, 2, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		ref     string
+		prefix  string
+		wantErr string
+	}{
+		{name: "base64 png", ref: base64.StdEncoding.EncodeToString(png)},
+		{name: "not base64", ref: "not an image!", wantErr: "referenceImage is neither an s3:// URI nor valid base64"},
+		{name: "not an image", ref: base64.StdEncoding.EncodeToString([]byte("hello")), wantErr: "referenceImage is not a PNG or JPEG image"},
+		{name: "too large", ref: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0}, maxReferenceBytes+1)), wantErr: "referenceImage exceeds"},
+		{name: "other bucket", ref: "s3://elsewhere/k.png", wantErr: "referenceImage must be in s3://out/"},
+		{name: "other tenant", ref: "s3://out/images/globex/k.png", prefix: "images/acme", wantErr: "referenceImage must be in s3://out/images/acme/"},
+		{name: "escapes prefix", ref: "s3://out/images/acme/../globex/k.png", prefix: "images/acme", wantErr: "referenceImage must be in s3://out/images/acme/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := resolveReferenceImage(context.Background(), tt.ref, tt.prefix)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveReferenceImage() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(data, png) {
+				t.Fatalf("resolveReferenceImage() = %d bytes, %v; want the PNG", len(data), err)
+			}
+		})
+	}
+}
+
+func TestParseRequestReferenceImage(t *testing.T) {
+	defer func(v bool) { vertexBackend = v }(vertexBackend)
+	tests := []struct {
+		name     string
+		body     string
+		vertex   bool
+		wantErr  string
+		strength float64
+	}{
+		{name: "default strength", body: `{"prompt": "a cat", "aspectRatio": "1:1", "referenceImage": "abc"}`, vertex: true, strength: defaultReferenceStrength},
+		{name: "strength", body: `{"prompt": "a cat", "aspectRatio": "1:1", "referenceImage": "abc", "referenceStrength": 0.9}`, vertex: true, strength: 0.9},
+		{name: "gemini backend", body: `{"prompt": "a cat", "aspectRatio": "1:1", "referenceImage": "abc"}`, wantErr: "referenceImage requires GENAI_BACKEND=vertex"},
+		{name: "strength out of range", body: `{"prompt": "a cat", "aspectRatio": "1:1", "referenceImage": "abc", "referenceStrength": 1.5}`, vertex: true, wantErr: "referenceStrength must be between 0 and 1"},
+		{name: "strength without image", body: `{"prompt": "a cat", "aspectRatio": "1:1", "referenceStrength": 0.5}`, vertex: true, wantErr: "referenceStrength requires referenceImage"},
+		{name: "image size", body: `{"prompt": "a cat", "aspectRatio": "1:1", "referenceImage": "abc", "imageSize": "2K"}`, vertex: true, wantErr: "imageSize can't be combined with referenceImage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vertexBackend = tt.vertex
+			in, reqErr := parseRequest(context.Background(), tt.body, nil, "")
+			if tt.wantErr != "" {
+				if reqErr == nil || reqErr.status != http.StatusBadRequest || reqErr.msg != tt.wantErr {
+					t.Fatalf("parseRequest() error = %+v, want 400 %q", reqErr, tt.wantErr)
+				}
+				return
+			}
+			if reqErr != nil {
+				t.Fatalf("parseRequest() error = %+v", reqErr)
+			}
+			if in.ReferenceStrength == nil || *in.ReferenceStrength != tt.strength {
+				t.Errorf("referenceStrength = %v, want %v", in.ReferenceStrength, tt.strength)
+			}
+		})
+	}
+}
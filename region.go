@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// bucketLocator is the part of the S3 API used to look up a bucket's region.
+type bucketLocator interface {
+	GetBucketLocation(ctx context.Context, params *s3.GetBucketLocationInput, optFns ...func(*s3.Options)) (*s3.GetBucketLocationOutput, error)
+}
+
+// detectBucketRegion returns the region bucket lives in.
+func detectBucketRegion(ctx context.Context, client bucketLocator, bucket string) (string, error) {
+	out, err := client.GetBucketLocation(ctx, &s3.GetBucketLocationInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		return "", err
+	}
+	// GetBucketLocation reports us-east-1 as an empty constraint and
+	// eu-west-1 by its legacy "EU" name.
+	switch loc := string(out.LocationConstraint); loc {
+	case "":
+		return "us-east-1", nil
+	case "EU":
+		return "eu-west-1", nil
+	default:
+		return loc, nil
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeLocator answers GetBucketLocation with a fixed constraint.
+type fakeLocator struct {
+	constraint types.BucketLocationConstraint
+	err        error
+	bucket     string // set by the call
+}
+
+func (f *fakeLocator) GetBucketLocation(_ context.Context, in *s3.GetBucketLocationInput, _ ...func(*s3.Options)) (*s3.GetBucketLocationOutput, error) {
+	f.bucket = aws.ToString(in.Bucket)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &s3.GetBucketLocationOutput{LocationConstraint: f.constraint}, nil
+}
+
+func TestDetectBucketRegion(t *testing.T) {
+	tests := []struct {
+		name       string
+		constraint types.BucketLocationConstraint
+		err        error
+		want       string
+	}{
+		{name: "us-east-1 is empty", want: "us-east-1"},
+		{name: "legacy EU", constraint: "EU", want: "eu-west-1"},
+		{name: "named region", constraint: types.BucketLocationConstraintApSoutheast2, want: "ap-southeast-2"},
+		{name: "error", err: errors.New("access denied")},
+	}
+	for _, tt := range tests {
+		loc := &fakeLocator{constraint: tt.constraint, err: tt.err}
+		got, err := detectBucketRegion(context.Background(), loc, "images")
+		if (err != nil) != (tt.err != nil) || got != tt.want {
+			t.Errorf("%s: detectBucketRegion() = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+		if loc.bucket != "images" {
+			t.Errorf("%s: looked up bucket %q, want images", tt.name, loc.bucket)
+		}
+	}
+}
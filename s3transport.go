@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+// s3Transport tunes the S3 client's connection pool for high fan-out
+// uploads. Zero fields keep the SDK defaults.
+var s3Transport s3TransportSettings
+
+type s3TransportSettings struct {
+	maxConnsPerHost     int           // S3_MAX_CONNS_PER_HOST
+	maxIdleConnsPerHost int           // S3_MAX_IDLE_CONNS_PER_HOST
+	idleConnTimeout     time.Duration // S3_IDLE_CONN_TIMEOUT_SECONDS
+	connectTimeout      time.Duration // S3_CONNECT_TIMEOUT_MS
+	responseTimeout     time.Duration // S3_RESPONSE_TIMEOUT_MS, until response headers arrive
+}
+
+// httpClient returns the SDK's HTTP client with t applied, or nil when t
+// changes nothing.
+func (t s3TransportSettings) httpClient() *awshttp.BuildableClient {
+	if t == (s3TransportSettings{}) {
+		return nil
+	}
+	return awshttp.NewBuildableClient().
+		WithTransportOptions(t.applyTransport).
+		WithDialerOptions(func(d *net.Dialer) {
+			if t.connectTimeout > 0 {
+				d.Timeout = t.connectTimeout
+			}
+		})
+}
+
+func (t s3TransportSettings) applyTransport(tr *http.Transport) {
+	if t.maxConnsPerHost > 0 {
+		tr.MaxConnsPerHost = t.maxConnsPerHost
+	}
+	if t.maxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = t.maxIdleConnsPerHost
+		// MaxIdleConns caps idle connections across all hosts, so it must
+		// not be the tighter limit
+		tr.MaxIdleConns = max(tr.MaxIdleConns, t.maxIdleConnsPerHost)
+	}
+	if t.idleConnTimeout > 0 {
+		tr.IdleConnTimeout = t.idleConnTimeout
+	}
+	if t.responseTimeout > 0 {
+		tr.ResponseHeaderTimeout = t.responseTimeout
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+// safetyRating is one safety category score of an image.
+type safetyRating struct {
+	Category    string  `json:"category"`    // e.g. "violence", lower-cased
+	Probability float32 `json:"probability"` // 0–1
+}
+
+// safetyRatings normalizes the safety attributes Imagen returns for an
+// image into a list, or nil when there are none.
+func safetyRatings(attrs *genai.SafetyAttributes) []safetyRating {
+	if attrs == nil {
+		return nil
+	}
+	var ratings []safetyRating
+	for i, c := range attrs.Categories {
+		if i >= len(attrs.Scores) {
+			break
+		}
+		ratings = append(ratings, safetyRating{Category: strings.ToLower(strings.TrimSpace(c)), Probability: attrs.Scores[i]})
+	}
+	return ratings
+}
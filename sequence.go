@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// sequence hands out image numbers for SEQUENTIAL_NAMING, or is nil when it
+// is disabled. Numbers are monotonic and gap-free: a request holds a lease
+// on its prefix's counter while it uploads, and only the numbers of images
+// it uploaded are committed. A failed request takes back what it wrote and
+// gives its numbers back for the next request.
+var sequence *sequenceCounter
+
+// sequenceMaxAttempts bounds retries of a throttled counter update. Waits
+// for another request's lease are bounded by the context instead.
+const sequenceMaxAttempts = 5
+
+// sequenceLeaseTTL is how long a lease lasts when the context has no
+// deadline, the longest a Lambda invocation can run. A lease left behind by
+// a crashed invocation expires after it.
+const sequenceLeaseTTL = 15 * time.Minute
+
+// counterAPI is the part of the DynamoDB API the sequence counter uses.
+type counterAPI interface {
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+// sequenceCounter keeps one counter item per output prefix (pk "/<prefix>")
+// holding the last number committed, and the lease of the request
+// numbering images under it, if any.
+type sequenceCounter struct {
+	client counterAPI
+	table  string
+	store  objectDeleter // takes back the uploads of failed requests
+}
+
+func (c *sequenceCounter) key(prefix string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"pk": &types.AttributeValueMemberS{Value: "/" + prefix}}
+}
+
+// acquire takes the lease on prefix's counter for holder and returns the
+// first number holder may use. The lease is a conditional update, so only
+// one request numbers images under a prefix at a time; the others wait for
+// it to commit or for its lease to expire, until ctx ends.
+func (c *sequenceCounter) acquire(ctx context.Context, prefix, holder string) (int, error) {
+	until := time.Now().Add(sequenceLeaseTTL)
+	if deadline, ok := ctx.Deadline(); ok {
+		until = deadline.Add(time.Minute)
+	}
+	backoff := s3RetryBase
+	for attempt := 1; ; attempt++ {
+		out, err := c.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                aws.String(c.table),
+			Key:                      c.key(prefix),
+			UpdateExpression:         aws.String("SET #lease = :holder, #until = :until"),
+			ConditionExpression:      aws.String("attribute_not_exists(#lease) OR #until < :now"),
+			ExpressionAttributeNames: map[string]string{"#lease": "lease", "#until": "leaseUntil"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":holder": &types.AttributeValueMemberS{Value: holder},
+				":until":  &types.AttributeValueMemberN{Value: strconv.FormatInt(until.Unix(), 10)},
+				":now":    &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+			},
+			ReturnValues: types.ReturnValueAllNew,
+		})
+		if err == nil {
+			last := 0
+			if v, ok := out.Attributes["last"].(*types.AttributeValueMemberN); ok {
+				if last, err = strconv.Atoi(v.Value); err != nil {
+					return 0, fmt.Errorf("bad counter value %q: %w", v.Value, err)
+				}
+			}
+			return last + 1, nil
+		}
+		leased := isLeaseHeld(err)
+		if !leased && (attempt >= sequenceMaxAttempts || !isCounterContention(err)) {
+			return 0, err
+		}
+		wait := time.Duration(rand.Int63n(int64(backoff))) + time.Millisecond
+		log.Printf("sequence counter for %q busy (attempt %d); retrying in %v", prefix, attempt, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return 0, fmt.Errorf("waiting for the sequence counter lease: %w", ctx.Err())
+		}
+		backoff = min(backoff*2, time.Second)
+	}
+}
+
+// commit adds the used numbers to prefix's counter and releases holder's
+// lease. It fails when the lease expired and was taken over, as the numbers
+// may then have been handed out again.
+func (c *sequenceCounter) commit(ctx context.Context, prefix, holder string, used int) error {
+	// Release even when ctx is what failed the request
+	ctx = context.WithoutCancel(ctx)
+	_, err := c.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(c.table),
+		Key:                      c.key(prefix),
+		UpdateExpression:         aws.String("ADD #last :used REMOVE #lease, #until"),
+		ConditionExpression:      aws.String("#lease = :holder"),
+		ExpressionAttributeNames: map[string]string{"#last": "last", "#lease": "lease", "#until": "leaseUntil"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":used":   &types.AttributeValueMemberN{Value: strconv.Itoa(used)},
+			":holder": &types.AttributeValueMemberS{Value: holder},
+		},
+	})
+	if isLeaseHeld(err) {
+		return errors.New("sequence counter lease expired before the numbers were committed")
+	}
+	return err
+}
+
+// number runs upload under the lease on prefix's counter, passing it the
+// first number to use and a log of the objects it writes. The numbers of the
+// uploaded images are committed. When upload fails, the objects it wrote are
+// deleted and all numbers given back; if that cleanup fails, the n numbers
+// stay used instead, so no later request collides with what is left.
+func (c *sequenceCounter) number(ctx context.Context, prefix string, n int, upload func(first int, written *writtenObjects) ([]uploadedImage, *requestError)) ([]uploadedImage, *requestError) {
+	holder := newJobID()
+	first, err := c.acquire(ctx, prefix, holder)
+	if err != nil {
+		log.Printf("failed to reserve image numbers: %v", err)
+		return nil, &requestError{status: http.StatusInternalServerError, msg: "failed to reserve image numbers"}
+	}
+	written := &writtenObjects{}
+	uploads, reqErr := upload(first, written)
+	used := len(uploads)
+	if reqErr != nil {
+		used = 0
+		if err := written.delete(context.WithoutCancel(ctx), c.store); err != nil {
+			log.Printf("failed to delete the uploads of a failed request, keeping numbers %d-%d: %v", first, first+n-1, err)
+			used = n
+		}
+	}
+	if err := c.commit(ctx, prefix, holder, used); err != nil {
+		log.Printf("failed to commit image numbers: %v", err)
+		if reqErr == nil {
+			reqErr = &requestError{status: http.StatusInternalServerError, msg: "failed to commit image numbers"}
+		}
+	}
+	return uploads, reqErr
+}
+
+// isLeaseHeld reports whether a counter update was refused because another
+// request holds the lease (or, on commit, took it over).
+func isLeaseHeld(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "ConditionalCheckFailedException"
+}
+
+// isCounterContention reports whether a counter update lost a race with a
+// transaction or was throttled, and is worth retrying.
+func isCounterContention(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "TransactionConflictException", "ProvisionedThroughputExceededException", "ThrottlingException":
+		return true
+	}
+	return false
+}
+
+// sequentialKey names image number seq under prefix, e.g. image_0001.png.
+func sequentialKey(prefix string, seq int, ext string) string {
+	return path.Join(prefix, fmt.Sprintf("image_%04d.%s", seq, ext))
+}
+
+// loadSequence sets up the counter behind SEQUENTIAL_NAMING.
+func loadSequence(awsCfg aws.Config) {
+	if os.Getenv("SEQUENTIAL_NAMING") == "true" {
+		table := os.Getenv("SEQUENCE_TABLE")
+		if table == "" {
+			log.Fatalf("SEQUENTIAL_NAMING requires SEQUENCE_TABLE")
+		}
+		sequence = &sequenceCounter{client: dynamodb.NewFromConfig(awsCfg), table: table, store: s3Client}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// counterItem is one counter as fakeCounter stores it.
+type counterItem struct {
+	last  int
+	lease string
+	until int64
+}
+
+// fakeCounter applies the counter's lease and commit updates per prefix,
+// failing the first fail calls with code.
+type fakeCounter struct {
+	mu    sync.Mutex
+	items map[string]*counterItem
+	fail  int
+	code  string
+	calls int
+}
+
+func (f *fakeCounter) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.fail {
+		return nil, &smithy.GenericAPIError{Code: f.code}
+	}
+	pk := params.Key["pk"].(*types.AttributeValueMemberS).Value
+	item := f.items[pk]
+	if item == nil {
+		item = &counterItem{}
+		f.items[pk] = item
+	}
+	values := params.ExpressionAttributeValues
+	num := func(name string) int64 {
+		n, _ := strconv.ParseInt(values[name].(*types.AttributeValueMemberN).Value, 10, 64)
+		return n
+	}
+	holder := values[":holder"].(*types.AttributeValueMemberS).Value
+	conflict := &smithy.GenericAPIError{Code: "ConditionalCheckFailedException"}
+	if _, ok := values[":used"]; ok {
+		if item.lease != holder {
+			return nil, conflict
+		}
+		item.last += int(num(":used"))
+		item.lease, item.until = "", 0
+		return &dynamodb.UpdateItemOutput{}, nil
+	}
+	if item.lease != "" && item.until >= num(":now") {
+		return nil, conflict
+	}
+	item.lease, item.until = holder, num(":until")
+	attrs := map[string]types.AttributeValue{}
+	if item.last > 0 {
+		attrs["last"] = &types.AttributeValueMemberN{Value: strconv.Itoa(item.last)}
+	}
+	return &dynamodb.UpdateItemOutput{Attributes: attrs}, nil
+}
+
+// fakeDeleter records deleted keys, failing every delete with err.
+type fakeDeleter struct {
+	err     error
+	deleted []string
+}
+
+func (f *fakeDeleter) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.deleted = append(f.deleted, aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestSequenceAcquire(t *testing.T) {
+	defer func(d time.Duration) { s3RetryBase = d }(s3RetryBase)
+	s3RetryBase = time.Millisecond
+	tests := []struct {
+		name      string
+		item      counterItem
+		fail      int
+		code      string
+		wantFirst int
+		wantErr   bool
+	}{
+		{name: "first number", wantFirst: 1},
+		{name: "after committed numbers", item: counterItem{last: 7}, wantFirst: 8},
+		{name: "expired lease taken over", item: counterItem{last: 3, lease: "crashed", until: time.Now().Add(-time.Minute).Unix()}, wantFirst: 4},
+		{name: "held lease waited for", item: counterItem{last: 3, lease: "other", until: time.Now().Add(time.Hour).Unix()}, wantErr: true},
+		{name: "throttling retried", fail: 2, code: "ThrottlingException", wantFirst: 1},
+		{name: "throttling gives up", fail: sequenceMaxAttempts, code: "ThrottlingException", wantErr: true},
+		{name: "other errors not retried", fail: 1, code: "AccessDeniedException", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := tt.item
+			f := &fakeCounter{items: map[string]*counterItem{"/images": &item}, fail: tt.fail, code: tt.code}
+			c := &sequenceCounter{client: f, table: "seq"}
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			first, err := c.acquire(ctx, "images", "me")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("acquire() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (first != tt.wantFirst || item.lease != "me") {
+				t.Errorf("acquire() = %d with lease %q, want %d with lease me", first, item.lease, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestSequenceNumber(t *testing.T) {
+	failed := &requestError{status: http.StatusInternalServerError, msg: "upload failed"}
+	tests := []struct {
+		name        string
+		uploaded    int // images returned by the upload
+		err         *requestError
+		deleteErr   error
+		wantErr     bool
+		wantLast    int
+		wantDeleted int
+	}{
+		{name: "all uploaded", uploaded: 3, wantLast: 5},
+		{name: "partial upload commits only its numbers", uploaded: 2, wantLast: 4},
+		{name: "failure gives numbers back", err: failed, wantErr: true, wantLast: 2, wantDeleted: 2},
+		{name: "failed cleanup keeps numbers", err: failed, deleteErr: errors.New("denied"), wantErr: true, wantLast: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeCounter{items: map[string]*counterItem{"/images": {last: 2}}}
+			store := &fakeDeleter{err: tt.deleteErr}
+			c := &sequenceCounter{client: f, table: "seq", store: store}
+			uploads, reqErr := c.number(context.Background(), "images", 3, func(first int, written *writtenObjects) ([]uploadedImage, *requestError) {
+				if first != 3 {
+					t.Errorf("first = %d, want 3", first)
+				}
+				written.add("b", sequentialKey("images", first, "png"))
+				written.add("b", sequentialKey("images", first+1, "png"))
+				return make([]uploadedImage, tt.uploaded), tt.err
+			})
+			if (reqErr != nil) != tt.wantErr || (!tt.wantErr && len(uploads) != tt.uploaded) {
+				t.Fatalf("number() = %d upload(s), %+v", len(uploads), reqErr)
+			}
+			item := f.items["/images"]
+			if item.last != tt.wantLast || item.lease != "" {
+				t.Errorf("counter = %d with lease %q, want %d and no lease", item.last, item.lease, tt.wantLast)
+			}
+			if len(store.deleted) != tt.wantDeleted {
+				t.Errorf("deleted %v, want %d object(s)", store.deleted, tt.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestSequenceNumberConcurrent(t *testing.T) {
+	defer func(d time.Duration) { s3RetryBase = d }(s3RetryBase)
+	s3RetryBase = time.Millisecond
+	f := &fakeCounter{items: map[string]*counterItem{}}
+	c := &sequenceCounter{client: f, table: "seq", store: &fakeDeleter{}}
+	var mu sync.Mutex
+	var got []int
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, reqErr := c.number(context.Background(), "images", 2, func(first int, _ *writtenObjects) ([]uploadedImage, *requestError) {
+				mu.Lock()
+				got = append(got, first, first+1)
+				mu.Unlock()
+				return make([]uploadedImage, 2), nil
+			})
+			if reqErr != nil {
+				t.Errorf("number() error = %+v", reqErr)
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Ints(got)
+	for i, n := range got {
+		if n != i+1 {
+			t.Fatalf("numbers handed out = %v, want 1-20 with no gaps or repeats", got)
+		}
+	}
+}
+
+func TestSequentialKey(t *testing.T) {
+	tests := []struct {
+		prefix string
+		seq    int
+		want   string
+	}{
+		{"images", 1, "images/image_0001.png"},
+		{"", 12345, "image_12345.png"},
+	}
+	for _, tt := range tests {
+		if got := sequentialKey(tt.prefix, tt.seq, "png"); got != tt.want {
+			t.Errorf("sequentialKey(%q, %d) = %q, want %q", tt.prefix, tt.seq, got, tt.want)
+		}
+	}
+}
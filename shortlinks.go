@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// links maps short link slugs to object keys, or is nil when
+// SHORTLINK_TABLE is unset.
+var links *linkStore
+
+var (
+	errLinkNotFound  = errors.New("short link not found")
+	errSlugCollision = errors.New("slug already points at another key")
+)
+
+// linkAPI is the part of the DynamoDB API the link store uses.
+type linkAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+}
+
+// linkStore keeps slug → key items, keyed by slug. Links are served by
+// GET /s/{slug} under base (SHORTLINK_BASE).
+type linkStore struct {
+	client linkAPI
+	table  string
+	base   string
+}
+
+// slugFor derives the slug of key: 8 URL-safe characters of its SHA-256, so
+// the same key always gets the same link.
+func slugFor(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return base64.RawURLEncoding.EncodeToString(sum[:6])
+}
+
+// create stores the link for key and returns its short URL. Storing an
+// existing link again is fine; a slug taken by a different key is not.
+func (l *linkStore) create(ctx context.Context, key string) (string, error) {
+	slug := slugFor(key)
+	_, err := l.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(l.table),
+		Item: map[string]types.AttributeValue{
+			"slug": &types.AttributeValueMemberS{Value: slug},
+			"key":  &types.AttributeValueMemberS{Value: key},
+		},
+		ConditionExpression:      aws.String("attribute_not_exists(slug) OR #key = :key"),
+		ExpressionAttributeNames: map[string]string{"#key": "key"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":key": &types.AttributeValueMemberS{Value: key},
+		},
+	})
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return "", fmt.Errorf("%s: %w", slug, errSlugCollision)
+	}
+	if err != nil {
+		return "", err
+	}
+	return l.base + "/s/" + slug, nil
+}
+
+// resolve returns the object key a slug points at.
+func (l *linkStore) resolve(ctx context.Context, slug string) (string, error) {
+	out, err := l.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(l.table),
+		Key:       map[string]types.AttributeValue{"slug": &types.AttributeValueMemberS{Value: slug}},
+	})
+	if err != nil {
+		return "", err
+	}
+	v, ok := out.Item["key"].(*types.AttributeValueMemberS)
+	if !ok {
+		return "", errLinkNotFound
+	}
+	return v.Value, nil
+}
+
+// linkTarget returns where a short link for key redirects: a fresh
+// presigned URL or the public (possibly signed CDN) URL. sourceIP is the
+// address of whoever follows the link, used when PRESIGN_IP_LOCK is set.
+func linkTarget(ctx context.Context, key, sourceIP string) (string, error) {
+	if presignGetURLs {
+		return presignGet(ctx, bucketFor(key), key, "")
+	}
+	if !presignIPLock {
+		sourceIP = ""
+	}
+	return signCDNURL(objectURL(key), sourceIP)
+}
+
+// shortLinkLocation resolves GET /s/{slug}, requested from sourceIP, to the
+// URL to redirect to.
+func shortLinkLocation(ctx context.Context, slug, sourceIP string) (string, *requestError) {
+	if links == nil {
+		return "", &requestError{status: http.StatusNotFound, msg: "short links are not enabled"}
+	}
+	key, err := links.resolve(ctx, slug)
+	if errors.Is(err, errLinkNotFound) {
+		return "", &requestError{status: http.StatusNotFound, msg: "short link not found"}
+	}
+	if err != nil {
+		log.Printf("failed to resolve short link %s: %v", slug, err)
+		return "", &requestError{status: http.StatusInternalServerError, msg: "failed to resolve short link"}
+	}
+	target, err := linkTarget(ctx, key, sourceIP)
+	if err != nil {
+		log.Printf("failed to build URL for %s: %v", key, err)
+		return "", &requestError{status: http.StatusInternalServerError, msg: "failed to build link target"}
+	}
+	return target, nil
+}
+
+// loadLinks sets up the short link store.
+func loadLinks(awsCfg aws.Config) {
+	if table := os.Getenv("SHORTLINK_TABLE"); table != "" {
+		base := strings.TrimSuffix(os.Getenv("SHORTLINK_BASE"), "/")
+		if base == "" {
+			log.Fatalf("SHORTLINK_TABLE requires SHORTLINK_BASE")
+		}
+		links = &linkStore{client: dynamodb.NewFromConfig(awsCfg), table: table, base: base}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeLinks is an in-memory slug table honouring create's condition.
+type fakeLinks map[string]string
+
+func (f fakeLinks) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	slug := params.Item["slug"].(*types.AttributeValueMemberS).Value
+	key := params.Item["key"].(*types.AttributeValueMemberS).Value
+	if existing, ok := f[slug]; ok && existing != key {
+		return nil, &types.ConditionalCheckFailedException{Message: aws.String("taken")}
+	}
+	f[slug] = key
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f fakeLinks) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	slug := params.Key["slug"].(*types.AttributeValueMemberS).Value
+	key, ok := f[slug]
+	if !ok {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	return &dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"slug": &types.AttributeValueMemberS{Value: slug},
+		"key":  &types.AttributeValueMemberS{Value: key},
+	}}, nil
+}
+
+func TestSlugFor(t *testing.T) {
+	a, b := slugFor("generated/a.png"), slugFor("generated/b.png")
+	if len(a) != 8 || a != slugFor("generated/a.png") || a == b {
+		t.Errorf("slugFor() = %q, %q; want stable, distinct 8-character slugs", a, b)
+	}
+}
+
+func TestLinkStore(t *testing.T) {
+	table := fakeLinks{slugFor("taken.png"): "someone-else.png"}
+	l := &linkStore{client: table, table: "links", base: "https://img.example.com"}
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		key     string
+		wantErr error
+	}{
+		{name: "new link", key: "generated/a.png"},
+		{name: "same link again", key: "generated/a.png"},
+		{name: "slug collision", key: "taken.png", wantErr: errSlugCollision},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, err := l.create(ctx, tt.key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("create(%q) error = %v, want %v", tt.key, err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if want := "https://img.example.com/s/" + slugFor(tt.key); url != want {
+				t.Errorf("create(%q) = %q, want %q", tt.key, url, want)
+			}
+			got, err := l.resolve(ctx, slugFor(tt.key))
+			if err != nil || got != tt.key {
+				t.Errorf("resolve() = %q, %v; want %q", got, err, tt.key)
+			}
+		})
+	}
+	if _, err := l.resolve(ctx, "missing0"); !errors.Is(err, errLinkNotFound) {
+		t.Errorf("resolve(missing) error = %v, want errLinkNotFound", err)
+	}
+}
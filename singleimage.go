@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"google.golang.org/genai"
+)
+
+// singleImageModels lists models that generate one image per call, so
+// larger requests are split into that many concurrent calls
+// (SINGLE_IMAGE_MODELS replaces the list).
+var singleImageModels = map[string]bool{
+	"imagen-4.0-ultra-generate-preview-06-06": true,
+	"imagen-4.0-ultra-generate-001":           true,
+}
+
+// imageCall makes one GenerateImages (or EditImage) call with cfg.
+type imageCall func(ctx context.Context, cfg *genai.GenerateImagesConfig) (*genai.GenerateImagesResponse, error)
+
+// generateEach fulfils cfg.NumberOfImages with one single-image call per
+// image, run concurrently, and merges the results in call order. A fixed
+// seed is offset per call so the images differ. Failed calls are logged and
+// skipped; only when every call fails is the first error returned.
+func generateEach(ctx context.Context, cfg *genai.GenerateImagesConfig, call imageCall) (*genai.GenerateImagesResponse, error) {
+	n := int(cfg.NumberOfImages)
+	resps := make([]*genai.GenerateImagesResponse, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		one := *cfg
+		one.NumberOfImages = 1
+		if cfg.Seed != nil {
+			seed := *cfg.Seed + int32(i)
+			one.Seed = &seed
+		}
+		wg.Add(1)
+		go func(i int, one *genai.GenerateImagesConfig) {
+			defer wg.Done()
+			resps[i], errs[i] = call(ctx, one)
+		}(i, &one)
+	}
+	wg.Wait()
+
+	var merged *genai.GenerateImagesResponse
+	for i, resp := range resps {
+		if errs[i] != nil {
+			log.Printf("single-image call %d of %d failed: %v", i+1, n, errs[i])
+			continue
+		}
+		if merged == nil {
+			// Headers and prompt safety attributes come from the first
+			// successful call
+			first := *resp
+			first.GeneratedImages = nil
+			merged = &first
+		}
+		merged.GeneratedImages = append(merged.GeneratedImages, resp.GeneratedImages...)
+	}
+	if merged == nil {
+		return nil, errs[0]
+	}
+	return merged, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// SQS mode (SQS_MODE=true) generates one request per queue message instead
+// of serving HTTP. Messages carry the same JSON body as POST requests.
+var (
+	sqsMode bool
+	// sqsMaxReceiveCount is the queue's redrive maxReceiveCount
+	// (SQS_MAX_RECEIVE_COUNT); 0 records every failed attempt.
+	sqsMaxReceiveCount int
+	// failureBucket is the private bucket failure records are written to
+	// (FAILURE_BUCKET). They keep the message body, prompt and all, so they
+	// don't go to the output bucket.
+	failureBucket string
+	// failurePrefix is where failure records are written (FAILURE_PREFIX).
+	failurePrefix = "failures"
+)
+
+// failureRecord is the context of a failed message, written to
+// <failurePrefix>/<messageId>.json in failureBucket so it can be inspected
+// and replayed once the queue gives up on it.
+type failureRecord struct {
+	MessageID    string `json:"messageId"`
+	Queue        string `json:"queue"`
+	ReceiveCount int    `json:"receiveCount"`
+	Status       int    `json:"status"`
+	Error        string `json:"error"`
+	Reason       string `json:"reason,omitempty"`
+	Retried      bool   `json:"retried"` // false when the message was dropped as unprocessable
+	FailedAt     string `json:"failedAt"`
+	Body         string `json:"body"`
+}
+
+// sqsHandler processes a batch of queue messages, reporting failed ones so
+// only they return to the queue. Server-side failures are retried under the
+// queue's redrive policy and end up in its dead-letter queue; invalid
+// requests would fail the same way every time, so they are dropped. Either
+// way a failure record is written first: always for dropped messages, and
+// on the last receive for retried ones.
+func sqsHandler(ctx context.Context, ev events.SQSEvent) (events.SQSEventResponse, error) {
+	defer flushTraces(ctx)
+	defer flushAsync(ctx)
+
+	var resp events.SQSEventResponse
+	for _, msg := range ev.Records {
+		reqErr := processMessage(ctx, msg)
+		if reqErr == nil {
+			continue
+		}
+		retry := reqErr.status >= http.StatusInternalServerError
+		received, _ := strconv.Atoi(msg.Attributes["ApproximateReceiveCount"])
+		log.Printf("message %s failed (receive %d, status %d): %s", msg.MessageId, received, reqErr.status, reqErr.msg)
+		if !retry || sqsMaxReceiveCount == 0 || received >= sqsMaxReceiveCount {
+			if err := writeFailureRecord(ctx, s3Client, msg, received, reqErr, retry); err != nil {
+				log.Printf("failed to write failure record for message %s: %v", msg.MessageId, err)
+				// Keep the message rather than drop it unrecorded
+				retry = true
+			}
+		}
+		if retry {
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: msg.MessageId})
+		}
+	}
+	return resp, nil
+}
+
+func processMessage(ctx context.Context, msg events.SQSMessage) *requestError {
+	in, reqErr := parseRequest(ctx, msg.Body, nil, "")
+	if reqErr != nil {
+		return reqErr
+	}
+	if in.FastFirst {
+		return &requestError{status: http.StatusBadRequest, msg: "fastFirst requires response streaming (RESPONSE_STREAMING=true)"}
+	}
+	// Queue messages have no caller identity to trust
+	if reqErr := checkOverrides(in, false); reqErr != nil {
+		return reqErr
+	}
+	out, reqErr := run(ctx, in, nil)
+	if reqErr == nil {
+		log.Printf("message %s: generated %d image(s)", msg.MessageId, len(out.ImageURLs))
+	}
+	return reqErr
+}
+
+func writeFailureRecord(ctx context.Context, client objectPutter, msg events.SQSMessage, received int, reqErr *requestError, retried bool) error {
+	rec := failureRecord{
+		MessageID:    msg.MessageId,
+		Queue:        msg.EventSourceARN,
+		ReceiveCount: received,
+		Status:       reqErr.status,
+		Error:        reqErr.msg,
+		Reason:       reqErr.reason,
+		Retried:      retried,
+		FailedAt:     time.Now().UTC().Format(time.RFC3339),
+		Body:         msg.Body,
+	}
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return putInternalObject(ctx, client, failureBucket, path.Join(folderPrefix, failurePrefix, msg.MessageId+".json"), body, "application/json")
+}
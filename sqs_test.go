@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestWriteFailureRecord(t *testing.T) {
+	defer func(b, folder string) { failureBucket, folderPrefix = b, folder }(failureBucket, folderPrefix)
+	failureBucket, folderPrefix = "private-failures", "generated-images"
+	msg := events.SQSMessage{MessageId: "m-1", EventSourceARN: "arn:aws:sqs:us-east-1:1:q", Body: `{"prompt": ""}`}
+
+	reqErr := processMessage(context.Background(), msg)
+	if reqErr == nil || reqErr.status != http.StatusBadRequest {
+		t.Fatalf("processMessage() = %+v, want a 400", reqErr)
+	}
+	client := &fakePutter{}
+	if err := writeFailureRecord(context.Background(), client, msg, 2, reqErr, false); err != nil {
+		t.Fatalf("writeFailureRecord() error = %v", err)
+	}
+	if client.calls != 1 {
+		t.Fatalf("writeFailureRecord() made %d call(s), want 1", client.calls)
+	}
+	in := client.inputs[0]
+	if b, k := aws.ToString(in.Bucket), aws.ToString(in.Key); b != "private-failures" || k != "generated-images/failures/m-1.json" {
+		t.Errorf("record written to s3://%s/%s, want s3://private-failures/generated-images/failures/m-1.json", b, k)
+	}
+	var rec failureRecord
+	if err := json.Unmarshal([]byte(client.bodies[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.MessageID != "m-1" || rec.Queue != msg.EventSourceARN || rec.ReceiveCount != 2 || rec.Status != http.StatusBadRequest ||
+		rec.Error != reqErr.msg || rec.Retried || rec.Body != msg.Body || rec.FailedAt == "" {
+		t.Errorf("record = %+v", rec)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// Container-level counters served by GET /stats, for debugging. They start
+// at zero on every cold start.
+var (
+	coldStart       = time.Now()
+	statGenerations atomic.Int64 // generate calls, successful or not
+	statUploads     atomic.Int64 // images uploaded to S3
+	statErrors      atomic.Int64 // generate calls that failed
+)
+
+// containerStats is the GET /stats response.
+type containerStats struct {
+	Generations   int64   `json:"generations"`
+	Uploads       int64   `json:"uploads"`
+	Errors        int64   `json:"errors"`
+	Inflight      int64   `json:"inflight"`
+	ColdStart     string  `json:"coldStart"`
+	UptimeSeconds float64 `json:"uptimeSeconds"`
+}
+
+// statsBody renders the current counters as JSON.
+func statsBody() []byte {
+	body, _ := json.Marshal(containerStats{
+		Generations:   statGenerations.Load(),
+		Uploads:       statUploads.Load(),
+		Errors:        statErrors.Load(),
+		Inflight:      inflight.Load(),
+		ColdStart:     coldStart.UTC().Format(time.RFC3339),
+		UptimeSeconds: time.Since(coldStart).Round(time.Millisecond).Seconds(),
+	})
+	return body
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errObjectExists is returned by putObject when DENY_OVERWRITE is set and
+// the key is already taken.
+var errObjectExists = errors.New("object already exists")
+
+var (
+	// denyOverwrite makes every upload conditional on the key being free
+	// (DENY_OVERWRITE).
+	denyOverwrite bool
+	// s3MaxAttempts bounds how many times an upload is tried when S3
+	// throttles or fails server-side (S3_MAX_ATTEMPTS).
+	s3MaxAttempts = 4
+	// s3RetryBase is the first retry's maximum backoff, doubled per attempt.
+	s3RetryBase = 200 * time.Millisecond
+	// shardBuckets spreads uploads across several buckets (SHARD_BUCKETS).
+	shardBuckets []string
+	// kmsKeyID, when set, encrypts uploads with SSE-KMS (OUTPUT_KMS_KEY_ID).
+	kmsKeyID string
+	// presigner signs URLs with the Lambda's credentials.
+	presigner *s3.PresignClient
+	// presignExpiry is how long presigned URLs stay valid (PRESIGN_EXPIRY_SECONDS).
+	presignExpiry time.Duration
+	// presignGetURLs returns presigned GET URLs instead of public ones, for
+	// private buckets (PRESIGN_URLS).
+	presignGetURLs bool
+)
+
+// cacheBustURLs appends a content hash to returned URLs (CACHE_BUST_URLS).
+var cacheBustURLs bool
+
+// s3Endpoint overrides the S3 endpoint (AWS_S3_ENDPOINT), for LocalStack or
+// MinIO. Empty in production.
+var s3Endpoint string
+
+// clientRegion is the region of the current S3 client, set by newS3Client.
+var clientRegion string
+
+// newS3Client creates the S3 client, pointing it at s3Endpoint when set and
+// using s3Transport.
+func newS3Client(cfg aws.Config) *s3.Client {
+	clientRegion = cfg.Region
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if hc := s3Transport.httpClient(); hc != nil {
+			o.HTTPClient = hc
+		}
+		if s3Endpoint != "" {
+			o.BaseEndpoint = aws.String(s3Endpoint)
+			// Local emulators don't resolve virtual-hosted bucket names
+			o.UsePathStyle = true
+		}
+	})
+}
+
+// uploadOptions are the per-request settings applied to every upload.
+type uploadOptions struct {
+	encryptionContext string            // encoded SSE-KMS encryption context, "" for none
+	metadata          map[string]string // S3 user metadata
+	downloadName      string            // filename offered by presigned GET URLs, "" for the key's
+	tagging           string            // URL-encoded S3 object tags, "" for none
+	bucket            string            // overrides the output bucket, e.g. for a TENANT_CONFIG bucket
+	sourceIP          string            // PRESIGN_IP_LOCK: the only address signed URLs work from
+	written           *writtenObjects   // SEQUENTIAL_NAMING: logs uploads, nil for none
+}
+
+// targetBucket is the bucket key is uploaded to.
+func (o uploadOptions) targetBucket(key string) string {
+	if o.bucket != "" {
+		return o.bucket
+	}
+	return bucketFor(key)
+}
+
+// objectDeleter is the part of the S3 API used to take back uploads.
+type objectDeleter interface {
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// writtenObjects logs the objects uploaded with a set of uploadOptions,
+// from any number of goroutines.
+type writtenObjects struct {
+	mu      sync.Mutex
+	objects [][2]string // bucket, key
+}
+
+func (w *writtenObjects) add(bucket, key string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.objects = append(w.objects, [2]string{bucket, key})
+}
+
+// delete removes the logged objects through client, returning the first
+// failure after trying them all.
+func (w *writtenObjects) delete(ctx context.Context, client objectDeleter) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var firstErr error
+	for _, obj := range w.objects {
+		if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(obj[0]), Key: aws.String(obj[1])}); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("deleting %s: %w", obj[1], err)
+		}
+	}
+	return firstErr
+}
+
+// putObject uploads body to key in the output bucket and returns its public URL.
+func putObject(ctx context.Context, key string, body []byte, contentType string, opts uploadOptions) (string, error) {
+	obj, err := putObjectStored(ctx, key, body, contentType, opts)
+	return obj.url, err
+}
+
+// storedObject is a completed upload as S3 confirmed it.
+type storedObject struct {
+	url      string
+	etag     string // quoted as S3 sends it, so it can go straight into If-None-Match
+	checksum string // base64 SHA-256 of the body, verified and stored by S3
+}
+
+// putObjectStored is putObject that also returns what S3 reported about the
+// object. The body's SHA-256 is sent along, so S3 rejects an upload that
+// was corrupted in transit and keeps the checksum for later integrity checks.
+func putObjectStored(ctx context.Context, key string, body []byte, contentType string, opts uploadOptions) (_ storedObject, err error) {
+	// Derived objects (thumbnails, variants, sprite sheets) are checked here
+	if err := checkKey(key); err != nil {
+		return storedObject{}, err
+	}
+	ctx, span := tracer.Start(ctx, "imagen.upload", trace.WithAttributes(
+		attribute.String("s3.key", key),
+		attribute.Int("s3.size", len(body)),
+	))
+	defer func() { endSpan(span, err) }()
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(opts.targetBucket(key)),
+		Key:         aws.String(key),
+		ContentType: aws.String(storedContentType(contentType)),
+		Metadata:    opts.metadata,
+		// S3 checks the body against it and returns it once stored
+		ChecksumSHA256: aws.String(sha256Base64(body)),
+	}
+	if opts.tagging != "" {
+		input.Tagging = aws.String(opts.tagging)
+	}
+	if kmsKeyID != "" {
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(kmsKeyID)
+		if opts.encryptionContext != "" {
+			input.SSEKMSEncryptionContext = aws.String(opts.encryptionContext)
+		}
+	}
+	if denyOverwrite {
+		input.IfNoneMatch = aws.String("*")
+	}
+	if err := s3Limit.acquire(ctx); err != nil {
+		return storedObject{}, err
+	}
+	out, err := uploadBody(ctx, s3Client, input, body)
+	s3Limit.release()
+	if err != nil && isPreconditionFailed(err) {
+		log.Printf("S3 object %s already exists; not overwriting", key)
+		return storedObject{}, fmt.Errorf("%s: %w", key, errObjectExists)
+	}
+	if err != nil {
+		log.Printf("S3 upload failed for %s: %v", key, err)
+		return storedObject{}, err
+	}
+	opts.written.add(opts.targetBucket(key), key)
+	obj := storedObject{etag: aws.ToString(out.ETag), checksum: aws.ToString(out.ChecksumSHA256)}
+	if presignGetURLs {
+		obj.url, err = presignGet(ctx, opts.targetBucket(key), key, opts.downloadName)
+		return obj, err
+	}
+	obj.url = objectURL(key)
+	if opts.bucket != "" {
+		// Other buckets are served by S3 directly, not through the CDN
+		obj.url = buildPublicURL(opts.bucket, clientRegion, key)
+	}
+	if cacheBustURLs {
+		obj.url += "?v=" + contentVersion(body)
+	}
+	if opts.bucket != "" {
+		return obj, nil
+	}
+	// Sign last so the signature covers every query parameter
+	obj.url, err = signCDNURL(obj.url, opts.sourceIP)
+	return obj, err
+}
+
+// sha256Base64 is the checksum format S3 uses for ChecksumSHA256.
+func sha256Base64(body []byte) string {
+	sum := sha256.Sum256(body)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// putInternalObject writes a record that isn't handed to clients, such as a
+// failure record, to key in bucket through client. These records keep
+// prompts, so bucket is a private one rather than the output bucket. Like
+// putObjectStored it checks the key first and, under DENY_OVERWRITE, never
+// replaces an object.
+func putInternalObject(ctx context.Context, client objectPutter, bucket, key string, body []byte, contentType string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	}
+	if kmsKeyID != "" {
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(kmsKeyID)
+	}
+	if denyOverwrite {
+		input.IfNoneMatch = aws.String("*")
+	}
+	_, err := putWithRetry(ctx, client, input, body)
+	if err != nil && isPreconditionFailed(err) {
+		return fmt.Errorf("%s: %w", key, errObjectExists)
+	}
+	return err
+}
+
+// bucketFor returns the bucket that holds key: one of shardBuckets chosen
+// by a hash of the key, or the output bucket when sharding is off.
+func bucketFor(key string) string {
+	if len(shardBuckets) == 0 {
+		return bucketName
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return shardBuckets[h.Sum32()%uint32(len(shardBuckets))]
+}
+
+// s3Uploader is the part of the S3 API uploads use.
+type s3Uploader interface {
+	objectPutter
+	multipartAPI
+}
+
+// uploadBody sends input with body through client: in one PUT, or in parts
+// when body is over multipartThreshold. input.ChecksumSHA256 is the SHA-256
+// of body, and is reported back either way.
+func uploadBody(ctx context.Context, client s3Uploader, input *s3.PutObjectInput, body []byte) (*s3.PutObjectOutput, error) {
+	if len(body) <= multipartThreshold {
+		return putWithRetry(ctx, client, input, body)
+	}
+	// One PUT of a very large object is slow to retry, and capped at 5 GB
+	fullChecksum := input.ChecksumSHA256
+	input.ChecksumSHA256 = nil
+	out, err := putMultipart(ctx, client, input, body, multipartPartSize)
+	if err != nil {
+		return nil, err
+	}
+	// S3 only has a composite SHA-256 for multipart objects; every part was
+	// verified, so report the full-object one like a PUT
+	out.ChecksumSHA256 = fullChecksum
+	return out, nil
+}
+
+// objectPutter is the part of the S3 API single-PUT uploads use.
+type objectPutter interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// putWithRetry sends input with body through client, retrying S3
+// throttling and server errors as retryS3 does.
+func putWithRetry(ctx context.Context, client objectPutter, input *s3.PutObjectInput, body []byte) (*s3.PutObjectOutput, error) {
+	var out *s3.PutObjectOutput
+	err := retryS3(ctx, func() error {
+		input.Body = bytes.NewReader(body)
+		var err error
+		out, err = client.PutObject(ctx, input)
+		return err
+	})
+	return out, err
+}
+
+// retryS3 calls op, retrying S3 throttling and server errors with
+// exponential backoff on top of the SDK's own retries. Other failures, such
+// as AccessDenied, are returned at once. It gives up early rather than sleep
+// past the context deadline.
+func retryS3(ctx context.Context, op func() error) error {
+	backoff := s3RetryBase
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= s3MaxAttempts || !isRetryableS3Error(err) {
+			return err
+		}
+		// Full jitter spreads out retries from concurrent uploads
+		wait := time.Duration(rand.Int63n(int64(backoff))) + time.Millisecond
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return err
+		}
+		log.Printf("S3 %s (attempt %d of %d); retrying in %v", s3ErrorCode(err), attempt, s3MaxAttempts, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// isRetryableS3Error reports whether an S3 failure is throttling or a
+// transient server-side error.
+func isRetryableS3Error(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "SlowDown", "ServiceUnavailable", "InternalError", "RequestTimeout":
+		return true
+	}
+	return apiErr.ErrorFault() == smithy.FaultServer
+}
+
+func s3ErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return err.Error()
+}
+
+// isPreconditionFailed reports whether a conditional S3 write was refused
+// because the object exists (or a concurrent write to it won).
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return true
+	}
+	return false
+}
+
+// encodeEncryptionContext returns ec in the form S3 expects for
+// SSEKMSEncryptionContext: base64-encoded JSON.
+func encodeEncryptionContext(ec map[string]string) (string, error) {
+	if kmsKeyID == "" {
+		return "", errors.New("encryptionContext requires KMS encryption (OUTPUT_KMS_KEY_ID)")
+	}
+	for k := range ec {
+		if k == "" {
+			return "", errors.New("encryptionContext keys must not be empty")
+		}
+		// S3 adds this pair itself
+		if k == "aws:s3:arn" {
+			return "", fmt.Errorf("encryptionContext key %q is reserved", k)
+		}
+	}
+	b, err := json.Marshal(ec)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// contentVersion is a short hash of an object's bytes, used to give each
+// distinct upload its own CDN cache key.
+func contentVersion(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:4])
+}
+
+// objectURL returns the public URL of key in the output bucket, or on the
+// CDN when one is configured.
+func objectURL(key string) string {
+	if cdnDomain != "" {
+		return fmt.Sprintf("https://%s/%s", cdnDomain, key)
+	}
+	return buildPublicURL(bucketFor(key), clientRegion, key)
+}
+
+// buildPublicURL returns the URL of key in bucket, served from region. It
+// must be given the region the S3 client actually uploaded to, which may
+// differ from OUTPUT_BUCKET_REGION after DETECT_BUCKET_REGION.
+func buildPublicURL(bucket, region, key string) string {
+	if s3Endpoint != "" {
+		return fmt.Sprintf("%s/%s/%s", s3Endpoint, bucket, key)
+	}
+	// Dotted bucket names don't match S3's wildcard certificate, so they're
+	// addressed path-style
+	if strings.Contains(bucket, ".") {
+		return fmt.Sprintf("https://s3.%s.amazonaws.com/%s/%s", region, bucket, key)
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, region, key)
+}
+
+// presignPut returns a URL that lets its holder PUT an object of contentType
+// to key in bucket until presignExpiry passes. The Content-Type header is
+// part of the signature, so the uploader must send the same value.
+func presignPut(ctx context.Context, bucket, key, contentType string) (string, error) {
+	req, err := presigner.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(storedContentType(contentType)),
+	}, s3.WithPresignExpires(presignExpiry))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// presignGet returns a URL that lets its holder GET key in bucket until
+// presignExpiry passes. With a downloadName, browsers save the object under
+// that name.
+func presignGet(ctx context.Context, bucket, key, downloadName string) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if downloadName != "" {
+		input.ResponseContentDisposition = aws.String(fmt.Sprintf("attachment; filename=%q", downloadName))
+	}
+	req, err := presigner.PresignGetObject(ctx, input, s3.WithPresignExpires(presignExpiry))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// promptSlug turns a prompt into a short ASCII filename stem such as
+// "a-cat-in-a-hat".
+func promptSlug(prompt string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(prompt) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+			if b.Len() >= 60 {
+				break
+			}
+		} else {
+			dash = true
+		}
+	}
+	if b.Len() == 0 {
+		return "image"
+	}
+	return b.String()
+}
+
+// loadStorageConfig creates the S3 client and reads where and how uploads
+// are stored. It returns the AWS config the other AWS clients share.
+func loadStorageConfig() aws.Config {
+	// load AWS Output Bucket Configuration
+	region = os.Getenv("OUTPUT_BUCKET_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	// Load AWS config & create S3 client
+	awsCfg, err := config.LoadDefaultConfig(
+		context.Background(),
+		config.WithRegion(region),
+	)
+	if err != nil {
+		log.Fatalf("unable to load AWS SDK config: %v", err)
+	}
+	// Custom S3 endpoint, e.g. LocalStack or MinIO for local testing
+	s3Endpoint = strings.TrimSuffix(os.Getenv("AWS_S3_ENDPOINT"), "/")
+	// Connection pool sizing for high fan-out uploads
+	s3Transport = s3TransportSettings{
+		maxConnsPerHost:     envInt("S3_MAX_CONNS_PER_HOST", 0),
+		maxIdleConnsPerHost: envInt("S3_MAX_IDLE_CONNS_PER_HOST", 0),
+		idleConnTimeout:     time.Duration(envInt("S3_IDLE_CONN_TIMEOUT_SECONDS", 0)) * time.Second,
+		connectTimeout:      time.Duration(envInt("S3_CONNECT_TIMEOUT_MS", 0)) * time.Millisecond,
+		responseTimeout:     time.Duration(envInt("S3_RESPONSE_TIMEOUT_MS", 0)) * time.Millisecond,
+	}
+	s3Client = newS3Client(awsCfg)
+
+	// Read bucket + optional folder prefix from env
+	bucketName = os.Getenv("OUTPUT_BUCKET")
+	if bucketName == "" {
+		log.Fatalf("OUTPUT_BUCKET must be set")
+	}
+	folderPrefix = normalizePrefix(os.Getenv("OUTPUT_FOLDER")) // e.g. "generated-images" or ""
+
+	// Optionally look up the bucket's real region once per container, and use
+	// it for both the S3 client and the returned URLs
+	if os.Getenv("DETECT_BUCKET_REGION") == "true" {
+		detected, err := detectBucketRegion(context.Background(), s3Client, bucketName)
+		if err != nil {
+			log.Fatalf("unable to detect region of bucket %s: %v", bucketName, err)
+		}
+		if detected != region {
+			log.Printf("bucket %s is in %s, not %s; using %s", bucketName, detected, region, detected)
+			region = detected
+			awsCfg.Region = region
+			s3Client = newS3Client(awsCfg)
+		}
+	}
+	for _, b := range strings.Split(os.Getenv("SHARD_BUCKETS"), ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			shardBuckets = append(shardBuckets, b)
+		}
+	}
+	kmsKeyID = os.Getenv("OUTPUT_KMS_KEY_ID")
+	denyOverwrite = os.Getenv("DENY_OVERWRITE") == "true"
+	s3MaxAttempts = envInt("S3_MAX_ATTEMPTS", s3MaxAttempts)
+
+	// Objects above the threshold go up in parts
+	multipartThreshold = envInt("MULTIPART_THRESHOLD_BYTES", multipartThreshold)
+	multipartPartSize = envInt("MULTIPART_PART_SIZE_BYTES", multipartPartSize)
+	if multipartPartSize < minPartSize {
+		log.Fatalf("MULTIPART_PART_SIZE_BYTES must be at least %d (5 MiB)", minPartSize)
+	}
+	return awsCfg
+}
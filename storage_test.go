@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// fakePutter fails the first len(errs) PutObject calls with errs in turn,
+// then succeeds.
+type fakePutter struct {
+	errs   []error
+	calls  int
+	inputs []*s3.PutObjectInput
+	bodies []string
+}
+
+func (f *fakePutter) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.calls++
+	f.inputs = append(f.inputs, params)
+	b, _ := io.ReadAll(params.Body)
+	f.bodies = append(f.bodies, string(b))
+	if f.calls <= len(f.errs) {
+		return nil, f.errs[f.calls-1]
+	}
+	return &s3.PutObjectOutput{ETag: aws.String(`"etag"`)}, nil
+}
+
+func TestPutWithRetry(t *testing.T) {
+	defer func(base time.Duration, n int) { s3RetryBase, s3MaxAttempts = base, n }(s3RetryBase, s3MaxAttempts)
+	s3RetryBase, s3MaxAttempts = time.Millisecond, 3
+	slowDown := &smithy.GenericAPIError{Code: "SlowDown", Fault: smithy.FaultServer}
+	internal := &smithy.GenericAPIError{Code: "InternalError", Fault: smithy.FaultServer}
+	denied := &smithy.GenericAPIError{Code: "AccessDenied", Fault: smithy.FaultClient}
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "first try", wantCalls: 1},
+		{name: "SlowDown then success", errs: []error{slowDown}, wantCalls: 2},
+		{name: "server errors then success", errs: []error{slowDown, internal}, wantCalls: 3},
+		{name: "gives up after max attempts", errs: []error{slowDown, slowDown, slowDown}, wantCalls: 3, wantErr: slowDown},
+		{name: "access denied fails at once", errs: []error{denied}, wantCalls: 1, wantErr: denied},
+		{name: "other errors fail at once", errs: []error{errors.New("dial tcp: refused")}, wantCalls: 1, wantErr: errors.New("dial tcp: refused")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakePutter{errs: tt.errs}
+			out, err := putWithRetry(context.Background(), client, &s3.PutObjectInput{Key: aws.String("k")}, []byte("body"))
+			if client.calls != tt.wantCalls {
+				t.Errorf("putWithRetry() made %d call(s), want %d", client.calls, tt.wantCalls)
+			}
+			if tt.wantErr != nil {
+				if err == nil || err.Error() != tt.wantErr.Error() {
+					t.Fatalf("putWithRetry() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || aws.ToString(out.ETag) != `"etag"` {
+				t.Fatalf("putWithRetry() = %v, %v", out, err)
+			}
+			// Every attempt resends the whole body
+			for i, b := range client.bodies {
+				if b != "body" {
+					t.Errorf("attempt %d sent %q, want %q", i+1, b, "body")
+				}
+			}
+		})
+	}
+}
+
+func TestPutWithRetryDeadline(t *testing.T) {
+	defer func(base time.Duration, n int) { s3RetryBase, s3MaxAttempts = base, n }(s3RetryBase, s3MaxAttempts)
+	s3RetryBase, s3MaxAttempts = time.Hour, 5
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	client := &fakePutter{errs: []error{&smithy.GenericAPIError{Code: "SlowDown", Fault: smithy.FaultServer}}}
+	if _, err := putWithRetry(ctx, client, &s3.PutObjectInput{}, nil); err == nil || client.calls != 1 {
+		t.Errorf("putWithRetry() = %v after %d call(s), want the SlowDown error without sleeping past the deadline", err, client.calls)
+	}
+}
+
+func TestPutInternalObject(t *testing.T) {
+	defer func(p *regexp.Regexp, deny bool) { allowedKeyPattern, denyOverwrite = p, deny }(allowedKeyPattern, denyOverwrite)
+	allowedKeyPattern = regexp.MustCompile(`^generated-images/`)
+	exists := &smithy.GenericAPIError{Code: "PreconditionFailed", Fault: smithy.FaultClient}
+	tests := []struct {
+		name      string
+		key       string
+		deny      bool
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "written", key: "generated-images/failures/m.json", wantCalls: 1},
+		{name: "key not allowed", key: "failures/m.json", wantErr: errKeyNotAllowed},
+		{name: "conditional under DENY_OVERWRITE", key: "generated-images/failures/m.json", deny: true, wantCalls: 1},
+		{name: "existing object kept", key: "generated-images/failures/m.json", deny: true, errs: []error{exists}, wantCalls: 1, wantErr: errObjectExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			denyOverwrite = tt.deny
+			client := &fakePutter{errs: tt.errs}
+			err := putInternalObject(context.Background(), client, "private", tt.key, []byte("{}"), "application/json")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("putInternalObject() error = %v, want %v", err, tt.wantErr)
+			}
+			if client.calls != tt.wantCalls {
+				t.Fatalf("putInternalObject() made %d call(s), want %d", client.calls, tt.wantCalls)
+			}
+			if tt.wantCalls > 0 && aws.ToString(client.inputs[0].Bucket) != "private" {
+				t.Errorf("bucket = %q, want private", aws.ToString(client.inputs[0].Bucket))
+			}
+			if tt.wantCalls > 0 && (aws.ToString(client.inputs[0].IfNoneMatch) == "*") != tt.deny {
+				t.Errorf("If-None-Match = %q, want it set only under DENY_OVERWRITE", aws.ToString(client.inputs[0].IfNoneMatch))
+			}
+		})
+	}
+}
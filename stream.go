@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// progressEvent is a single line of a streamed response.
+type progressEvent struct {
+	Status   string           `json:"status"`             // "generating", "first", "uploaded", "done" or "error"
+	Uploaded int              `json:"uploaded,omitempty"` // set for "uploaded"
+	Total    int              `json:"total,omitempty"`    // set for "uploaded"
+	Index    *int             `json:"index,omitempty"`    // set for "first" and "uploaded"
+	ImageURL string           `json:"imageUrl,omitempty"` // set for "first" and "uploaded"
+	JobID    string           `json:"jobId,omitempty"`    // set for "first"
+	Result   *responsePayload `json:"result,omitempty"`   // set for "done"
+	Error    string           `json:"error,omitempty"`    // set for "error"
+	Reason   string           `json:"reason,omitempty"`   // machine-readable cause, when known
+}
+
+// progressWriter writes progress events as newline-delimited JSON, or as
+// Server-Sent Events named after their status when sse is set.
+type progressWriter struct {
+	w   io.Writer
+	enc *json.Encoder
+	sse bool
+	err error
+}
+
+func newProgressWriter(w io.Writer, sse bool) *progressWriter {
+	return &progressWriter{w: w, enc: json.NewEncoder(w), sse: sse}
+}
+
+// emit writes ev. Once a write fails (e.g. the client went away) later
+// events are dropped and the first error is kept.
+func (p *progressWriter) emit(ev progressEvent) {
+	if p.err != nil {
+		return
+	}
+	if !p.sse {
+		p.err = p.enc.Encode(ev)
+		return
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		p.err = err
+		return
+	}
+	// JSON has no raw newlines, so the payload fits on one data: line
+	_, p.err = fmt.Fprintf(p.w, "event: %s\ndata: %s\n\n", ev.Status, data)
+}
+
+func (p *progressWriter) uploaded(u uploadProgress) {
+	idx := u.Index
+	p.emit(progressEvent{Status: "uploaded", Uploaded: u.Done, Total: u.Total, Index: &idx, ImageURL: u.URL})
+}
+
+// Err returns the first write error, if any.
+func (p *progressWriter) Err() error {
+	return p.err
+}
+
+// streamProgress runs a request to completion, reporting each stage to w.
+func streamProgress(ctx context.Context, in requestPayload, w *progressWriter) {
+	w.emit(progressEvent{Status: "generating"})
+	if in.FastFirst {
+		streamFastFirst(ctx, in, w)
+		return
+	}
+	out, reqErr := run(ctx, in, w.uploaded)
+	if reqErr != nil {
+		w.emit(progressEvent{Status: "error", Error: reqErr.msg, Reason: reqErr.reason})
+		return
+	}
+	w.emit(progressEvent{Status: "done", Result: &out})
+}
+
+// streamHandler is used when the Function URL runs in RESPONSE_STREAM mode.
+// Validation errors are still returned as a plain response; once generation
+// starts the status is 200 and progress is written as JSON lines.
+func streamHandler(ctx context.Context, req events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLStreamingResponse, error) {
+	rid := requestID(ctx, events.APIGatewayProxyRequest{RequestContext: events.APIGatewayProxyRequestContext{RequestID: req.RequestContext.RequestID}})
+	if req.RequestContext.HTTP.Method == http.MethodHead {
+		return &events.LambdaFunctionURLStreamingResponse{StatusCode: http.StatusOK, Headers: configHeaders(), Body: strings.NewReader("")}, nil
+	}
+	if req.RequestContext.HTTP.Method == http.MethodGet && strings.HasPrefix(req.RawPath, "/jobs/") {
+		return jobResponse(ctx, strings.TrimPrefix(req.RawPath, "/jobs/"), rid), nil
+	}
+	if req.RequestContext.HTTP.Method == http.MethodGet && strings.HasPrefix(req.RawPath, "/s/") {
+		location, reqErr := shortLinkLocation(ctx, strings.TrimPrefix(req.RawPath, "/s/"), req.RequestContext.HTTP.SourceIP)
+		if reqErr != nil {
+			return streamingResponse(errorResponse(rid, reqErr)), nil
+		}
+		return &events.LambdaFunctionURLStreamingResponse{
+			StatusCode: http.StatusFound,
+			Headers:    map[string]string{"Location": location},
+			Body:       strings.NewReader(""),
+		}, nil
+	}
+	if req.RequestContext.HTTP.Method == http.MethodGet && req.RawPath == "/stats" {
+		return &events.LambdaFunctionURLStreamingResponse{
+			StatusCode: http.StatusOK,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       bytes.NewReader(statsBody()),
+		}, nil
+	}
+	if req.RequestContext.HTTP.Method == http.MethodGet && req.RawPath == "/metadata" {
+		if tenantClaim != "" {
+			return streamingResponse(clientError(rid, http.StatusForbidden, "tenant isolation is not available with response streaming")), nil
+		}
+		body, reqErr := lookupMetadata(ctx, req.QueryStringParameters["key"], folderPrefix)
+		if reqErr != nil {
+			return streamingResponse(errorResponse(rid, reqErr)), nil
+		}
+		return &events.LambdaFunctionURLStreamingResponse{
+			StatusCode: http.StatusOK,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       bytes.NewReader(body),
+		}, nil
+	}
+
+	apiKey := apiKeyFromRequest("", req.Headers)
+	in, reqErr := parseRequest(ctx, req.Body, req.QueryStringParameters, apiKey)
+	if reqErr == nil && in.FastFirst && jobs == nil {
+		reqErr = &requestError{status: http.StatusBadRequest, msg: "fastFirst requires JOBS_TABLE"}
+	}
+	if reqErr == nil && in.FastFirst && len(in.Prompts) > 0 {
+		reqErr = &requestError{status: http.StatusBadRequest, msg: "fastFirst does not support prompts batches"}
+	}
+	if reqErr == nil {
+		// Function URLs carry no API key or JWT, so no caller is trusted
+		reqErr = checkOverrides(in, false)
+	}
+	if reqErr == nil {
+		reqErr = applyTenantConfig(&in, apiKey)
+	}
+	if presignIPLock {
+		in.sourceIP = req.RequestContext.HTTP.SourceIP
+	}
+	if reqErr == nil && tenantClaim != "" {
+		// Function URLs have no JWT authorizer to take the tenant from
+		reqErr = &requestError{status: http.StatusForbidden, msg: "tenant isolation is not available with response streaming"}
+	}
+	if reqErr != nil && envelopeResponses {
+		return streamingResponse(envelopeResponse(ctx, events.APIGatewayProxyRequest{RequestContext: events.APIGatewayProxyRequestContext{RequestID: rid}}, responsePayload{}, reqErr)), nil
+	}
+	if reqErr != nil {
+		return streamingResponse(errorResponse(rid, reqErr)), nil
+	}
+
+	sse := strings.Contains(req.Headers["accept"], "text/event-stream")
+	contentType := "application/x-ndjson"
+	if sse {
+		contentType = "text/event-stream"
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		w := newProgressWriter(pw, sse)
+		streamProgress(ctx, in, w)
+		// Finish background work before ending the stream, which lets
+		// Lambda freeze the container
+		flushAsync(ctx)
+		flushTraces(ctx)
+		pw.CloseWithError(w.Err())
+	}()
+
+	// Headers go out before generation finishes, so the count is the
+	// container's load as this request starts, itself included
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": contentType, "Cache-Control": "no-cache", "X-Inflight-Count": strconv.FormatInt(inflight.Load()+1, 10)},
+		Body:       pr,
+	}, nil
+}
+
+// streamFastFirst runs a fastFirst request. The first image to finish
+// uploading, whatever its index, is written as a "first" event straight
+// away, so interactive clients can show it and disconnect; the rest keep
+// uploading and are recorded in the job, which GET /jobs/{jobId} returns.
+// Both the event and the job record use the image's real index.
+func streamFastFirst(ctx context.Context, in requestPayload, w *progressWriter) {
+	jobID := newJobID()
+	if err := jobs.create(ctx, jobID); err != nil {
+		log.Printf("failed to create job %s: %v", jobID, err)
+		w.emit(progressEvent{Status: "error", Error: "failed to create job"})
+		return
+	}
+	out, reqErr := generate(ctx, in, func(u uploadProgress) {
+		if err := jobs.addImage(ctx, jobID, u.Index, u.Total, u.URL); err != nil {
+			log.Printf("failed to record image %d of job %s: %v", u.Index, jobID, err)
+		}
+		if u.Done == 1 {
+			idx := u.Index
+			w.emit(progressEvent{Status: "first", Index: &idx, ImageURL: u.URL, JobID: jobID})
+		} else {
+			w.uploaded(u)
+		}
+	})
+	status := jobComplete
+	if reqErr != nil {
+		status = jobFailed
+	}
+	if err := jobs.finish(ctx, jobID, status); err != nil {
+		log.Printf("failed to finish job %s: %v", jobID, err)
+	}
+	if reqErr != nil {
+		w.emit(progressEvent{Status: "error", Error: reqErr.msg, Reason: reqErr.reason, JobID: jobID})
+		return
+	}
+	out.JobID = jobID
+	w.emit(progressEvent{Status: "done", Result: &out})
+}
+
+// jobResponse serves GET /jobs/{jobId}.
+func jobResponse(ctx context.Context, id, requestID string) *events.LambdaFunctionURLStreamingResponse {
+	if jobs == nil {
+		return streamingResponse(clientError(requestID, http.StatusNotFound, "jobs are not enabled"))
+	}
+	st, err := jobs.get(ctx, id)
+	if errors.Is(err, errJobNotFound) {
+		return streamingResponse(clientError(requestID, http.StatusNotFound, "job not found"))
+	}
+	if err != nil {
+		log.Printf("failed to load job %s: %v", id, err)
+		return streamingResponse(serverError(requestID, http.StatusInternalServerError, "failed to load job"))
+	}
+	body, _ := json.Marshal(st)
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       bytes.NewReader(body),
+	}
+}
+
+// streamingResponse sends a response rendered for API Gateway as a
+// streaming one, so errors look the same in both modes.
+func streamingResponse(resp events.APIGatewayProxyResponse, _ error) *events.LambdaFunctionURLStreamingResponse {
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Headers,
+		Body:       strings.NewReader(resp.Body),
+	}
+}
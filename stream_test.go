@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"google.golang.org/genai"
+)
+
+func TestStreamHandlerErrors(t *testing.T) {
+	defer func(f string, e bool) { errorFormat, envelopeResponses = f, e }(errorFormat, envelopeResponses)
+	req := events.LambdaFunctionURLRequest{
+		Body:           "not json",
+		RequestContext: events.LambdaFunctionURLRequestContext{RequestID: "req-1", HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{Method: http.MethodPost}},
+	}
+	tests := []struct {
+		name     string
+		format   string
+		envelope bool
+		wantType string
+	}{
+		{name: "plain", wantType: "text/plain"},
+		{name: "problem", format: errorFormatRFC7807, wantType: "application/problem+json"},
+		{name: "envelope", envelope: true, wantType: "application/json"},
+		{name: "problem wins over envelope", format: errorFormatRFC7807, envelope: true, wantType: "application/problem+json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errorFormat, envelopeResponses = tt.format, tt.envelope
+			resp, err := streamHandler(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusBadRequest || resp.Headers["Content-Type"] != tt.wantType {
+				t.Fatalf("streamHandler() = %d %s, want 400 %s", resp.StatusCode, resp.Headers["Content-Type"], tt.wantType)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch tt.wantType {
+			case "application/problem+json":
+				var got problemDetails
+				if err := json.Unmarshal(body, &got); err != nil || got.Status != http.StatusBadRequest || got.Instance != "req-1" {
+					t.Errorf("problem = %s, want status 400 and instance req-1", body)
+				}
+			case "application/json":
+				var got envelope
+				if err := json.Unmarshal(body, &got); err != nil || got.Error == nil || got.Meta.RequestID != "req-1" {
+					t.Errorf("envelope = %s, want an error with requestId req-1", body)
+				}
+			}
+		})
+	}
+}
+
+func TestJobResponseErrors(t *testing.T) {
+	defer func(f string, j *jobTracker) { errorFormat, jobs = f, j }(errorFormat, jobs)
+	errorFormat, jobs = errorFormatRFC7807, nil
+	resp := jobResponse(context.Background(), "job-1", "req-1")
+	if resp.StatusCode != http.StatusNotFound || resp.Headers["Content-Type"] != "application/problem+json" {
+		t.Errorf("jobResponse() = %d %s, want 404 application/problem+json", resp.StatusCode, resp.Headers["Content-Type"])
+	}
+}
+
+// readEvents decodes a streamed body's newline-delimited events.
+func readEvents(t *testing.T, body io.Reader) []progressEvent {
+	t.Helper()
+	var events []progressEvent
+	dec := json.NewDecoder(body)
+	for {
+		var ev progressEvent
+		if err := dec.Decode(&ev); err == io.EOF {
+			return events
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+}
+
+// fakeGeneration replaces Imagen with a generator returning n images and
+// S3 with an uploader returning one URL per index.
+func fakeGeneration(t *testing.T, n int) {
+	t.Helper()
+	gen, up := generator, imageUploader
+	t.Cleanup(func() { generator, imageUploader = gen, up })
+	generator = func(context.Context, string, requestPayload, *genai.GenerateImagesConfig) (*genai.GenerateImagesResponse, error) {
+		return generated(n), nil
+	}
+	imageUploader = func(_ context.Context, _ requestPayload, idx int, _ *genai.GeneratedImage, _ time.Time, _ uploadOptions) (uploadedImage, *requestError) {
+		return uploadedImage{url: fmt.Sprintf("https://example.com/%d.png", idx)}, nil
+	}
+}
+
+func TestStreamHandlerProgress(t *testing.T) {
+	defer func(n int) { maxImages = n }(maxImages)
+	maxImages = 4
+	fakeGeneration(t, 2)
+	req := events.LambdaFunctionURLRequest{
+		Body:           `{"prompt": "a cat", "aspectRatio": "1:1", "numberOfImages": 2}`,
+		RequestContext: events.LambdaFunctionURLRequestContext{HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{Method: http.MethodPost}},
+	}
+	resp, err := streamHandler(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Headers["Content-Type"] != "application/x-ndjson" {
+		b, _ := io.ReadAll(resp.Body)
+		t.Fatalf("streamHandler() = %d %s %s, want 200 application/x-ndjson", resp.StatusCode, resp.Headers["Content-Type"], b)
+	}
+	got := readEvents(t, resp.Body)
+	var statuses []string
+	for _, ev := range got {
+		statuses = append(statuses, ev.Status)
+	}
+	if fmt.Sprint(statuses) != "[generating uploaded uploaded done]" {
+		t.Fatalf("events = %v, want generating, uploaded, uploaded, done", statuses)
+	}
+	for i, ev := range got[1:3] {
+		if ev.Uploaded != i+1 || ev.Total != 2 || ev.Index == nil || ev.ImageURL != fmt.Sprintf("https://example.com/%d.png", *ev.Index) {
+			t.Errorf("event %d = %+v, want upload %d of 2 with its image's URL", i+1, ev, i+1)
+		}
+	}
+	if done := got[3].Result; done == nil || fmt.Sprint(done.ImageURLs) != "[https://example.com/0.png https://example.com/1.png]" {
+		t.Errorf("done result = %+v, want both URLs in index order", done)
+	}
+}
+
+// fakeJobs accepts every job write and finds no jobs.
+type fakeJobs struct{}
+
+func (fakeJobs) PutItem(context.Context, *dynamodb.PutItemInput, ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (fakeJobs) UpdateItem(context.Context, *dynamodb.UpdateItemInput, ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (fakeJobs) GetItem(context.Context, *dynamodb.GetItemInput, ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func TestStreamFastFirst(t *testing.T) {
+	defer func(n int, j *jobTracker) { maxImages, jobs = n, j }(maxImages, jobs)
+	maxImages = 4
+	jobs = &jobTracker{client: fakeJobs{}, table: "jobs", ttl: time.Hour, now: time.Now}
+	fakeGeneration(t, 3)
+	// Image 0 uploads straight away; the others wait until the test has
+	// read the first event
+	release := make(chan struct{})
+	imageUploader = func(_ context.Context, _ requestPayload, idx int, _ *genai.GeneratedImage, _ time.Time, _ uploadOptions) (uploadedImage, *requestError) {
+		if idx > 0 {
+			<-release
+		}
+		return uploadedImage{url: fmt.Sprintf("https://example.com/%d.png", idx)}, nil
+	}
+
+	req := events.LambdaFunctionURLRequest{
+		Body:           `{"prompt": "a cat", "aspectRatio": "1:1", "numberOfImages": 3, "fastFirst": true}`,
+		RequestContext: events.LambdaFunctionURLRequestContext{HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{Method: http.MethodPost}},
+	}
+	resp, err := streamHandler(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		t.Fatalf("streamHandler() = %d %s, want 200", resp.StatusCode, b)
+	}
+	dec := json.NewDecoder(resp.Body)
+	var generating, first progressEvent
+	if err := dec.Decode(&generating); err != nil || generating.Status != "generating" {
+		t.Fatalf("first event = %+v (%v), want generating", generating, err)
+	}
+	if err := dec.Decode(&first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Status != "first" || first.Index == nil || *first.Index != 0 || first.ImageURL != "https://example.com/0.png" || first.JobID == "" {
+		t.Fatalf("second event = %+v, want image 0 as first with a jobId", first)
+	}
+	close(release)
+
+	rest := readEvents(t, io.MultiReader(dec.Buffered(), resp.Body))
+	if len(rest) != 3 || rest[0].Status != "uploaded" || rest[1].Status != "uploaded" || rest[2].Status != "done" {
+		t.Fatalf("remaining events = %+v, want two uploaded and done", rest)
+	}
+	if done := rest[2].Result; done == nil || done.JobID != first.JobID || len(done.ImageURLs) != 3 {
+		t.Errorf("done result = %+v, want 3 images under job %s", done, first.JobID)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// tracer is a no-op until initTracing installs an exporting provider.
+	tracer trace.Tracer = otel.Tracer("imagen-lambda")
+	// tracerProvider is set when OTEL_ENABLED is "true".
+	tracerProvider *sdktrace.TracerProvider
+)
+
+// initTracing exports spans over OTLP/HTTP to OTEL_EXPORTER_OTLP_ENDPOINT.
+func initTracing(ctx context.Context) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		log.Fatalf("OTEL_ENABLED requires OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	// The exporter reads the endpoint and OTEL_EXPORTER_OTLP_HEADERS itself
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		log.Fatalf("unable to create OTLP exporter: %v", err)
+	}
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
+	otel.SetTracerProvider(tracerProvider)
+	tracer = tracerProvider.Tracer("imagen-lambda")
+}
+
+// endSpan marks span failed when err is non-nil, then ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// flushTraces exports buffered spans before the invocation returns, since
+// Lambda may freeze the container before the batcher's next export.
+func flushTraces(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.ForceFlush(ctx); err != nil {
+		log.Printf("unable to flush traces: %v", err)
+	}
+}
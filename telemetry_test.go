@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/genai"
+)
+
+// recordSpans points tracer at an in-memory recorder for the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	old := tracer
+	t.Cleanup(func() { tracer = old })
+	rec := tracetest.NewSpanRecorder()
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)).Tracer("test")
+	return rec
+}
+
+func spanAttrs(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range s.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestGenerateSpan(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus codes.Code
+	}{
+		{name: "success", wantStatus: codes.Unset},
+		{name: "failure", err: errors.New("boom"), wantStatus: codes.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := recordSpans(t)
+			fakeGeneration(t, 2)
+			if tt.err != nil {
+				generator = func(context.Context, string, requestPayload, *genai.GenerateImagesConfig) (*genai.GenerateImagesResponse, error) {
+					return nil, tt.err
+				}
+			}
+			in := requestPayload{Prompt: "a cat", AspectRatio: "16:9", NumberOfImages: 2}
+			if _, reqErr := generate(context.Background(), in, nil); (reqErr != nil) != (tt.err != nil) {
+				t.Fatalf("generate() error = %v, want error %v", reqErr, tt.err != nil)
+			}
+			spans := rec.Ended()
+			if len(spans) != 1 || spans[0].Name() != "imagen.generate" {
+				t.Fatalf("ended %d span(s), want one imagen.generate", len(spans))
+			}
+			attrs := spanAttrs(spans[0])
+			if attrs["imagen.image_count"].AsInt64() != 2 || attrs["imagen.aspect_ratio"].AsString() != "16:9" || attrs["imagen.model"].AsString() != imagenModel {
+				t.Errorf("span attributes = %v", spans[0].Attributes())
+			}
+			if got := spans[0].Status().Code; got != tt.wantStatus {
+				t.Errorf("span status = %v, want %v", got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestEndSpan(t *testing.T) {
+	rec := recordSpans(t)
+	_, ok := tracer.Start(context.Background(), "ok")
+	endSpan(ok, nil)
+	_, failed := tracer.Start(context.Background(), "failed")
+	endSpan(failed, errors.New("access denied"))
+
+	spans := rec.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("ended %d span(s), want 2", len(spans))
+	}
+	if spans[0].Status().Code != codes.Unset || len(spans[0].Events()) != 0 {
+		t.Errorf("successful span = %v, %v; want no status or events", spans[0].Status(), spans[0].Events())
+	}
+	if spans[1].Status().Code != codes.Error || spans[1].Status().Description != "access denied" || len(spans[1].Events()) != 1 {
+		t.Errorf("failed span = %v, %v; want an error status and recorded error", spans[1].Status(), spans[1].Events())
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// tenantClaim is the JWT claim that names the caller's tenant (TENANT_CLAIM).
+// When set, every request's images go under a per-tenant prefix and requests
+// without the claim are rejected.
+var tenantClaim string
+
+// validTenant keeps tenant IDs to a single, safe path segment.
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9_@.-]+$`)
+
+// claimFromAuthorizer looks up claim in an API Gateway authorizer context. It
+// understands the Cognito layout ("claims"), the HTTP API JWT layout
+// ("jwt" → "claims"), and Lambda authorizers that set keys directly.
+func claimFromAuthorizer(auth map[string]interface{}, claim string) (string, bool) {
+	if claims, ok := auth["claims"].(map[string]interface{}); ok {
+		if v, ok := claims[claim].(string); ok && v != "" {
+			return v, true
+		}
+	}
+	if jwt, ok := auth["jwt"].(map[string]interface{}); ok {
+		if claims, ok := jwt["claims"].(map[string]interface{}); ok {
+			if v, ok := claims[claim].(string); ok && v != "" {
+				return v, true
+			}
+		}
+	}
+	if v, ok := auth[claim].(string); ok && v != "" {
+		return v, true
+	}
+	return "", false
+}
+
+// tenantFromAuthorizer returns the validated tenant ID for a request.
+func tenantFromAuthorizer(auth map[string]interface{}) (string, error) {
+	tenant, ok := claimFromAuthorizer(auth, tenantClaim)
+	if !ok {
+		return "", fmt.Errorf("missing %s claim", tenantClaim)
+	}
+	if tenant == "." || tenant == ".." || !validTenant.MatchString(tenant) {
+		return "", fmt.Errorf("invalid %s claim", tenantClaim)
+	}
+	return tenant, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// tenantConfigs maps a caller's API key to its own defaults (TENANT_CONFIG).
+// Callers with no API key, or one not listed, get the global defaults.
+var tenantConfigs map[string]tenantConfig
+
+type tenantConfig struct {
+	Model     string `json:"model,omitempty"`     // the only model tried, instead of IMAGEN_MODEL and its fallbacks
+	Bucket    string `json:"bucket,omitempty"`    // receives uploads instead of OUTPUT_BUCKET
+	MaxImages int    `json:"maxImages,omitempty"` // images per request, within MAX_IMAGES
+}
+
+func parseTenantConfig(raw string) (map[string]tenantConfig, error) {
+	var configs map[string]tenantConfig
+	dec := json.NewDecoder(bytes.NewReader([]byte(raw)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&configs); err != nil {
+		return nil, err
+	}
+	for key, c := range configs {
+		// Keys are secrets, so errors don't quote them
+		if key == "" {
+			return nil, fmt.Errorf("empty API key")
+		}
+		if c.MaxImages < 0 || c.MaxImages > maxImages {
+			return nil, fmt.Errorf("maxImages %d must be between 0 and MAX_IMAGES (%d)", c.MaxImages, maxImages)
+		}
+	}
+	return configs, nil
+}
+
+// apiKeyFromRequest returns the caller's API key: the one API Gateway
+// validated, or else the x-api-key header.
+func apiKeyFromRequest(identityKey string, headers map[string]string) string {
+	if identityKey != "" {
+		return identityKey
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, "x-api-key") {
+			return v
+		}
+	}
+	return ""
+}
+
+// applyTenantModel picks the model of the tenant apiKey belongs to, unless
+// the request chose one itself or is a reference edit, which keeps
+// EDIT_MODEL. parseRequest calls it before validating anything that depends
+// on the model, such as aspect ratio and image size.
+func applyTenantModel(in *requestPayload, apiKey string) {
+	c, ok := tenantConfigs[apiKey]
+	if !ok || apiKey == "" {
+		return
+	}
+	if c.Model != "" && in.model == "" && len(in.CompareModels) == 0 && in.ReferenceImage == "" {
+		in.model = c.Model
+	}
+}
+
+// applyTenantConfig fills in the other defaults of the tenant apiKey
+// belongs to. It runs after parseRequest, so request fields still win where
+// they exist.
+func applyTenantConfig(in *requestPayload, apiKey string) *requestError {
+	c, ok := tenantConfigs[apiKey]
+	if !ok || apiKey == "" {
+		return nil
+	}
+	if c.Bucket != "" {
+		if in.ShortLinks {
+			return &requestError{status: http.StatusBadRequest, msg: "shortLinks are not available for this API key"}
+		}
+		in.bucket = c.Bucket
+	}
+	if c.MaxImages > 0 {
+		prompts := max(len(in.Prompts), 1)
+		if total := prompts * int(in.NumberOfImages); total > c.MaxImages {
+			return &requestError{status: http.StatusBadRequest, msg: fmt.Sprintf("%d images exceeds this API key's limit (%d)", total, c.MaxImages)}
+		}
+	}
+	return nil
+}
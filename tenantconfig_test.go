@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseTenantConfig(t *testing.T) {
+	defer func(n int) { maxImages = n }(maxImages)
+	maxImages = 4
+	tests := []struct {
+		name    string
+		raw     string
+		want    map[string]tenantConfig
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			raw:  `{"key-a": {"model": "imagen-4.0-fast-generate-001", "maxImages": 2}, "key-b": {"bucket": "tenant-b"}}`,
+			want: map[string]tenantConfig{
+				"key-a": {Model: "imagen-4.0-fast-generate-001", MaxImages: 2},
+				"key-b": {Bucket: "tenant-b"},
+			},
+		},
+		{name: "empty key", raw: `{"": {"bucket": "b"}}`, wantErr: true},
+		{name: "over MAX_IMAGES", raw: `{"k": {"maxImages": 5}}`, wantErr: true},
+		{name: "unknown field", raw: `{"k": {"region": "eu-west-1"}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTenantConfig(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTenantConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for k, c := range tt.want {
+				if got[k] != c {
+					t.Errorf("tenant %q = %+v, want %+v", k, got[k], c)
+				}
+			}
+		})
+	}
+}
+
+func TestAPIKeyFromRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity string
+		headers  map[string]string
+		want     string
+	}{
+		{"identity wins", "validated", map[string]string{"x-api-key": "header"}, "validated"},
+		{"header", "", map[string]string{"X-Api-Key": "header"}, "header"},
+		{"none", "", map[string]string{"authorization": "Bearer x"}, ""},
+	}
+	for _, tt := range tests {
+		if got := apiKeyFromRequest(tt.identity, tt.headers); got != tt.want {
+			t.Errorf("%s: apiKeyFromRequest() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyTenantConfig(t *testing.T) {
+	defer func(c map[string]tenantConfig) { tenantConfigs = c }(tenantConfigs)
+	tenantConfigs = map[string]tenantConfig{
+		"model":  {Model: "imagen-4.0-fast-generate-001"},
+		"bucket": {Bucket: "tenant-bucket"},
+		"capped": {MaxImages: 2},
+	}
+	tests := []struct {
+		name       string
+		key        string
+		in         requestPayload
+		wantModel  string
+		wantBucket string
+		wantStatus int
+	}{
+		{name: "unknown key", key: "other", in: requestPayload{NumberOfImages: 4}},
+		{name: "tenant model", key: "model", in: requestPayload{}, wantModel: "imagen-4.0-fast-generate-001"},
+		{name: "request model wins", key: "model", in: requestPayload{model: "preset"}, wantModel: "preset"},
+		{name: "compare keeps its models", key: "model", in: requestPayload{CompareModels: []string{"a"}}},
+		{name: "reference image keeps edit model", key: "model", in: requestPayload{ReferenceImage: "s3://b/k.png"}},
+		{name: "tenant bucket", key: "bucket", in: requestPayload{}, wantBucket: "tenant-bucket"},
+		{name: "no short links off the output bucket", key: "bucket", in: requestPayload{ShortLinks: true}, wantStatus: http.StatusBadRequest},
+		{name: "within cap", key: "capped", in: requestPayload{NumberOfImages: 2}},
+		{name: "over cap", key: "capped", in: requestPayload{NumberOfImages: 1, Prompts: []string{"a", "b", "c"}}, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := tt.in
+			applyTenantModel(&in, tt.key)
+			reqErr := applyTenantConfig(&in, tt.key)
+			if tt.wantStatus != 0 {
+				if reqErr == nil || reqErr.status != tt.wantStatus {
+					t.Fatalf("applyTenantConfig() = %+v, want status %d", reqErr, tt.wantStatus)
+				}
+				return
+			}
+			if reqErr != nil {
+				t.Fatalf("applyTenantConfig() = %+v", reqErr)
+			}
+			if in.model != tt.wantModel || in.bucket != tt.wantBucket {
+				t.Errorf("model %q, bucket %q; want %q, %q", in.model, in.bucket, tt.wantModel, tt.wantBucket)
+			}
+		})
+	}
+}
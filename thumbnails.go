@@ -0,0 +1,94 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+)
+
+// thumbnailSize is the maximum width/height of thumbnails, from THUMBNAIL_SIZE.
+var thumbnailSize = 256
+
+// Limits of the sizes request field.
+const (
+	maxVariantSizes = 4
+	minVariantSize  = 16
+	maxVariantSize  = 4096
+)
+
+// defaultSpriteColumns is used when a sprite sheet request omits spriteColumns.
+const defaultSpriteColumns = 4
+
+// spriteFrame is the rectangle one thumbnail occupies in a sprite sheet.
+type spriteFrame struct {
+	Index  int `json:"index"` // position in imageUrls
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type spriteSheet struct {
+	URL    string        `json:"url"`
+	Width  int           `json:"width"`
+	Height int           `json:"height"`
+	Frames []spriteFrame `json:"frames"`
+}
+
+// makeThumbnail decodes a generated image and scales it to thumbnailSize.
+func makeThumbnail(imgBytes []byte) (image.Image, error) {
+	img, err := decodeImage(imgBytes)
+	if err != nil {
+		return nil, err
+	}
+	return resizeToFit(img, thumbnailSize), nil
+}
+
+// layoutSprite arranges images of the given sizes in a grid with cols
+// columns. Every cell is as large as the largest image, and each image sits
+// in the top-left corner of its cell. It returns one frame per image and the
+// overall sheet size.
+func layoutSprite(sizes []image.Point, cols int) (frames []spriteFrame, width, height int) {
+	if len(sizes) == 0 {
+		return nil, 0, 0
+	}
+	if cols > len(sizes) {
+		cols = len(sizes)
+	}
+	var cellW, cellH int
+	for _, s := range sizes {
+		if s.X > cellW {
+			cellW = s.X
+		}
+		if s.Y > cellH {
+			cellH = s.Y
+		}
+	}
+	rows := (len(sizes) + cols - 1) / cols
+	frames = make([]spriteFrame, len(sizes))
+	for i, s := range sizes {
+		frames[i] = spriteFrame{
+			Index:  i,
+			X:      (i % cols) * cellW,
+			Y:      (i / cols) * cellH,
+			Width:  s.X,
+			Height: s.Y,
+		}
+	}
+	return frames, cols * cellW, rows * cellH
+}
+
+// composeSprite draws thumbs into a single sheet laid out by layoutSprite.
+func composeSprite(thumbs []image.Image, cols int) (*image.RGBA, []spriteFrame) {
+	sizes := make([]image.Point, len(thumbs))
+	for i, t := range thumbs {
+		sizes[i] = t.Bounds().Size()
+	}
+	frames, w, h := layoutSprite(sizes, cols)
+	sheet := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i, t := range thumbs {
+		f := frames[i]
+		r := image.Rect(f.X, f.Y, f.X+f.Width, f.Y+f.Height)
+		draw.Draw(sheet, r, t, t.Bounds().Min, draw.Src)
+	}
+	return sheet, frames
+}
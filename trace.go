@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// upstreamRequestIDHeaders are the response headers that may carry an
+// identifier Google support can use to find a request, in preference order.
+var upstreamRequestIDHeaders = []string{
+	"X-Goog-Request-Id",
+	"X-Request-Id",
+	"X-Cloud-Trace-Context",
+}
+
+type traceKey struct{}
+
+// upstreamTrace records the request ID of the last GenAI HTTP response made
+// with a context returned by withUpstreamTrace.
+type upstreamTrace struct {
+	mu sync.Mutex
+	id string
+}
+
+func withUpstreamTrace(ctx context.Context) (context.Context, *upstreamTrace) {
+	t := &upstreamTrace{}
+	return context.WithValue(ctx, traceKey{}, t), t
+}
+
+func (t *upstreamTrace) record(h http.Header) {
+	for _, name := range upstreamRequestIDHeaders {
+		if v := h.Get(name); v != "" {
+			t.mu.Lock()
+			t.id = v
+			t.mu.Unlock()
+			return
+		}
+	}
+}
+
+// ID returns the recorded request ID, or "" if none was seen.
+func (t *upstreamTrace) ID() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.id
+}
+
+// traceTransport records upstream request IDs from responses into the
+// upstreamTrace stored on the request context, if any.
+type traceTransport struct {
+	base http.RoundTripper
+}
+
+func (t traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if tr, ok := req.Context().Value(traceKey{}).(*upstreamTrace); ok {
+		tr.record(resp.Header)
+	}
+	return resp, nil
+}
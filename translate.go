@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+var (
+	// autoTranslate sends non-English prompts to Imagen in English, which it
+	// renders best (AUTO_TRANSLATE).
+	autoTranslate bool
+	// translateModel detects the language and translates (TRANSLATE_MODEL).
+	translateModel = "gemini-2.5-flash"
+)
+
+const translateInstruction = "Identify the language of the image generation prompt below. " +
+	"Reply with its ISO 639-1 code alone on the first line. If it isn't English, put a faithful English " +
+	"translation of the prompt on the second line, keeping names, quoted text and style terms as they are. " +
+	"Reply with nothing else.\n\nPrompt: "
+
+// translator returns the language of prompt and, unless it is "en", the
+// prompt in English.
+type translator func(ctx context.Context, prompt string) (lang, english string, err error)
+
+// geminiTranslate is the translator backed by translateModel.
+func geminiTranslate(ctx context.Context, prompt string) (string, string, error) {
+	if err := genaiLimit.acquire(ctx); err != nil {
+		return "", "", err
+	}
+	defer genaiLimit.release()
+	resp, err := genaiClient.Models.GenerateContent(ctx, translateModel, genai.Text(translateInstruction+prompt), &genai.GenerateContentConfig{
+		MaxOutputTokens: 1024,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return parseTranslation(resp.Text())
+}
+
+// parseTranslation splits a translateInstruction reply into its language
+// code and translation.
+func parseTranslation(reply string) (string, string, error) {
+	first, rest, _ := strings.Cut(strings.TrimSpace(reply), "\n")
+	lang := strings.ToLower(strings.TrimSpace(first))
+	english := strings.Join(strings.Fields(rest), " ")
+	if len(lang) != 2 {
+		return "", "", errors.New("model returned no language code")
+	}
+	if lang != "en" && english == "" {
+		return "", "", errors.New("model returned no translation")
+	}
+	return lang, english, nil
+}
+
+// translatePrompt returns prompt in English and the language it was
+// translated from, or prompt itself and "" when it already is English. A
+// failed translation is logged and the prompt is used as written.
+func translatePrompt(ctx context.Context, prompt string, translate translator) (string, string) {
+	lang, english, err := translate(ctx, prompt)
+	if err != nil {
+		log.Printf("warning: prompt translation failed, using it as written: %v", err)
+		return prompt, ""
+	}
+	if lang == "en" {
+		return prompt, ""
+	}
+	log.Printf("translated prompt from %s: %q", lang, redactPrompt(english))
+	return english, lang
+}
+
+// translateForModel translates a sanitized prompt when AUTO_TRANSLATE is on.
+// The translation is model output, so it is sanitized again before
+// parseRequest runs the remaining prompt checks on it.
+func translateForModel(ctx context.Context, prompt string) (string, string, error) {
+	if !autoTranslate {
+		return prompt, "", nil
+	}
+	english, lang := translatePrompt(ctx, prompt, geminiTranslate)
+	if lang == "" {
+		return prompt, "", nil
+	}
+	clean, err := sanitizePrompt(english)
+	if err != nil {
+		return "", "", fmt.Errorf("translated prompt: %w", err)
+	}
+	if strings.TrimSpace(clean) == "" {
+		return "", "", errors.New("translated prompt is empty")
+	}
+	return clean, lang, nil
+}
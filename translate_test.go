@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestParseTranslation(t *testing.T) {
+	tests := []struct {
+		reply       string
+		wantLang    string
+		wantEnglish string
+		wantErr     bool
+	}{
+		{reply: "en", wantLang: "en"},
+		{reply: " FR \n un chat \n sur un toit ", wantLang: "fr", wantEnglish: "un chat sur un toit"},
+		{reply: "de\na cat on a roof", wantLang: "de", wantEnglish: "a cat on a roof"},
+		{reply: "de", wantErr: true},
+		{reply: "", wantErr: true},
+		{reply: "French\na cat", wantErr: true},
+	}
+	for _, tt := range tests {
+		lang, english, err := parseTranslation(tt.reply)
+		if (err != nil) != tt.wantErr || lang != tt.wantLang || english != tt.wantEnglish {
+			t.Errorf("parseTranslation(%q) = %q, %q, %v; want %q, %q, error %t",
+				tt.reply, lang, english, err, tt.wantLang, tt.wantEnglish, tt.wantErr)
+		}
+	}
+}
+
+func TestTranslatePrompt(t *testing.T) {
+	tests := []struct {
+		name     string
+		lang     string
+		english  string
+		err      error
+		want     string
+		wantLang string
+	}{
+		{name: "english", lang: "en", want: "un gato"},
+		{name: "translated", lang: "es", english: "a cat", want: "a cat", wantLang: "es"},
+		{name: "failure keeps prompt", err: errors.New("boom"), want: "un gato"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			translate := func(context.Context, string) (string, string, error) { return tt.lang, tt.english, tt.err }
+			got, lang := translatePrompt(context.Background(), "un gato", translate)
+			if got != tt.want || lang != tt.wantLang {
+				t.Errorf("translatePrompt() = %q, %q; want %q, %q", got, lang, tt.want, tt.wantLang)
+			}
+		})
+	}
+}
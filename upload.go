@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// watchdogReserve is the time kept back for the response once uploads are
+// under way (WATCHDOG_RESERVE_MS). No upload starts later than that before
+// the invocation deadline.
+var watchdogReserve = 5 * time.Second
+
+// imageUploader uploads one image for uploadImages.
+var imageUploader = uploadImage
+
+// maxUploadConcurrency caps how many images of a request are processed and
+// uploaded at once (UPLOAD_CONCURRENCY).
+var maxUploadConcurrency = 8
+
+// uploadConcurrency returns how many workers to use for n images: one per
+// image up to maxUploadConcurrency. A single image is handled inline.
+func uploadConcurrency(n int) int {
+	if n < 1 {
+		return 1
+	}
+	if n > maxUploadConcurrency {
+		return maxUploadConcurrency
+	}
+	return n
+}
+
+// uploadedImage is the outcome of uploading one generated image.
+type uploadedImage struct {
+	key         string
+	url         string
+	etag        string
+	checksum    string // base64 SHA-256 confirmed by S3
+	blurhash    string
+	variants    map[string]string // size → URL
+	altText     string
+	labels      []string // AUTO_LABEL
+	reuploadURL string
+	shortLink   string
+	thumb       image.Image
+	thumbURL    string
+	lqipURL     string // GENERATE_LQIP
+	data        []byte // uploaded bytes, kept for the contact sheet, animation and atlas
+	contentType string
+}
+
+// uploadImages uploads images with uploadConcurrency workers. Results keep
+// the order of images whatever order the uploads finish in; onUpload sees
+// completions as they happen, one call at a time. The first failure cancels
+// the remaining uploads. Close to the deadline no new uploads start, and
+// only the images already uploaded are returned.
+func uploadImages(ctx context.Context, in requestPayload, images []*genai.GeneratedImage, now time.Time, opts uploadOptions, onUpload func(uploadProgress)) ([]uploadedImage, *requestError) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]uploadedImage, len(images))
+	var (
+		mu       sync.Mutex
+		done     int
+		firstErr *requestError
+	)
+	work := func(idx int) {
+		u, reqErr := imageUploader(ctx, in, idx, images[idx], now, opts)
+		mu.Lock()
+		defer mu.Unlock()
+		if reqErr != nil {
+			if firstErr == nil {
+				firstErr = reqErr
+				cancel()
+			}
+			return
+		}
+		// Indexed by position, never appended, so completion order can't
+		// reorder the results
+		results[idx] = u
+		done++
+		if onUpload != nil && firstErr == nil {
+			onUpload(uploadProgress{Index: idx, URL: u.url, Done: done, Total: len(images)})
+		}
+	}
+
+	deadline, watched := ctx.Deadline()
+	outOfTime := func() bool {
+		return watched && time.Until(deadline) < watchdogReserve
+	}
+	// Uploads start in index order, so the first started images are the
+	// ones that finished
+	started := 0
+	partial := func() ([]uploadedImage, *requestError) {
+		if firstErr != nil || started == len(images) {
+			return results, firstErr
+		}
+		log.Printf("stopping after %d of %d uploads: %v left before the deadline", started, len(images), time.Until(deadline).Round(time.Millisecond))
+		if started == 0 {
+			return nil, &requestError{status: http.StatusGatewayTimeout, msg: "no time left to upload images"}
+		}
+		return results[:started], nil
+	}
+
+	workers := uploadConcurrency(len(images))
+	if workers == 1 {
+		for idx := range images {
+			if outOfTime() {
+				break
+			}
+			started++
+			if work(idx); firstErr != nil {
+				break
+			}
+		}
+		return partial()
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range next {
+				work(idx)
+			}
+		}()
+	}
+feed:
+	for idx := range images {
+		if outOfTime() {
+			break
+		}
+		select {
+		case next <- idx:
+			started++
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = &requestError{status: http.StatusGatewayTimeout, msg: fmt.Sprintf("upload interrupted: %v", ctx.Err())}
+	}
+	return partial()
+}
+
+// uploadImage prepares image idx (crop, format, size limit, DPI) and uploads
+// it along with its optional presigned re-upload URL and thumbnail.
+func uploadImage(ctx context.Context, in requestPayload, idx int, img *genai.GeneratedImage, now time.Time, opts uploadOptions) (uploadedImage, *requestError) {
+	var u uploadedImage
+	data, contentType := img.Image.ImageBytes, contentTypeFor("png")
+	if in.cropW > 0 {
+		var err error
+		if data, err = cropToAspect(data, in.cropW, in.cropH); err != nil {
+			return u, &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to crop image %d: %v", idx, err)}
+		}
+	}
+	if maxWidth > 0 || maxHeight > 0 {
+		var err error
+		if data, err = limitDimensions(data, maxWidth, maxHeight, dimensionPolicy == dimensionPolicyReject); err != nil {
+			return u, &requestError{status: http.StatusUnprocessableEntity, msg: fmt.Sprintf("image %d exceeds MAX_WIDTH/MAX_HEIGHT: %v", idx, err)}
+		}
+	}
+	generated := data
+	// Alt text and the contact sheet keep the PNG when uploading AVIF, as
+	// their consumers can't read it
+	source, sourceType := data, contentType
+	if in.OutputFormat == "avif" {
+		var err error
+		if data, err = encodeAVIF(data, in.OutputQuality); err != nil {
+			log.Printf("AVIF encoding failed for image %d: %v", idx, err)
+			return u, &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to encode image %d as AVIF: %v", idx, err)}
+		}
+		contentType = contentTypeFor("avif")
+		if maxImageBytes > 0 && len(data) > maxImageBytes {
+			return u, &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("image %d exceeds MAX_IMAGE_BYTES as AVIF (%d bytes)", idx, len(data))}
+		}
+	} else if maxImageBytes > 0 {
+		var err error
+		data, contentType, err = fitToSize(data, contentType, maxImageBytes)
+		if err != nil {
+			log.Printf("image %d too large: %v", idx, err)
+			return u, &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("image %d exceeds MAX_IMAGE_BYTES: %v", idx, err)}
+		}
+	}
+	if in.OutputDPI > 0 {
+		var err error
+		if data, err = setDPI(data, contentType, in.OutputDPI); err != nil {
+			return u, &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to set DPI on image %d: %v", idx, err)}
+		}
+	}
+	if contentType != contentTypeFor("avif") {
+		source, sourceType = data, contentType
+	}
+	u.key = objectKey(in.outputPrefix, in.Prompt, in.namePrefix+strconv.Itoa(idx), extensionFor(contentType), now)
+	if in.firstSeq > 0 {
+		u.key = sequentialKey(in.outputPrefix, in.firstSeq+idx, extensionFor(contentType))
+	}
+	if err := checkKey(u.key); err != nil {
+		return u, uploadFailed("image", err)
+	}
+	if generateAltText {
+		// Best effort: an image without alt text is still worth returning
+		alt, err := describeImage(ctx, source, sourceType)
+		if err != nil {
+			log.Printf("alt text failed for image %d: %v", idx, err)
+		} else {
+			u.altText = alt
+			// Long descriptions are cut to fit S3's 2 KB limit; the
+			// response still has the whole text
+			opts.metadata = withEscapedMetadata(opts.metadata, "alt-text", alt)
+		}
+	}
+	if autoLabel {
+		// Best effort, like alt text: an unlabeled image is still returned
+		labels, err := labelImage(ctx, source, sourceType)
+		if err == nil {
+			opts.tagging, err = withLabelTag(opts.tagging, labels)
+		}
+		if err != nil {
+			log.Printf("labeling failed for image %d: %v", idx, err)
+		} else {
+			u.labels = labels
+		}
+	}
+	if generateLQIP {
+		// Uploaded first, so the placeholder is never missing while the
+		// full image exists
+		lqip, err := makeLQIP(generated, lqipWidth)
+		if err != nil {
+			return u, &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to create placeholder for image %d: %v", idx, err)}
+		}
+		if u.lqipURL, err = putObject(ctx, lqipKey(u.key), lqip, contentTypeFor("jpeg"), opts); err != nil {
+			return u, uploadFailed("placeholder", err)
+		}
+	}
+	if in.FriendlyFilenames {
+		opts.downloadName = promptSlug(in.Prompt) + "." + extensionFor(contentType)
+		if in.NumberOfImages > 1 || in.namePrefix != "" {
+			opts.downloadName = fmt.Sprintf("%s-%s%d.%s", promptSlug(in.Prompt), in.namePrefix, idx+1, extensionFor(contentType))
+		}
+	}
+	obj, err := putObjectStored(ctx, u.key, data, contentType, opts)
+	if err != nil {
+		return u, uploadFailed("image", err)
+	}
+	statUploads.Add(1)
+	u.url, u.etag, u.checksum = obj.url, obj.etag, obj.checksum
+	if in.ContactSheetPDF || in.OutputFormat == "webp-anim" || in.Atlas {
+		u.data, u.contentType = source, sourceType
+	}
+	if in.ShortLinks {
+		link, err := links.create(ctx, u.key)
+		if err != nil {
+			log.Printf("short link failed for %s: %v", u.key, err)
+			return u, &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to create short link: %v", err)}
+		}
+		u.shortLink = link
+	}
+
+	if in.IncludeReuploadURLs {
+		putURL, err := presignPut(ctx, opts.targetBucket(u.key), u.key, contentType)
+		if err != nil {
+			log.Printf("presign PUT failed for %s: %v", u.key, err)
+			return u, &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to presign upload URL: %v", err)}
+		}
+		u.reuploadURL = putURL
+	}
+
+	if in.Blurhash {
+		hash, err := blurHash(generated)
+		if err != nil {
+			return u, &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to compute blurhash of image %d: %v", idx, err)}
+		}
+		u.blurhash = hash
+	}
+
+	if len(in.Sizes) > 0 {
+		variants, reqErr := uploadVariants(ctx, u.key, generated, in.Sizes, opts)
+		if reqErr != nil {
+			return u, reqErr
+		}
+		u.variants = variants
+	}
+
+	if in.Thumbnails {
+		thumb, err := makeThumbnail(generated)
+		if err != nil {
+			log.Printf("thumbnail failed for %s: %v", u.key, err)
+			return u, &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to create thumbnail: %v", err)}
+		}
+		thumbBytes, err := encodePNG(thumb)
+		if err != nil {
+			return u, &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to encode thumbnail: %v", err)}
+		}
+		opts.downloadName = ""
+		thumbURL, err := putObject(ctx, strings.TrimSuffix(u.key, path.Ext(u.key))+"_thumb.png", thumbBytes, contentTypeFor("png"), opts)
+		if err != nil {
+			return u, uploadFailed("thumbnail", err)
+		}
+		u.thumb, u.thumbURL = thumb, thumbURL
+	}
+	return u, nil
+}
+
+// uploadVariants uploads a PNG copy of data scaled to fit each of sizes,
+// as <key>_<size>.png. Images are never scaled up, so a size larger than
+// the image gets a full-size copy.
+func uploadVariants(ctx context.Context, key string, data []byte, sizes []int, opts uploadOptions) (map[string]string, *requestError) {
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to decode image for resizing: %v", err)}
+	}
+	opts.downloadName = ""
+	stem := strings.TrimSuffix(key, path.Ext(key))
+	variants := make(map[string]string, len(sizes))
+	for _, size := range sizes {
+		b, err := encodePNG(resizeToFit(img, size))
+		if err != nil {
+			return nil, &requestError{status: http.StatusInternalServerError, msg: fmt.Sprintf("failed to encode %dpx variant: %v", size, err)}
+		}
+		url, err := putObject(ctx, fmt.Sprintf("%s_%d.png", stem, size), b, contentTypeFor("png"), opts)
+		if err != nil {
+			return nil, uploadFailed(fmt.Sprintf("%dpx variant", size), err)
+		}
+		variants[strconv.Itoa(size)] = url
+	}
+	return variants, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+func TestUploadImagesOutOfOrder(t *testing.T) {
+	defer func(u func(context.Context, requestPayload, int, *genai.GeneratedImage, time.Time, uploadOptions) (uploadedImage, *requestError)) {
+		imageUploader = u
+	}(imageUploader)
+	const n = 4
+	// Image i may only finish once image i+1 has, so uploads complete in
+	// reverse order
+	release := make([]chan struct{}, n)
+	for i := range release {
+		release[i] = make(chan struct{})
+	}
+	close(release[n-1])
+	imageUploader = func(_ context.Context, _ requestPayload, idx int, _ *genai.GeneratedImage, _ time.Time, _ uploadOptions) (uploadedImage, *requestError) {
+		<-release[idx]
+		return uploadedImage{url: fmt.Sprintf("https://example.com/%d.png", idx)}, nil
+	}
+	var completed []int
+	onUpload := func(u uploadProgress) {
+		completed = append(completed, u.Index)
+		if u.Index > 0 {
+			close(release[u.Index-1])
+		}
+	}
+
+	images := generated(n).GeneratedImages
+	results, reqErr := uploadImages(context.Background(), requestPayload{}, images, time.Now(), uploadOptions{}, onUpload)
+	if reqErr != nil {
+		t.Fatal(reqErr.msg)
+	}
+	if fmt.Sprint(completed) != "[3 2 1 0]" {
+		t.Fatalf("uploads completed in order %v, want [3 2 1 0]", completed)
+	}
+	for i, u := range results {
+		if want := fmt.Sprintf("https://example.com/%d.png", i); u.url != want {
+			t.Errorf("results[%d] = %s, want %s", i, u.url, want)
+		}
+	}
+}
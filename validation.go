@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// validationConfig is a per-deployment request policy (VALIDATION_CONFIG),
+// applied on top of the built-in checks. Fields are named by their JSON
+// request names, e.g.
+//
+//	{"required": ["aspectRatio"],
+//	 "allowed": {"personGeneration": ["dont_allow"]},
+//	 "ranges": {"numberOfImages": {"min": 1, "max": 2}}}
+type validationConfig struct {
+	Required []string                `json:"required"`
+	Allowed  map[string][]string     `json:"allowed"`
+	Ranges   map[string]numericRange `json:"ranges"`
+}
+
+type numericRange struct {
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+}
+
+// validation is nil unless VALIDATION_CONFIG is set.
+var validation *validationConfig
+
+// parseValidationConfig parses s, rejecting names that aren't request fields
+// so that a typo in the policy doesn't silently disable a rule.
+func parseValidationConfig(s string) (*validationConfig, error) {
+	var cfg validationConfig
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	known := requestFieldNames()
+	var names []string
+	names = append(names, cfg.Required...)
+	for name := range cfg.Allowed {
+		names = append(names, name)
+	}
+	for name := range cfg.Ranges {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown request field %q", name)
+		}
+	}
+	return &cfg, nil
+}
+
+// requestFieldNames returns the JSON names of requestPayload's fields.
+func requestFieldNames() map[string]bool {
+	names := map[string]bool{}
+	t := reflect.TypeOf(requestPayload{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// check validates the request as the client sent it, before defaults are
+// applied. A field counts as missing when it's absent or has its zero value.
+func (c *validationConfig) check(in requestPayload) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	for _, name := range c.Required {
+		if v, ok := fields[name]; !ok || isZeroJSON(v) {
+			return fmt.Errorf("%s is required", name)
+		}
+	}
+	for name, allowed := range c.Allowed {
+		v, ok := fields[name].(string)
+		if !ok || v == "" {
+			continue
+		}
+		if !containsFold(allowed, v) {
+			return fmt.Errorf("%s must be one of %s", name, strings.Join(allowed, ", "))
+		}
+	}
+	for name, r := range c.Ranges {
+		v, ok := fields[name].(float64)
+		if !ok || v == 0 {
+			continue
+		}
+		if (r.Min != nil && v < *r.Min) || (r.Max != nil && v > *r.Max) {
+			return fmt.Errorf("%s must be %s", name, r)
+		}
+	}
+	return nil
+}
+
+func (r numericRange) String() string {
+	switch {
+	case r.Min != nil && r.Max != nil:
+		return fmt.Sprintf("between %g and %g", *r.Min, *r.Max)
+	case r.Min != nil:
+		return fmt.Sprintf("at least %g", *r.Min)
+	case r.Max != nil:
+		return fmt.Sprintf("at most %g", *r.Max)
+	}
+	return "a number"
+}
+
+func isZeroJSON(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case float64:
+		return v == 0
+	case bool:
+		return !v
+	case []any:
+		return len(v) == 0
+	case map[string]any:
+		return len(v) == 0
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
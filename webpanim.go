@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"time"
+
+	"github.com/gen2brain/webp"
+)
+
+// Animated WebP output for outputFormat "webp-anim": the images are uploaded
+// as usual and also assembled, in response order, into one looping
+// animation. Like AVIF, the frame encoder is pure Go (WebAssembly).
+var (
+	// webpAvailable is false when the startup check found the encoder
+	// unusable; animation requests are then refused up front.
+	webpAvailable bool
+	// animationFrameDelay is how long each frame shows
+	// (ANIMATION_FRAME_DELAY_MS).
+	animationFrameDelay = 500 * time.Millisecond
+)
+
+// maxFrameMillis is the largest frame duration an ANMF chunk can hold.
+const maxFrameMillis = 1<<24 - 1
+
+// checkWebP encodes a 1x1 image to confirm the encoder works here.
+func checkWebP() error {
+	var buf bytes.Buffer
+	return webp.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1)), webp.Options{Quality: webp.DefaultQuality})
+}
+
+// webpFrame is one encoded image ready to go into an ANMF chunk.
+type webpFrame struct {
+	width, height int
+	data          []byte // the still image's ALPH, VP8 and VP8L chunks
+}
+
+// encodeAnimatedWebP encodes generated PNG or JPEG images as the frames of
+// an animated WebP at quality (1-100, 0 for the encoder default).
+func encodeAnimatedWebP(images [][]byte, quality int, delay time.Duration) ([]byte, error) {
+	if len(images) == 0 {
+		return nil, errors.New("no frames")
+	}
+	if quality == 0 {
+		quality = webp.DefaultQuality
+	}
+	frames := make([]webpFrame, len(images))
+	for i, data := range images {
+		img, err := decodeImage(data)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+		var buf bytes.Buffer
+		if err := webp.Encode(&buf, img, webp.Options{Quality: quality}); err != nil {
+			return nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+		chunks, err := frameChunks(buf.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+		frames[i] = webpFrame{width: img.Bounds().Dx(), height: img.Bounds().Dy(), data: chunks}
+	}
+	return assembleAnimation(frames, delay), nil
+}
+
+// encodeStillWebP encodes one generated PNG or JPEG image as a still WebP at
+// quality (1-100, 0 for the encoder default).
+func encodeStillWebP(data []byte, quality int) ([]byte, error) {
+	if quality == 0 {
+		quality = webp.DefaultQuality
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, img, webp.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// frameChunks returns the chunks of a still WebP file that make up its
+// image, dropping the RIFF header and any VP8X, ICC or metadata chunks.
+func frameChunks(file []byte) ([]byte, error) {
+	if len(file) < 12 || string(file[0:4]) != "RIFF" || string(file[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP file")
+	}
+	var out []byte
+	for rest := file[12:]; len(rest) >= 8; {
+		fourCC, size := string(rest[0:4]), int(binary.LittleEndian.Uint32(rest[4:8]))
+		if 8+size > len(rest) {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		switch fourCC {
+		case "ALPH", "VP8 ", "VP8L":
+			out = appendChunk(out, fourCC, rest[8:8+size])
+		}
+		rest = rest[min(8+size+size&1, len(rest)):]
+	}
+	if len(out) == 0 {
+		return nil, errors.New("WebP file has no image data")
+	}
+	return out, nil
+}
+
+// assembleAnimation wraps frames in an extended-format WebP that loops
+// forever, each frame shown for delay at the top left of a canvas sized to
+// the largest frame.
+func assembleAnimation(frames []webpFrame, delay time.Duration) []byte {
+	var canvasW, canvasH int
+	for _, f := range frames {
+		canvasW, canvasH = max(canvasW, f.width), max(canvasH, f.height)
+	}
+	millis := min(max(delay.Milliseconds(), 0), maxFrameMillis)
+
+	var body []byte
+	vp8x := []byte{0x02 | 0x10, 0, 0, 0} // animation and alpha flags
+	vp8x = appendUint24(vp8x, canvasW-1)
+	vp8x = appendUint24(vp8x, canvasH-1)
+	body = appendChunk(body, "VP8X", vp8x)
+	// Transparent background, loop count 0 (forever)
+	body = appendChunk(body, "ANIM", []byte{0, 0, 0, 0, 0, 0})
+	for _, f := range frames {
+		anmf := appendUint24(nil, 0) // X offset / 2
+		anmf = appendUint24(anmf, 0) // Y offset / 2
+		anmf = appendUint24(anmf, f.width-1)
+		anmf = appendUint24(anmf, f.height-1)
+		anmf = appendUint24(anmf, int(millis))
+		anmf = append(anmf, 0x02) // don't blend, don't dispose
+		anmf = append(anmf, f.data...)
+		body = appendChunk(body, "ANMF", anmf)
+	}
+	file := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(4+len(body)))...)
+	file = append(file, "WEBP"...)
+	return append(file, body...)
+}
+
+// appendChunk appends a RIFF chunk, padded to an even length.
+func appendChunk(b []byte, fourCC string, payload []byte) []byte {
+	b = append(b, fourCC...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(payload)))
+	b = append(b, payload...)
+	if len(payload)&1 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// appendUint24 appends v as a little-endian 24-bit integer.
+func appendUint24(b []byte, v int) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"testing"
+	"time"
+)
+
+// riffChunks splits the chunks after a RIFF/WEBP header.
+func riffChunks(t *testing.T, file []byte) (fourCCs []string, payloads [][]byte) {
+	t.Helper()
+	if string(file[0:4]) != "RIFF" || string(file[8:12]) != "WEBP" {
+		t.Fatalf("not a WebP file: % x", file[:12])
+	}
+	if size := int(binary.LittleEndian.Uint32(file[4:8])); size != len(file)-8 {
+		t.Fatalf("RIFF size %d, file has %d bytes after the header", size, len(file)-8)
+	}
+	for rest := file[12:]; len(rest) > 0; {
+		size := int(binary.LittleEndian.Uint32(rest[4:8]))
+		fourCCs = append(fourCCs, string(rest[0:4]))
+		payloads = append(payloads, rest[8:8+size])
+		rest = rest[8+size+size&1:]
+	}
+	return fourCCs, payloads
+}
+
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+func TestEncodeAnimatedWebP(t *testing.T) {
+	if err := checkWebP(); err != nil {
+		t.Skipf("WebP encoder unavailable: %v", err)
+	}
+	small, err := encodePNG(image.NewRGBA(image.Rect(0, 0, 4, 6)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := encodePNG(image.NewRGBA(image.Rect(0, 0, 8, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		frames     [][]byte
+		delay      time.Duration
+		wantCanvas [2]int
+		wantMillis int
+	}{
+		{"one frame", [][]byte{small}, 500 * time.Millisecond, [2]int{4, 6}, 500},
+		{"canvas fits the largest frame", [][]byte{small, large, small}, 80 * time.Millisecond, [2]int{8, 6}, 80},
+		{"delay capped", [][]byte{large}, 10 * time.Hour, [2]int{8, 2}, maxFrameMillis},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			anim, err := encodeAnimatedWebP(tt.frames, 0, tt.delay)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fourCCs, payloads := riffChunks(t, anim)
+			if len(fourCCs) != 2+len(tt.frames) || fourCCs[0] != "VP8X" || fourCCs[1] != "ANIM" {
+				t.Fatalf("chunks = %q, want VP8X, ANIM and %d ANMF", fourCCs, len(tt.frames))
+			}
+			if w, h := uint24(payloads[0][4:])+1, uint24(payloads[0][7:])+1; [2]int{w, h} != tt.wantCanvas {
+				t.Errorf("canvas %dx%d, want %v", w, h, tt.wantCanvas)
+			}
+			for i, anmf := range payloads[2:] {
+				if fourCCs[2+i] != "ANMF" {
+					t.Fatalf("chunk %d is %q, want ANMF", 2+i, fourCCs[2+i])
+				}
+				if got := uint24(anmf[12:]); got != tt.wantMillis {
+					t.Errorf("frame %d shows for %d ms, want %d", i, got, tt.wantMillis)
+				}
+				// The frame's own image chunks follow its 16-byte header
+				switch frame := string(anmf[16:20]); frame {
+				case "VP8 ", "VP8L", "ALPH":
+				default:
+					t.Errorf("frame %d starts with %q, want image data", i, frame)
+				}
+			}
+		})
+	}
+}
+
+func TestFrameChunks(t *testing.T) {
+	still := append([]byte("RIFF\x00\x00\x00\x00WEBP"), appendChunk(appendChunk(nil, "VP8X", make([]byte, 10)), "VP8L", []byte{1, 2, 3})...)
+	tests := []struct {
+		name    string
+		file    []byte
+		want    []byte
+		wantErr bool
+	}{
+		{"keeps image chunks", still, appendChunk(nil, "VP8L", []byte{1, 2, 3}), false},
+		{"not WebP", []byte("RIFF\x00\x00\x00\x00WAVE"), nil, true},
+		{"no image data", []byte("RIFF\x00\x00\x00\x00WEBP"), nil, true},
+		{"truncated", append([]byte("RIFF\x00\x00\x00\x00WEBPVP8L"), 0xff, 0, 0, 0), nil, true},
+	}
+	for _, tt := range tests {
+		got, err := frameChunks(tt.file)
+		if (err != nil) != tt.wantErr || string(got) != string(tt.want) {
+			t.Errorf("%s: frameChunks() = % x, %v; want % x (error %v)", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestEncodeStillWebP(t *testing.T) {
+	if err := checkWebP(); err != nil {
+		t.Skipf("WebP encoder unavailable: %v", err)
+	}
+	png, err := encodePNG(image.NewRGBA(image.Rect(0, 0, 4, 6)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	still, err := encodeStillWebP(png, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fourCCs, _ := riffChunks(t, still)
+	for _, fourCC := range fourCCs {
+		if fourCC == "ANIM" || fourCC == "ANMF" {
+			t.Errorf("still WebP has a %s chunk", fourCC)
+		}
+	}
+	if _, err := encodeAnimatedWebP(nil, 0, time.Second); err == nil {
+		t.Error("encodeAnimatedWebP() accepted no frames")
+	}
+}